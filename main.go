@@ -1,58 +1,213 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/alecthomas/kong"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipfsplugin "github.com/ipfs/go-ipfs/plugin"
+	"github.com/ipfs/go-ipfs/plugin/plugins/badgerds"
+	"github.com/ipfs/go-ipfs/plugin/plugins/flatfs"
+	"github.com/ipfs/go-ipfs/plugin/plugins/levelds"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/mbndr/figlet4go"
+	mh "github.com/multiformats/go-multihash"
 
 	"github.com/allisterb/go-ds-motr/mio"
+	"github.com/allisterb/go-ds-motr/motrds"
+	"github.com/allisterb/go-ds-motr/plugin"
 	"github.com/allisterb/go-ds-motr/uint128"
 )
 
 type OidCmd struct {
-	Name  string `arg:"" name:"name" help:"Object id or key name to generate 128-bit object id for."`
-	Parse bool   `help:"Parse name as 128-bit object id." short:"P"`
+	Name   string `arg:"" name:"name" help:"Object id or key name to generate 128-bit object id for."`
+	Parse  bool   `help:"Parse name as 128-bit object id." short:"P"`
+	Scheme string `help:"Key scheme used to generate the object id from the key name." default:"legacy" enum:"legacy,fnv1a-128,sha256-128"`
+}
+
+type CidCmd struct {
+	Value     string `arg:"" name:"value" help:"CID, datastore key (starting with /) or hex Motr key (starting with 0x) of a block."`
+	Scheme    string `help:"Key scheme used to derive the Motr key from the datastore key." default:"multihash" enum:"legacy,raw,fnv1a-128,sha256-128,multihash"`
+	Namespace string `help:"Datastore namespace holding blocks, / when the datastore is mounted at /blocks." default:"/blocks" short:"n"`
+	Hash      string `help:"Multihash function of the digest in a hex Motr key, which Motr keys don't record." default:"sha2-256"`
+}
+
+// MotrConn holds the flags locating the Motr cluster. Values not given as flags or
+// environment variables are taken from the selected connection profile.
+type MotrConn struct {
+	LocalEP    string `name:"local" short:"L" env:"MOTRDS_LOCAL_ADDR" help:"Motr local endpoint address."`
+	HaxEP      string `name:"hax" short:"H" env:"MOTRDS_HAX_ADDR" help:"Motr HA endpoint address."`
+	ProfileFid string `name:"profile" short:"C" env:"MOTRDS_PROFILE_FID" help:"Cluster profile fid."`
+	ProcessFid string `name:"process" short:"P" env:"MOTRDS_PROCESS_FID" help:"Local process fid."`
+}
+
+// Connection is a named connection profile, with the same keys as the motrds
+// datastore spec.
+type Connection struct {
+	LocalAddr  string `json:"localAddr"`
+	HaxAddr    string `json:"haxAddr"`
+	ProfileFid string `json:"profileFid"`
+	ProcessFid string `json:"processFid"`
+}
+
+// Connections is the content of the connection profiles file.
+type Connections struct {
+	Default     string                `json:"default,omitempty"`
+	Connections map[string]Connection `json:"connections"`
+}
+
+type ConnectionAddCmd struct {
+	MotrConn `embed:""`
+	Name     string `arg:"" name:"name" help:"Name of the connection profile."`
+	Default  bool   `help:"Use this connection profile when none is selected."`
+}
+
+type ConnectionImportCmd struct {
+	Name    string `arg:"" name:"name" help:"Name of the connection profile."`
+	Path    string `arg:"" name:"path" help:"IPFS repo directory or datastore_spec file to import the connection from."`
+	Idx     string `name:"index" short:"i" help:"Index of the motrds datastore to import when the repo has several."`
+	Default bool   `help:"Use this connection profile when none is selected."`
+}
+
+type ConnectionListCmd struct{}
+
+type ConnectionRemoveCmd struct {
+	Name string `arg:"" name:"name" help:"Name of the connection profile."`
+}
+
+type ConnectionCmd struct {
+	Add    ConnectionAddCmd    `cmd:"" help:"Add or replace a connection profile."`
+	Import ConnectionImportCmd `cmd:"" help:"Add or replace a connection profile with the Motr connection of an IPFS repo's motrds datastore."`
+	List   ConnectionListCmd   `cmd:"" help:"List the connection profiles."`
+	Remove ConnectionRemoveCmd `cmd:"" help:"Remove a connection profile."`
 }
 
 type IndexCmd struct {
-	LocalEP    string `required:"" name:"local" short:"L" help:"Motr local endpoint address."`
-	HaxEP      string `required:"" name:"hax" short:"H" help:"Motr local endpoint address."`
-	ProfileFid string `required:"" name:"profile" short:"C" help:"Cluster profile fid."`
-	ProcessFid string `required:"" name:"process" short:"P" help:"Local process fid."`
-	Name       string `arg:"" name:"name" help:"Name of index to create or delete."`
-	Create     bool   `help:"Create an index with this name."`
-	Delete     bool   `help:"Delete the index with this name."`
+	MotrConn `embed:""`
+	Name     string `arg:"" name:"name" help:"Name of index to create or delete."`
+	Create   bool   `help:"Create an index with this name."`
+	Delete   bool   `help:"Delete the index with this name."`
 }
 
 type StoreCmd struct {
-	LocalEP    string `required:"" name:"local" short:"L" help:"Motr local endpoint address."`
-	HaxEP      string `required:"" name:"hax" short:"H" help:"Motr local endpoint address."`
-	ProfileFid string `required:"" name:"profile" short:"C" help:"Cluster profile fid."`
-	ProcessFid string `required:"" name:"process" short:"P" help:"Local process fid."`
-	Idx        string `arg:"" name:"index" required:"" help:"Index ID."`
-	Key        string `arg:"" name:"key" required:"" help:"Key name."`
-	Value      string `arg:"" default:"" name:"key" help:"Value to store, or omit to retrieve the value stored at this key."`
-	Delete     bool   `help:"Delete object identified by this key." short:"d"`
-	Update     bool   `help:"Update object identified by this key with a new value." short:"u"`
-	File       bool   `help:"Update object identified by this key with a new value." short:"f"`
-	Size       bool   `help:"Get the size of object identified by this key with a new value." short:"s"`
+	MotrConn `embed:""`
+	Idx      string `arg:"" name:"index" required:"" help:"Index ID."`
+	Key      string `arg:"" name:"key" required:"" help:"Key name."`
+	Value    string `arg:"" default:"" name:"key" help:"Value to store, or omit to retrieve the value stored at this key."`
+	Delete   bool   `help:"Delete object identified by this key." short:"d"`
+	Update   bool   `help:"Update object identified by this key with a new value." short:"u"`
+	File     bool   `help:"Update object identified by this key with a new value." short:"f"`
+	Size     bool   `help:"Get the size of object identified by this key with a new value." short:"s"`
+	Scheme   string `help:"Key scheme used to derive the Motr key from the key name." default:"legacy" enum:"legacy,raw,fnv1a-128,sha256-128,multihash"`
+}
+
+type SchemeCmd struct {
+	MotrConn     `embed:""`
+	LevelDBPath  string `name:"leveldb" short:"D" help:"Path to the LevelDB or Badger catalogue of the datastore using the index."`
+	Catalogue    string `help:"Catalogue backend of the datastore using the index." enum:"leveldb,badger,motr" default:"leveldb"`
+	CatalogueIdx string `name:"catalogue-index" help:"Motr index holding the catalogue when the catalogue backend is motr."`
+	Idx          string `arg:"" name:"index" required:"" help:"Index ID."`
+	Migrate      string `help:"Migrate the index to this key scheme." enum:",legacy,raw,fnv1a-128,sha256-128,multihash" default:""`
+}
+
+type ReencryptCmd struct {
+	MotrConn           `embed:""`
+	LevelDBPath        string `name:"leveldb" short:"D" help:"Path to the LevelDB or Badger catalogue of the datastore using the index."`
+	Catalogue          string `help:"Catalogue backend of the datastore using the index." enum:"leveldb,badger,motr" default:"leveldb"`
+	CatalogueIdx       string `name:"catalogue-index" help:"Motr index holding the catalogue when the catalogue backend is motr."`
+	Idx                string `arg:"" name:"index" required:"" help:"Index ID."`
+	Encryption         string `help:"Encryption algorithm to re-encrypt values with." default:"aes-gcm" enum:"aes-gcm,xchacha20-poly1305"`
+	KeyFile            string `help:"File containing the encryption keys, the last key is used to re-encrypt values." name:"key-file" xor:"keys"`
+	KeyEnv             string `help:"Environment variable containing the encryption keys, the last key is used to re-encrypt values." name:"key-env" xor:"keys"`
+	Compression        string `help:"Compression of the re-encrypted values, which should match the compression in the datastore's spec." default:"none" enum:"none,zstd,snappy"`
+	CompressionMinSize int    `name:"compression-min-size" help:"Smallest value compressed, 0 for the datastore's default, which should match compressionMinSize in the datastore's spec."`
+}
+
+type MigrateCmd struct {
+	MotrConn     `embed:""`
+	LevelDBPath  string `name:"leveldb" short:"D" help:"Path to the LevelDB or Badger catalogue of the Motr datastore."`
+	Catalogue    string `help:"Catalogue backend of the Motr datastore." enum:"leveldb,badger,motr" default:"leveldb"`
+	CatalogueIdx string `name:"catalogue-index" help:"Motr index holding the catalogue when the catalogue backend is motr."`
+	Scheme       string `help:"Key scheme of the Motr index." default:"multihash" enum:"legacy,raw,fnv1a-128,sha256-128,multihash"`
+	CreateIndex  bool   `name:"create-index" help:"Create the Motr index if it doesn't exist."`
+	Workers      int    `help:"Number of goroutines writing to Motr." default:"8"`
+	BatchSize    int    `name:"batch-size" help:"Number of entries each goroutine writes in a batch." default:"1000"`
+	Rewrite      bool   `help:"Rewrite the repo's config and datastore_spec to use the Motr datastore once the migration is verified, keeping the old files with a .pre-motrds suffix."`
+	Repo         string `arg:"" name:"repo" help:"IPFS repo directory whose datastore to migrate."`
+	Idx          string `arg:"" name:"index" help:"Motr index to migrate the datastore into."`
+}
+
+type LsCatalogueCmd struct {
+	MotrConn     `embed:""`
+	LevelDBPath  string `name:"leveldb" short:"D" help:"Path to the LevelDB or Badger catalogue of the datastore using the index."`
+	Catalogue    string `help:"Catalogue backend of the datastore using the index." enum:"leveldb,badger,motr" default:"leveldb"`
+	CatalogueIdx string `name:"catalogue-index" help:"Motr index holding the catalogue when the catalogue backend is motr."`
+	Idx          string `arg:"" name:"index" required:"" help:"Index ID."`
+	Prefix       string `arg:"" optional:"" name:"prefix" help:"Only list datastore keys under this prefix, e.g. /blocks."`
+	Limit        int    `short:"n" help:"Maximum number of keys to list, 0 to list all keys."`
+	Sizes        bool   `short:"s" help:"Show the size of the value of each key."`
+	Format       string `help:"Output format: text, JSON (one object per line) or text with the Motr key of each datastore key in hex." enum:"text,json,hex" default:"text"`
+}
+
+type LsIndexCmd struct {
+	MotrConn `embed:""`
+	Idx      string `arg:"" name:"index" required:"" help:"Index ID."`
+	After    string `help:"Only list Motr keys after this hex key."`
+	Limit    int    `short:"n" help:"Maximum number of keys to list, 0 to list all keys."`
+	Sizes    bool   `short:"s" help:"Show the size of the value of each key."`
+	Format   string `help:"Output format: text, JSON (one object per line) or hex." enum:"text,json,hex" default:"text"`
+	Batch    int    `name:"batch-size" help:"Number of keys read from Motr at a time." default:"100"`
+}
+
+type LsCmd struct {
+	Catalogue LsCatalogueCmd `cmd:"" help:"List the datastore keys in the catalogue of a datastore's Motr index."`
+	Index     LsIndexCmd     `cmd:"" help:"List the keys of a Motr index by iterating over the index."`
+}
+
+type ConfigCheckCmd struct {
+	Path     string `arg:"" optional:"" name:"path" help:"IPFS repo directory, IPFS config file or datastore_spec file to check. Checks the flags and connection profile when omitted."`
+	MotrConn `embed:""`
+	Idx      string `name:"index" short:"i" help:"Index ID."`
+}
+
+type ConfigCmd struct {
+	Check ConfigCheckCmd `cmd:"" help:"Check Motr endpoint addresses and fids, and the motrds datastores configured in an IPFS repo."`
 }
 
 var log = logging.Logger("CLI")
-var hash128 = fnv.New128()
-var mkv mio.Mkv
+var mkv mio.Index
+var keys motrds.KeyMapper
 
 // Command-line arguments
 var CLI struct {
-	Debug bool     `help:"Enable debug mode."`
-	Oid   OidCmd   `cmd:"" help:"Generate or parse Motr object id."`
-	Index IndexCmd `cmd:"" help:"Create an index in the Motr key-value store."`
-	Store StoreCmd `cmd:"" help:"Store an object in the Motr key-value store."`
+	Debug       bool          `help:"Enable debug mode."`
+	Backend     string        `help:"Motr backend to use, memory to try commands without a Motr cluster." enum:",motr,memory" default:""`
+	Connection  string        `help:"Connection profile supplying the Motr endpoint addresses and fids not given as flags." short:"c" env:"MOTRDS_CONNECTION"`
+	Connections string        `help:"Connection profiles file, by default go-ds-motr/connections.json in the user config directory." env:"MOTRDS_CONNECTIONS" type:"path"`
+	Conn        ConnectionCmd `cmd:"" name:"connection" help:"Manage the connection profiles used by the other commands."`
+	Oid         OidCmd        `cmd:"" help:"Generate or parse Motr object id."`
+	Cid         CidCmd        `cmd:"" help:"Map between the CID, datastore key and Motr key of an IPFS block."`
+	Index       IndexCmd      `cmd:"" help:"Create an index in the Motr key-value store."`
+	Store       StoreCmd      `cmd:"" help:"Store an object in the Motr key-value store."`
+	Scheme      SchemeCmd     `cmd:"" help:"Show or migrate the key scheme of a datastore's Motr index."`
+	Reencrypt   ReencryptCmd  `cmd:"" help:"Encrypt all values in a datastore's Motr index with the newest encryption key."`
+	Config      ConfigCmd     `cmd:"" help:"Check go-ds-motr configuration."`
+	Migrate     MigrateCmd    `cmd:"" help:"Migrate the datastore of an IPFS repo into a Motr index."`
+	Ls          LsCmd         `cmd:"" help:"List the keys of a datastore or Motr index."`
 }
 
 func init() {
@@ -68,8 +223,14 @@ func main() {
 		figlet4go.ColorCyan,
 	}
 	renderStr, _ := ascii.RenderOpts("Go-Ds-Motr", options)
-	fmt.Print(renderStr)
+	// Keep stdout for the output of commands like ls.
+	fmt.Fprint(os.Stderr, renderStr)
 	ctx := kong.Parse(&CLI)
+	if idx, err := mio.NewIndex(CLI.Backend); err != nil {
+		log.Fatalf("Error selecting Motr backend: %s", err)
+	} else {
+		mkv = idx
+	}
 	if contains(ctx.Args, "--debug") {
 		logging.SetAllLoggers(logging.LevelInfo)
 		log.Info("Debug mode enabled.")
@@ -81,13 +242,76 @@ func (l *OidCmd) Run(ctx *kong.Context) error {
 	if l.Parse {
 		parseOID(l.Name)
 	} else {
-		createOID(l.Name)
+		createOID(l.Name, l.Scheme)
 	}
 	return nil
 }
 
+func (c *CidCmd) Run(ctx *kong.Context) error {
+	blocks := ds.NewKey(c.Namespace)
+	var km motrds.KeyMapper
+	if c.Scheme == motrds.MultihashKeyScheme {
+		km = motrds.NewMultihashKeyMapper(blocks)
+	} else {
+		km, _ = motrds.NewKeyMapper(c.Scheme)
+	}
+	var h mh.Multihash
+	switch {
+	case strings.HasPrefix(c.Value, "0x"):
+		if c.Scheme != motrds.MultihashKeyScheme {
+			log.Fatalf("Motr keys can only be mapped back to a block with the multihash key scheme.")
+		}
+		digest, err := hex.DecodeString(strings.ReplaceAll(strings.TrimPrefix(c.Value, "0x"), ":0x", ""))
+		if err != nil {
+			log.Fatalf("Could not parse Motr key %s as hexadecimal: %s.", c.Value, err)
+		}
+		code, ok := mh.Names[c.Hash]
+		if !ok {
+			log.Fatalf("Unknown multihash function %s.", c.Hash)
+		} else if code == mh.IDENTITY {
+			log.Fatalf("Blocks with identity CIDs are stored under the hash of their datastore key, which can't be mapped back.")
+		} else if size, ok := mh.DefaultLengths[code]; ok && size != len(digest) {
+			log.Fatalf("Motr key %s is %d bytes, a %s digest is %d bytes: use --hash to give the multihash function of the block.", c.Value, len(digest), c.Hash, size)
+		}
+		log.Infof("Assuming Motr key %s is a %s digest...", c.Value, c.Hash)
+		if h, err = mh.Encode(digest, code); err != nil {
+			log.Fatalf("Could not encode Motr key %s as a multihash: %s.", c.Value, err)
+		}
+		if !bytes.Equal(km.MotrKey(motrds.BlockKey(blocks, h)), digest) {
+			log.Fatalf("Motr key %s is not a block digest: blocks with short digests are stored under the hash of their datastore key, which can't be mapped back.", c.Value)
+		}
+	case strings.HasPrefix(c.Value, "/"):
+		dh, err := motrds.BlockMultihash(blocks, ds.NewKey(c.Value))
+		if err != nil {
+			log.Fatalf("Could not decode block multihash from datastore key %s: %s.", c.Value, err)
+		}
+		h, _ = mh.Encode(dh.Digest, dh.Code)
+	default:
+		cc, err := cid.Decode(c.Value)
+		if err != nil {
+			log.Fatalf("Could not parse %s as a CID: %s.", c.Value, err)
+		}
+		h = cc.Hash()
+	}
+	dsKey := motrds.BlockKey(blocks, h)
+	log.Infof("Multihash: %s", h.B58String())
+	if dh, err := mh.Decode(h); err == nil && dh.Code == mh.SHA2_256 && dh.Length == 32 {
+		log.Infof("CIDv0: %s", cid.NewCidV0(h))
+	}
+	log.Infof("CIDv1 (raw): %s", cid.NewCidV1(cid.Raw, h))
+	log.Infof("Datastore key: %s", dsKey)
+	log.Infof("Motr key (%s): %s", km.Scheme(), motrKeyString(km.MotrKey(dsKey)))
+	return nil
+}
+
 func (s *StoreCmd) Run(ctx *kong.Context) error {
-	if rinit, einit := mio.Init(&s.LocalEP, &s.HaxEP, &s.ProfileFid, &s.ProcessFid, 1, false); !rinit {
+	s.resolve(true)
+	if _keys, ekeys := motrds.NewKeyMapper(s.Scheme); ekeys != nil {
+		log.Fatalf("Error selecting key scheme: %s", ekeys)
+	} else {
+		keys = _keys
+	}
+	if rinit, einit := mio.InitBackend(CLI.Backend, &s.LocalEP, &s.HaxEP, &s.ProfileFid, &s.ProcessFid, mio.ClientConfig{Threads: 1}); !rinit {
 		log.Fatalf("Error initializing Motr client: %s", einit)
 	} else {
 		log.Info(("Initialized Motr client."))
@@ -115,7 +339,8 @@ func (s *StoreCmd) Run(ctx *kong.Context) error {
 }
 
 func (s *IndexCmd) Run(ctx *kong.Context) error {
-	if rinit, einit := mio.Init(&s.LocalEP, &s.HaxEP, &s.ProfileFid, &s.ProcessFid, 1, false); !rinit {
+	s.resolve(true)
+	if rinit, einit := mio.InitBackend(CLI.Backend, &s.LocalEP, &s.HaxEP, &s.ProfileFid, &s.ProcessFid, mio.ClientConfig{Threads: 1}); !rinit {
 		log.Fatalf("Error initializing Motr client: %s", einit)
 	} else {
 		log.Info(("Initialized Motr client."))
@@ -129,6 +354,714 @@ func (s *IndexCmd) Run(ctx *kong.Context) error {
 	return nil
 }
 
+func (s *SchemeCmd) Run(ctx *kong.Context) error {
+	s.resolve(true)
+	d, err := motrds.NewMotrDatastore(motrds.Config{
+		LocalAddr:        s.LocalEP,
+		HaxAddr:          s.HaxEP,
+		ProfileFid:       s.ProfileFid,
+		LocalProcessFid:  s.ProcessFid,
+		Idx:              s.Idx,
+		Backend:          CLI.Backend,
+		LevelDBPath:      s.LevelDBPath,
+		CatalogueBackend: s.Catalogue,
+		CatalogueIdx:     s.CatalogueIdx,
+		Threads:          1,
+		ReadOnly:         s.Migrate == "",
+	})
+	if err != nil {
+		log.Fatalf("Error opening Motr datastore for index %s: %s", s.Idx, err)
+	}
+	defer d.Close()
+	log.Infof("Motr index %s uses key scheme %s.", s.Idx, d.KeyScheme)
+	if s.Migrate != "" {
+		if emig := d.MigrateKeyScheme(s.Migrate); emig != nil {
+			log.Fatalf("Error migrating Motr index %s to key scheme %s: %s", s.Idx, s.Migrate, emig)
+		}
+	}
+	return nil
+}
+
+func (r *ReencryptCmd) Run(ctx *kong.Context) error {
+	if r.KeyFile == "" && r.KeyEnv == "" {
+		log.Fatalf("An encryption key file or environment variable must be specified.")
+	}
+	r.resolve(true)
+	d, err := motrds.NewMotrDatastore(motrds.Config{
+		LocalAddr:          r.LocalEP,
+		HaxAddr:            r.HaxEP,
+		ProfileFid:         r.ProfileFid,
+		LocalProcessFid:    r.ProcessFid,
+		Idx:                r.Idx,
+		Backend:            CLI.Backend,
+		LevelDBPath:        r.LevelDBPath,
+		CatalogueBackend:   r.Catalogue,
+		CatalogueIdx:       r.CatalogueIdx,
+		Threads:            1,
+		Encryption:         r.Encryption,
+		EncryptionKeyFile:  r.KeyFile,
+		EncryptionKeyEnv:   r.KeyEnv,
+		Compression:        r.Compression,
+		CompressionMinSize: r.CompressionMinSize,
+	})
+	if err != nil {
+		log.Fatalf("Error opening Motr datastore for index %s: %s", r.Idx, err)
+	}
+	defer d.Close()
+	if eenc := d.Reencrypt(); eenc != nil {
+		log.Fatalf("Error re-encrypting values in Motr index %s: %s", r.Idx, eenc)
+	}
+	return nil
+}
+
+func (c *ConfigCheckCmd) Run(ctx *kong.Context) error {
+	if c.Path == "" {
+		c.resolve(false)
+		if err := c.checkFlags(); err != nil {
+			log.Fatalf("Invalid configuration: %s.", err)
+		}
+		log.Infof("Motr endpoint addresses and fids are valid.")
+		return nil
+	}
+	configFile, specFile := c.Path, ""
+	if fi, err := os.Stat(c.Path); err != nil {
+		log.Fatalf("Could not read %s: %s.", c.Path, err)
+	} else if fi.IsDir() {
+		configFile, specFile = filepath.Join(c.Path, "config"), filepath.Join(c.Path, "datastore_spec")
+	} else if filepath.Base(c.Path) == "datastore_spec" {
+		configFile, specFile = "", c.Path
+	}
+	var diskSpecs []string
+	if configFile != "" {
+		var cfg struct {
+			Datastore struct{ Spec map[string]interface{} }
+		}
+		if err := readJSON(configFile, &cfg); err != nil {
+			log.Fatalf("Could not read IPFS config file %s: %s.", configFile, err)
+		}
+		specs := findJSONObjects(cfg.Datastore.Spec, func(m map[string]interface{}) bool { return m["type"] == "motrds" })
+		if len(specs) == 0 {
+			log.Fatalf("No motrds datastore is configured in %s.", configFile)
+		}
+		for _, spec := range specs {
+			dsc, err := plugin.MotrPlugin{}.DatastoreConfigParser()(spec)
+			if err != nil {
+				log.Fatalf("Invalid motrds datastore in %s: %s.", configFile, err)
+			}
+			log.Infof("The motrds datastore for index %s in %s is valid.", spec["index"], configFile)
+			diskSpecs = append(diskSpecs, dsc.DiskSpec().String())
+		}
+	}
+	if specFile == "" {
+		return nil
+	}
+	var diskSpec map[string]interface{}
+	if err := readJSON(specFile, &diskSpec); err != nil {
+		log.Fatalf("Could not read datastore_spec file %s: %s.", specFile, err)
+	}
+	// datastore_spec doesn't record datastore types; motrds entries are the ones with
+	// a local address.
+	onDisk := findJSONObjects(diskSpec, func(m map[string]interface{}) bool { _, ok := m["localAddr"]; return ok })
+	if len(onDisk) == 0 {
+		log.Fatalf("No motrds datastore is recorded in %s.", specFile)
+	}
+	found := map[string]bool{}
+	for _, spec := range onDisk {
+		spec["type"] = "motrds"
+		dsc, err := plugin.MotrPlugin{}.DatastoreConfigParser()(spec)
+		if err != nil {
+			log.Fatalf("Invalid motrds datastore in %s: %s.", specFile, err)
+		}
+		found[dsc.DiskSpec().String()] = true
+	}
+	for _, s := range diskSpecs {
+		if !found[s] {
+			log.Fatalf("%s does not match the motrds datastore in %s, IPFS will refuse to start. Expected: %s", specFile, configFile, s)
+		}
+	}
+	log.Infof("The motrds datastores in %s are valid.", specFile)
+	return nil
+}
+
+// checkFlags validates the Motr endpoint addresses and fids given as flags, and the
+// index when one is given.
+func (c *ConfigCheckCmd) checkFlags() error {
+	conf := motrds.Config{
+		LocalAddr:       c.LocalEP,
+		HaxAddr:         c.HaxEP,
+		ProfileFid:      c.ProfileFid,
+		LocalProcessFid: c.ProcessFid,
+		Backend:         mio.MotrBackend,
+	}
+	if err := conf.ValidateConnection(); err != nil {
+		return err
+	}
+	if c.Idx != "" {
+		if err := mio.ValidateFid(c.Idx, mio.IndexFidType); err != nil {
+			return fmt.Errorf("invalid index: %v", err)
+		}
+	}
+	return nil
+}
+
+func (m *MigrateCmd) Run(ctx *kong.Context) error {
+	m.resolve(true)
+	if locked, err := fsrepo.LockedByOtherProcess(m.Repo); err != nil {
+		log.Fatalf("Could not check the lock of IPFS repo %s: %s.", m.Repo, err)
+	} else if locked {
+		log.Fatalf("IPFS repo %s is in use, stop the IPFS daemon before migrating it.", m.Repo)
+	}
+	configFile := filepath.Join(m.Repo, "config")
+	var cfg map[string]interface{}
+	if err := readJSON(configFile, &cfg); err != nil {
+		log.Fatalf("Could not read IPFS config file %s: %s.", configFile, err)
+	}
+	dsCfg, _ := cfg["Datastore"].(map[string]interface{})
+	spec, ok := dsCfg["Spec"].(map[string]interface{})
+	if !ok {
+		log.Fatalf("IPFS config file %s has no datastore spec.", configFile)
+	}
+	for _, pl := range append(append(flatfs.Plugins, levelds.Plugins...), badgerds.Plugins...) {
+		pd := pl.(ipfsplugin.PluginDatastore)
+		fsrepo.AddDatastoreConfigHandler(pd.DatastoreTypeName(), pd.DatastoreConfigParser())
+	}
+	srcConf, err := fsrepo.AnyDatastoreConfig(spec)
+	if err != nil {
+		log.Fatalf("Could not open the datastore of IPFS repo %s: %s.", m.Repo, err)
+	}
+	src, err := srcConf.Create(m.Repo)
+	if err != nil {
+		log.Fatalf("Could not open the datastore of IPFS repo %s: %s.", m.Repo, err)
+	}
+	defer src.Close()
+
+	target := map[string]interface{}{
+		"type":       "motrds",
+		"localAddr":  m.LocalEP,
+		"haxAddr":    m.HaxEP,
+		"profileFid": m.ProfileFid,
+		"processFid": m.ProcessFid,
+		"index":      m.Idx,
+		"catalogue":  m.Catalogue,
+		"keyScheme":  m.Scheme,
+	}
+	if m.LevelDBPath != "" {
+		// The IPFS daemon doesn't run in the current directory.
+		path, _ := filepath.Abs(m.LevelDBPath)
+		target["leveldbPath"] = path
+	}
+	if m.CatalogueIdx != "" {
+		target["catalogueIndex"] = m.CatalogueIdx
+	}
+	if CLI.Backend != "" {
+		target["backend"] = CLI.Backend
+	}
+	if m.CreateIndex {
+		target["createIndex"] = true
+	}
+	dstConf, err := plugin.MotrPlugin{}.DatastoreConfigParser()(target)
+	if err != nil {
+		log.Fatalf("Invalid Motr datastore configuration: %s.", err)
+	}
+	dst, err := dstConf.Create(m.Repo)
+	if err != nil {
+		log.Fatalf("Error opening Motr datastore for index %s: %s", m.Idx, err)
+	}
+	d := dst.(*motrds.MotrDatastore)
+	defer d.Close()
+
+	repoPath, _ := filepath.Abs(m.Repo)
+	logged := 0
+	stats, err := d.Migrate(context.Background(), src, motrds.MigrateOptions{
+		Source:    repoPath + " " + srcConf.DiskSpec().String(),
+		Workers:   m.Workers,
+		BatchSize: m.BatchSize,
+		Progress: func(s motrds.MigrateStats) {
+			if n := s.Copied + s.Skipped; n-logged >= 10000 {
+				log.Infof("Copied %d entries, skipped %d already copied.", s.Copied, s.Skipped)
+				logged = n
+			}
+		},
+	})
+	if err != nil {
+		log.Fatalf("Error migrating IPFS repo %s into Motr index %s: %s", m.Repo, m.Idx, err)
+	}
+	log.Infof("Migrated and verified %d entries (%d bytes) from IPFS repo %s into Motr index %s.", stats.Entries, stats.Bytes, m.Repo, m.Idx)
+	if !m.Rewrite {
+		return nil
+	}
+	dsCfg["Spec"] = map[string]interface{}{"type": "measure", "prefix": "motr.datastore", "child": target}
+	newConfig, _ := json.MarshalIndent(cfg, "", "  ")
+	specFile := filepath.Join(m.Repo, "datastore_spec")
+	if err := replaceFiles(map[string][]byte{configFile: newConfig, specFile: dstConf.DiskSpec().Bytes()}, ".pre-motrds"); err != nil {
+		log.Fatalf("Could not rewrite the config of IPFS repo %s: %s.", m.Repo, err)
+	}
+	log.Infof("IPFS repo %s now uses Motr index %s, the old config and datastore_spec files have the .pre-motrds suffix.", m.Repo, m.Idx)
+	return nil
+}
+
+func (l *LsCatalogueCmd) Run(ctx *kong.Context) error {
+	l.resolve(true)
+	d, err := motrds.NewMotrDatastore(motrds.Config{
+		LocalAddr:        l.LocalEP,
+		HaxAddr:          l.HaxEP,
+		ProfileFid:       l.ProfileFid,
+		LocalProcessFid:  l.ProcessFid,
+		Idx:              l.Idx,
+		Backend:          CLI.Backend,
+		LevelDBPath:      l.LevelDBPath,
+		CatalogueBackend: l.Catalogue,
+		CatalogueIdx:     l.CatalogueIdx,
+		Threads:          1,
+		ReadOnly:         true,
+	})
+	if err != nil {
+		log.Fatalf("Error opening Motr datastore for index %s: %s", l.Idx, err)
+	}
+	defer d.Close()
+	r, err := d.Query(context.Background(), query.Query{Prefix: l.Prefix, Limit: l.Limit, KeysOnly: true, ReturnsSizes: l.Sizes})
+	if err != nil {
+		log.Fatalf("Error listing keys of Motr index %s: %s", l.Idx, err)
+	}
+	defer r.Close()
+	n := 0
+	for res := range r.Next() {
+		if res.Error != nil {
+			log.Fatalf("Error listing keys of Motr index %s: %s", l.Idx, res.Error)
+		}
+		e := lsEntry{Key: res.Key}
+		if l.Format != "text" {
+			e.MotrKey = fmt.Sprintf("0x%x", d.MotrKey(ds.RawKey(res.Key)))
+		}
+		if l.Sizes {
+			e.Size = &res.Size
+		}
+		e.print(l.Format)
+		n++
+	}
+	log.Infof("Listed %d keys in the catalogue of Motr index %s.", n, l.Idx)
+	return nil
+}
+
+func (l *LsIndexCmd) Run(ctx *kong.Context) error {
+	l.resolve(true)
+	var after []byte
+	if l.After != "" {
+		var err error
+		if after, err = hex.DecodeString(strings.TrimPrefix(l.After, "0x")); err != nil {
+			log.Fatalf("Could not parse Motr key %s as hexadecimal: %s.", l.After, err)
+		}
+	}
+	if l.Batch <= 0 {
+		log.Fatalf("The batch size must be positive.")
+	}
+	if rinit, einit := mio.InitBackend(CLI.Backend, &l.LocalEP, &l.HaxEP, &l.ProfileFid, &l.ProcessFid, mio.ClientConfig{Threads: 1}); !rinit {
+		log.Fatalf("Error initializing Motr client: %s", einit)
+	}
+	if err := mkv.Open(l.Idx, false); err != nil {
+		log.Fatalf("failed to open index %v: %v", l.Idx, err)
+	}
+	defer mkv.Close()
+	batch := l.Batch
+	if l.Limit > 0 && l.Limit < batch {
+		batch = l.Limit
+	}
+	n := 0
+	for l.Limit <= 0 || n < l.Limit {
+		keys, values, enext := mkv.Next(after, batch)
+		if enext != nil {
+			log.Fatalf("Error listing keys of Motr index %s: %s", l.Idx, enext)
+		}
+		for i, k := range keys {
+			e := lsEntry{Key: indexKeyString(k)}
+			if l.Format != "text" {
+				e.Key = fmt.Sprintf("0x%x", k)
+			}
+			if l.Sizes {
+				size := len(values[i])
+				e.Size = &size
+			}
+			e.print(l.Format)
+			n++
+			if n == l.Limit {
+				break
+			}
+		}
+		if len(keys) < batch {
+			break
+		}
+		after = keys[len(keys)-1]
+	}
+	log.Infof("Listed %d keys in Motr index %s.", n, l.Idx)
+	return nil
+}
+
+// lsEntry is a key listed by the ls commands.
+type lsEntry struct {
+	Key     string `json:"key"`
+	MotrKey string `json:"motrKey,omitempty"`
+	Size    *int   `json:"size,omitempty"`
+}
+
+func (e lsEntry) print(format string) {
+	if format == "json" {
+		b, _ := json.Marshal(e)
+		fmt.Println(string(b))
+		return
+	}
+	fields := []string{e.Key}
+	if e.MotrKey != "" {
+		fields = []string{e.MotrKey, e.Key}
+	}
+	if e.Size != nil {
+		fields = append(fields, strconv.Itoa(*e.Size))
+	}
+	fmt.Println(strings.Join(fields, "\t"))
+}
+
+// indexKeyString formats a Motr key as a 128-bit id, as text when it is printable, or
+// else in hex.
+func indexKeyString(k []byte) string {
+	if len(k) != 16 && utf8.Valid(k) && strings.IndexFunc(string(k), func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+		return string(k)
+	}
+	return motrKeyString(k)
+}
+
+func (c *ConnectionAddCmd) Run(ctx *kong.Context) error {
+	conn := Connection{LocalAddr: c.LocalEP, HaxAddr: c.HaxEP, ProfileFid: c.ProfileFid, ProcessFid: c.ProcessFid}
+	if err := validateConnection(conn); err != nil {
+		log.Fatalf("Invalid connection profile %s: %s.", c.Name, err)
+	}
+	saveConnection(c.Name, conn, c.Default)
+	return nil
+}
+
+func (c *ConnectionImportCmd) Run(ctx *kong.Context) error {
+	specFile := c.Path
+	if fi, err := os.Stat(c.Path); err != nil {
+		log.Fatalf("Could not read %s: %s.", c.Path, err)
+	} else if fi.IsDir() {
+		specFile = filepath.Join(c.Path, "datastore_spec")
+	}
+	var diskSpec map[string]interface{}
+	if err := readJSON(specFile, &diskSpec); err != nil {
+		log.Fatalf("Could not read datastore_spec file %s: %s.", specFile, err)
+	}
+	specs := findJSONObjects(diskSpec, func(m map[string]interface{}) bool {
+		_, ok := m["localAddr"]
+		return ok && (c.Idx == "" || m["index"] == c.Idx)
+	})
+	switch {
+	case len(specs) == 0 && c.Idx != "":
+		log.Fatalf("No motrds datastore for index %s is recorded in %s.", c.Idx, specFile)
+	case len(specs) == 0:
+		log.Fatalf("No motrds datastore is recorded in %s.", specFile)
+	case len(specs) > 1:
+		log.Fatalf("Several motrds datastores are recorded in %s, select one with --index.", specFile)
+	}
+	conn := Connection{}
+	conn.LocalAddr, _ = specs[0]["localAddr"].(string)
+	conn.HaxAddr, _ = specs[0]["haxAddr"].(string)
+	conn.ProfileFid, _ = specs[0]["profileFid"].(string)
+	conn.ProcessFid, _ = specs[0]["processFid"].(string)
+	if err := validateConnection(conn); err != nil {
+		log.Fatalf("Invalid Motr connection in %s: %s.", specFile, err)
+	}
+	saveConnection(c.Name, conn, c.Default)
+	return nil
+}
+
+func (c *ConnectionListCmd) Run(ctx *kong.Context) error {
+	conns, path, err := readConnections()
+	if err != nil {
+		log.Fatalf("Could not read connection profiles file %s: %s.", path, err)
+	}
+	if len(conns.Connections) == 0 {
+		log.Infof("No connection profiles in %s.", path)
+		return nil
+	}
+	names := make([]string, 0, len(conns.Connections))
+	for name := range conns.Connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conn := conns.Connections[name]
+		if name == conns.Default {
+			name += " (default)"
+		}
+		log.Infof("%s: local %s, hax %s, profile %s, process %s.", name, conn.LocalAddr, conn.HaxAddr, conn.ProfileFid, conn.ProcessFid)
+	}
+	return nil
+}
+
+func (c *ConnectionRemoveCmd) Run(ctx *kong.Context) error {
+	conns, path, err := readConnections()
+	if err != nil {
+		log.Fatalf("Could not read connection profiles file %s: %s.", path, err)
+	}
+	if _, ok := conns.Connections[c.Name]; !ok {
+		log.Fatalf("There is no connection profile %s in %s.", c.Name, path)
+	}
+	delete(conns.Connections, c.Name)
+	if conns.Default == c.Name {
+		conns.Default = ""
+	}
+	if err := writeConnections(conns, path); err != nil {
+		log.Fatalf("Could not write connection profiles file %s: %s.", path, err)
+	}
+	log.Infof("Removed connection profile %s from %s.", c.Name, path)
+	return nil
+}
+
+// resolve fills in the Motr endpoint addresses and fids not given as flags or
+// environment variables from the selected connection profile, or the default one.
+// When required is set a missing value is fatal.
+func (c *MotrConn) resolve(required bool) {
+	complete := c.LocalEP != "" && c.HaxEP != "" && c.ProfileFid != "" && c.ProcessFid != ""
+	if !complete || CLI.Connection != "" {
+		conns, path, err := readConnections()
+		if err != nil {
+			log.Fatalf("Could not read connection profiles file %s: %s.", path, err)
+		}
+		name := CLI.Connection
+		if name == "" {
+			name = conns.Default
+		}
+		if conn, ok := conns.Connections[name]; ok {
+			log.Infof("Using connection profile %s.", name)
+			for _, v := range []struct{ flag, profile *string }{
+				{&c.LocalEP, &conn.LocalAddr},
+				{&c.HaxEP, &conn.HaxAddr},
+				{&c.ProfileFid, &conn.ProfileFid},
+				{&c.ProcessFid, &conn.ProcessFid},
+			} {
+				if *v.flag == "" {
+					*v.flag = *v.profile
+				}
+			}
+		} else if name != "" {
+			log.Fatalf("There is no connection profile %s in %s.", name, path)
+		}
+	}
+	if !required {
+		return
+	}
+	for _, v := range []struct{ value, flag, env, desc string }{
+		{c.LocalEP, "-L", "MOTRDS_LOCAL_ADDR", "Motr local endpoint address"},
+		{c.HaxEP, "-H", "MOTRDS_HAX_ADDR", "Motr HA endpoint address"},
+		{c.ProfileFid, "-C", "MOTRDS_PROFILE_FID", "cluster profile fid"},
+		{c.ProcessFid, "-P", "MOTRDS_PROCESS_FID", "local process fid"},
+	} {
+		if v.value == "" {
+			log.Fatalf("No %s, set it with %s, the %s environment variable or a connection profile.", v.desc, v.flag, v.env)
+		}
+	}
+}
+
+func validateConnection(conn Connection) error {
+	if err := mio.ValidateEndpoint(conn.LocalAddr); err != nil {
+		return fmt.Errorf("invalid local address: %v", err)
+	}
+	if err := mio.ValidateEndpoint(conn.HaxAddr); err != nil {
+		return fmt.Errorf("invalid hax address: %v", err)
+	}
+	if err := mio.ValidateFid(conn.ProfileFid, mio.ProfileFidType); err != nil {
+		return fmt.Errorf("invalid cluster profile fid: %v", err)
+	}
+	if err := mio.ValidateFid(conn.ProcessFid, mio.ProcessFidType); err != nil {
+		return fmt.Errorf("invalid local process fid: %v", err)
+	}
+	return nil
+}
+
+// readConnections reads the connection profiles file, which doesn't have to exist.
+func readConnections() (Connections, string, error) {
+	path := CLI.Connections
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return Connections{}, "connections.json", err
+		}
+		path = filepath.Join(dir, "go-ds-motr", "connections.json")
+	}
+	var conns Connections
+	if err := readJSON(path, &conns); err != nil && !os.IsNotExist(err) {
+		return conns, path, err
+	}
+	if conns.Connections == nil {
+		conns.Connections = map[string]Connection{}
+	}
+	return conns, path, nil
+}
+
+func writeConnections(conns Connections, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b, _ := json.MarshalIndent(conns, "", "  ")
+	return os.WriteFile(path, b, 0600)
+}
+
+func saveConnection(name string, conn Connection, isDefault bool) {
+	conns, path, err := readConnections()
+	if err != nil {
+		log.Fatalf("Could not read connection profiles file %s: %s.", path, err)
+	}
+	conns.Connections[name] = conn
+	if isDefault || len(conns.Connections) == 1 {
+		conns.Default = name
+	}
+	if err := writeConnections(conns, path); err != nil {
+		log.Fatalf("Could not write connection profiles file %s: %s.", path, err)
+	}
+	log.Infof("Saved connection profile %s in %s.", name, path)
+}
+
+// renameFile renames files for replaceFiles, and is replaced by tests to make a rename
+// fail.
+var renameFile = os.Rename
+
+// replaceFiles replaces the content of files, keeping each old file with the backup
+// suffix in place of any backup left by an earlier replacement. The new contents are
+// written to temporary files and synced before any file is replaced, and each is then
+// renamed over the old file, so a crash leaves every file either old or new and never
+// partly written. If replacing a file fails, the files already replaced are restored
+// from their backups.
+func replaceFiles(files map[string][]byte, backup string) error {
+	var names []string
+	for file := range files {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+	temps := map[string]string{}
+	removeTemps := func() {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}
+	for _, file := range names {
+		temp, err := writeTempFile(file, files[file])
+		if err != nil {
+			removeTemps()
+			return fmt.Errorf("could not write %s: %v", file, err)
+		}
+		temps[file] = temp
+	}
+	// The old files are linked to temporary names first, so a stale backup is only
+	// replaced once every file has been backed up.
+	for _, file := range names {
+		if err := os.Remove(file + backup + ".tmp"); err != nil && !os.IsNotExist(err) {
+			removeTemps()
+			return fmt.Errorf("could not remove stale backup of %s: %v", file, err)
+		}
+		temps[file+backup] = file + backup + ".tmp"
+		if err := os.Link(file, file+backup+".tmp"); err != nil {
+			removeTemps()
+			return fmt.Errorf("could not back up %s: %v", file, err)
+		}
+	}
+	for _, file := range names {
+		if err := renameFile(file+backup+".tmp", file+backup); err != nil {
+			removeTemps()
+			return fmt.Errorf("could not back up %s: %v", file, err)
+		}
+		delete(temps, file+backup)
+	}
+	var replaced []string
+	restore := func() {
+		// The backup is linked to a temporary name renamed over the file, so the file
+		// is never missing and the backup is kept.
+		for _, file := range replaced {
+			err := os.Link(file+backup, file+backup+".tmp")
+			if err == nil {
+				err = os.Rename(file+backup+".tmp", file)
+			}
+			if err != nil {
+				os.Remove(file + backup + ".tmp")
+				log.Errorf("Could not restore %s from %s: %v.", file, file+backup, err)
+			}
+		}
+	}
+	dirs := map[string]bool{}
+	for _, file := range names {
+		if err := renameFile(temps[file], file); err != nil {
+			removeTemps()
+			restore()
+			return fmt.Errorf("could not replace %s: %v", file, err)
+		}
+		delete(temps, file)
+		replaced = append(replaced, file)
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			restore()
+			return fmt.Errorf("could not sync %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// writeTempFile writes content to a new temporary file in the directory of path and
+// syncs it to disk.
+func writeTempFile(path string, content []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if eclose := f.Close(); err == nil {
+		err = eclose
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// syncDir syncs a directory so the renames in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// findJSONObjects returns the objects in a decoded JSON value that match.
+func findJSONObjects(v interface{}, match func(map[string]interface{}) bool) []map[string]interface{} {
+	var found []map[string]interface{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if match(v) {
+			return []map[string]interface{}{v}
+		}
+		for _, c := range v {
+			found = append(found, findJSONObjects(c, match)...)
+		}
+	case []interface{}:
+		for _, c := range v {
+			found = append(found, findJSONObjects(c, match)...)
+		}
+	}
+	return found
+}
+
 func parseOID(id string) {
 	var _lo, _hi uint64
 	var oid uint128.Uint128
@@ -165,14 +1098,18 @@ func parseOID(id string) {
 	log.Infof("128-bit OID is 0x%x:0x%x\n", oid.Hi, oid.Lo)
 }
 
-func createOID(name string) {
-	log.Infof("Creating 128-bit OID for key name %s usng FNV-1 hash...")
-	oid := uint128.FromBytes(hash128.Sum([]byte(name)))
+func createOID(name string, scheme string) {
+	km, err := motrds.NewKeyMapper(scheme)
+	if err != nil {
+		log.Fatalf("Error creating OID: %s.", err)
+	}
+	log.Infof("Creating 128-bit OID for key name %s using key scheme %s...", name, scheme)
+	oid := uint128.FromBytes(km.MotrKey(ds.RawKey(name)))
 	log.Infof("128-bit OID is 0x%x:0x%x\n", oid.Hi, oid.Lo)
 }
 
 func createObject(idx string, key string, data []byte, update bool) {
-	if pget := mkv.Put(hash128.Sum([]byte(key)), data, update); pget != nil {
+	if pget := mkv.Put(keys.MotrKey(ds.RawKey(key)), data, update); pget != nil {
 		log.Errorf("Error putting object at key %s in index %s: %s.", key, idx, pget)
 	} else {
 		log.Infof("Put object at key %s in index %s", key, idx)
@@ -180,7 +1117,7 @@ func createObject(idx string, key string, data []byte, update bool) {
 }
 
 func deleteObject(idx string, key string) {
-	oid := hash128.Sum(hash128.Sum([]byte(key)))
+	oid := keys.MotrKey(ds.RawKey(key))
 	if edel := mkv.Delete(oid); edel != nil {
 		log.Errorf("Error deleting key %s: %s.", key, edel)
 	} else {
@@ -189,13 +1126,12 @@ func deleteObject(idx string, key string) {
 }
 
 func selectObject(idx string, key string) {
-	oid := hash128.Sum([]byte(key))
-	oid128 := uint128.FromBytes(oid)
+	oid := keys.MotrKey(ds.RawKey(key))
 	if rhas, ehas := mkv.Has(oid); rhas {
 		if r, eget := mkv.Get(oid); eget != nil {
 			log.Errorf("Error retrieving key %s: %s.", key, eget)
 		} else {
-			log.Infof("Key %s in index %s has oid: 0x%x:0x%x, value: %s.", key, idx, oid128.Hi, oid128.Lo, string(r))
+			log.Infof("Key %s in index %s has Motr key: %s, value: %s.", key, idx, motrKeyString(oid), string(r))
 		}
 	} else {
 		if ehas == nil {
@@ -207,7 +1143,7 @@ func selectObject(idx string, key string) {
 }
 
 func getObjectSize(idx string, key string) {
-	oid := hash128.Sum([]byte(key))
+	oid := keys.MotrKey(ds.RawKey(key))
 	if size, esize := mkv.GetSize(oid); esize != nil {
 		log.Fatalf("Error getting size of object at key %s in index %s: %v.", key, idx, esize)
 	} else {
@@ -215,6 +1151,14 @@ func getObjectSize(idx string, key string) {
 	}
 }
 
+func motrKeyString(k []byte) string {
+	if len(k) == 16 {
+		u := uint128.FromBytes(k)
+		return fmt.Sprintf("0x%x:0x%x", u.Hi, u.Lo)
+	}
+	return fmt.Sprintf("0x%x", k)
+}
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+
+	"github.com/allisterb/go-ds-motr/mio"
+	"github.com/allisterb/go-ds-motr/motrds"
+)
+
+// TestConfigCheckFlags checks that config check validates the Motr endpoint addresses
+// and fids given as flags, with or without an index.
+func TestConfigCheckFlags(t *testing.T) {
+	conn := MotrConn{
+		LocalEP:    "inet:tcp:192.168.1.161@22501",
+		HaxEP:      "inet:tcp:192.168.1.161@22001",
+		ProfileFid: "0x7000000000000001:0x0",
+		ProcessFid: "0x7200000000000001:0x3",
+	}
+	for _, c := range []struct {
+		cmd ConfigCheckCmd
+		err string
+	}{
+		{ConfigCheckCmd{MotrConn: conn}, ""},
+		{ConfigCheckCmd{MotrConn: conn, Idx: "0x7800000000000123:0x123456780"}, ""},
+		{ConfigCheckCmd{MotrConn: conn, Idx: "0x7200000000000123:0x1"}, "invalid index"},
+		{ConfigCheckCmd{MotrConn: MotrConn{LocalEP: conn.LocalEP, HaxEP: "192.168.1.161", ProfileFid: conn.ProfileFid, ProcessFid: conn.ProcessFid}}, "invalid hax address"},
+		{ConfigCheckCmd{}, "invalid local address"},
+	} {
+		err := c.cmd.checkFlags()
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("checkFlags(%+v) = %v, want %q", c.cmd, err, c.err)
+		}
+	}
+}
+
+// TestReencryptCompression checks that reencrypt stores the values it rewrites with
+// the compression given as flags.
+func TestReencryptCompression(t *testing.T) {
+	defer func(backend string) { CLI.Backend = backend }(CLI.Backend)
+	CLI.Backend = mio.MemoryBackend
+	t.Setenv("MOTRDS_TEST_KEYS", "k1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	r := ReencryptCmd{
+		MotrConn: MotrConn{
+			LocalEP:    "inet:tcp:192.168.1.161@22501",
+			HaxEP:      "inet:tcp:192.168.1.161@22001",
+			ProfileFid: "0x7000000000000001:0x0",
+			ProcessFid: "0x7200000000000001:0x3",
+		},
+		LevelDBPath: t.TempDir(),
+		Catalogue:   motrds.LevelDBCatalogue,
+		Idx:         "0x7800000000000123:0x34",
+		Encryption:  motrds.AESGCMEncryption,
+		KeyEnv:      "MOTRDS_TEST_KEYS",
+		Compression: motrds.ZstdCompression,
+	}
+	d, err := motrds.NewMotrDatastore(motrds.Config{
+		LocalAddr:        r.LocalEP,
+		HaxAddr:          r.HaxEP,
+		ProfileFid:       r.ProfileFid,
+		LocalProcessFid:  r.ProcessFid,
+		Idx:              r.Idx,
+		Backend:          CLI.Backend,
+		LevelDBPath:      r.LevelDBPath,
+		CatalogueBackend: r.Catalogue,
+		Threads:          1,
+		CreateIndex:      true,
+		Compression:      motrds.ZstdCompression,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, value := ds.NewKey("/value"), bytes.Repeat([]byte("compressible "), 1000)
+	if err := d.Put(context.Background(), key, value); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if err := r.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := mio.NewIndex(CLI.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Open(r.Idx, false); err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	_, values, err := idx.Next(nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range values {
+		if bytes.Contains(v, []byte("compressible")) || len(v) >= len(value) {
+			t.Fatalf("reencrypt stored a %d byte value uncompressed or in plain text", len(v))
+		}
+	}
+}
+
+// TestReplaceFiles checks that replaceFiles keeps the old files as backups in place of
+// earlier backups and leaves no temporary files, and that it restores the files it
+// replaced when replacing another one fails.
+func TestReplaceFiles(t *testing.T) {
+	dir := t.TempDir()
+	config, spec := filepath.Join(dir, "config"), filepath.Join(dir, "datastore_spec")
+	for file, content := range map[string]string{config: "old config", spec: "old spec"} {
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkDir := func(want map[string]string) {
+		t.Helper()
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != len(want) {
+			t.Fatalf("%s holds %d files, want %d", dir, len(entries), len(want))
+		}
+		for name, content := range want {
+			if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != content {
+				t.Fatalf("%s holds %q, %v, want %q", name, b, err, content)
+			}
+		}
+	}
+	if err := replaceFiles(map[string][]byte{config: []byte("new config"), spec: []byte("new spec")}, ".bak"); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(map[string]string{"config": "new config", "config.bak": "old config", "datastore_spec": "new spec", "datastore_spec.bak": "old spec"})
+	if err := replaceFiles(map[string][]byte{config: []byte("newer config"), spec: []byte("newer spec")}, ".bak"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"config": "newer config", "config.bak": "new config", "datastore_spec": "newer spec", "datastore_spec.bak": "new spec"}
+	checkDir(want)
+
+	// config is replaced first, then replacing datastore_spec fails.
+	defer func() { renameFile = os.Rename }()
+	renameFile = func(from, to string) error {
+		if to == spec {
+			return os.ErrPermission
+		}
+		return os.Rename(from, to)
+	}
+	if err := replaceFiles(map[string][]byte{config: []byte("newest config"), spec: []byte("newest spec")}, ".bak"); err == nil {
+		t.Fatal("replaced a file that can't be renamed")
+	}
+	want["config.bak"], want["datastore_spec.bak"] = "newer config", "newer spec"
+	checkDir(want)
+}
@@ -0,0 +1,158 @@
+package mio
+
+import (
+	"fmt"
+	"io"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/allisterb/go-ds-motr/uint128"
+)
+
+var log = logging.Logger("motrds")
+
+// Backends implementing the Motr APIs.
+const (
+	// The Motr client library talking to a Motr cluster.
+	MotrBackend = "motr"
+	// Indexes and objects kept in the memory of the process, for testing without a
+	// cluster.
+	MemoryBackend = "memory"
+)
+
+var Backends = []string{MotrBackend, MemoryBackend}
+
+// Index is the key-value API of a Motr index. Mkv implements it over the Motr client
+// and MemIndex in memory.
+type Index interface {
+	Open(id string, create bool) error
+	Close() error
+	Put(key []byte, value []byte, update bool) error
+	Get(key []byte) ([]byte, error)
+	Delete(key []byte) error
+	Has(key []byte) (bool, error)
+	GetSize(key []byte) (int, error)
+	Next(key []byte, nr int) (keys [][]byte, values [][]byte, err error)
+}
+
+// Object is the I/O API of a Motr object. Mio implements it over the Motr client and
+// MemObject in memory.
+type Object interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Open(id string, anySz ...uint64) error
+	Create(id string, sz uint64, anyPool ...string) error
+	GetPool() string
+	InPool(pool string) bool
+}
+
+func backendOf(backend string) (string, error) {
+	switch backend {
+	case "":
+		return DefaultBackend, nil
+	case MotrBackend, MemoryBackend:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("unknown Motr backend %q", backend)
+	}
+}
+
+// ClientConfig holds the tunables of the Motr client. Zero values select the
+// defaults.
+type ClientConfig struct {
+	// Number of threads reading and writing the blocks of an object in parallel.
+	Threads int
+	// Enable the Motr trace buffer and trace messages below warnings.
+	Trace bool
+	// Minimum length of the receive queue of the RPC transfer machine. Defaults to
+	// DefaultRecvQueueMinLen.
+	RecvQueueMinLen int
+	// Maximum size in bytes of RPC messages. Defaults to DefaultMaxRPCMsgSize.
+	MaxRPCMsgSize int
+	// Run the client with the Motr resource manager instead of in object store
+	// (oostore) mode.
+	NoOostore bool
+	// Verify the parity of data read from objects.
+	ReadVerify bool
+	// Create the meta indexes of the DIX index service. Only needed once, on a cluster
+	// where they don't exist yet.
+	CreateIndexMeta bool
+}
+
+// Motr client defaults.
+const (
+	DefaultRecvQueueMinLen = 64
+	DefaultMaxRPCMsgSize   = 65536
+)
+
+// Validate checks the tunables are in range.
+func (c ClientConfig) Validate() error {
+	switch {
+	case c.Threads < 0:
+		return fmt.Errorf("threads < 0: %d", c.Threads)
+	case c.RecvQueueMinLen < 0:
+		return fmt.Errorf("receive queue minimum length < 0: %d", c.RecvQueueMinLen)
+	case c.MaxRPCMsgSize < 0:
+		return fmt.Errorf("maximum RPC message size < 0: %d", c.MaxRPCMsgSize)
+	}
+	return nil
+}
+
+func (c ClientConfig) withDefaults() ClientConfig {
+	if c.Threads == 0 {
+		c.Threads = 1
+	}
+	if c.RecvQueueMinLen == 0 {
+		c.RecvQueueMinLen = DefaultRecvQueueMinLen
+	}
+	if c.MaxRPCMsgSize == 0 {
+		c.MaxRPCMsgSize = DefaultMaxRPCMsgSize
+	}
+	return c
+}
+
+// InitBackend initialises the Motr client for the motr backend, or DefaultBackend
+// if backend is empty. The memory backend needs no initialisation.
+func InitBackend(backend string, localEP *string, haxEP *string, profile *string, procFid *string, cc ClientConfig) (bool, error) {
+	if b, err := backendOf(backend); err != nil {
+		return false, err
+	} else if b == MemoryBackend {
+		return true, nil
+	}
+	return InitClient(localEP, haxEP, profile, procFid, cc)
+}
+
+// NewIndex returns an index of the backend, or DefaultBackend if backend is empty,
+// that needs to be opened.
+func NewIndex(backend string) (Index, error) {
+	b, err := backendOf(backend)
+	if err != nil {
+		return nil, err
+	} else if b == MemoryBackend {
+		return &MemIndex{}, nil
+	}
+	return newMotrIndex()
+}
+
+// NewObject returns an object of the backend, or DefaultBackend if backend is empty,
+// that needs to be opened or created.
+func NewObject(backend string) (Object, error) {
+	b, err := backendOf(backend)
+	if err != nil {
+		return nil, err
+	} else if b == MemoryBackend {
+		return &MemObject{}, nil
+	}
+	return newMotrObject()
+}
+
+// getOIDstr formats a Motr key as a fid when it is 128 bits long, or in hex.
+func getOIDstr(oid []byte) string {
+	if len(oid) != 16 {
+		return fmt.Sprintf("0x%x", oid)
+	}
+	u := uint128.FromBytes(oid)
+	return fmt.Sprintf("0x%x:0x%x", u.Hi, u.Lo)
+}
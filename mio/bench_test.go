@@ -0,0 +1,234 @@
+package mio
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Benchmarks run against the Motr cluster and index given by the MOTRDS_TEST_*
+// environment variables, or the memory backend when they are not set. Objects are
+// created with random IDs; they are not deleted on a cluster.
+
+var benchInit sync.Once
+
+func benchBackend(b *testing.B) string {
+	env := []string{"MOTRDS_TEST_LOCAL_ADDR", "MOTRDS_TEST_HAX_ADDR", "MOTRDS_TEST_PROFILE_FID", "MOTRDS_TEST_PROCESS_FID", "MOTRDS_TEST_INDEX"}
+	for _, e := range env {
+		if os.Getenv(e) == "" {
+			return MemoryBackend
+		}
+	}
+	var einit error
+	benchInit.Do(func() {
+		local, hax, profile, proc := os.Getenv(env[0]), os.Getenv(env[1]), os.Getenv(env[2]), os.Getenv(env[3])
+		_, einit = Init(&local, &hax, &profile, &proc, 4, false)
+	})
+	if einit != nil {
+		b.Fatal(einit)
+	}
+	return MotrBackend
+}
+
+var benchIndexes uint32
+
+func benchIndex(b *testing.B) Index {
+	backend := benchBackend(b)
+	idx, err := NewIndex(backend)
+	if err != nil {
+		b.Fatal(err)
+	}
+	id := os.Getenv("MOTRDS_TEST_INDEX")
+	if backend == MemoryBackend {
+		id = fmt.Sprintf("0x7800000000000002:0x%x", atomic.AddUint32(&benchIndexes, 1))
+	}
+	if err := idx.Open(id, true); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { idx.Close() })
+	return idx
+}
+
+func benchObject(b *testing.B, size uint64) Object {
+	obj, err := NewObject(benchBackend(b))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	if err := obj.Create(fmt.Sprintf("0x1000000000000000:0x%x", binary.BigEndian.Uint64(id[:])), size); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { obj.Close() })
+	return obj
+}
+
+var benchSizes = []int{128, 4 << 10, 256 << 10, 1 << 20}
+var benchConcurrency = []int{1, 16}
+
+func sizeName(size int) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%dMiB", size>>20)
+	case size >= 1<<10:
+		return fmt.Sprintf("%dKiB", size>>10)
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
+
+func randomKey() []byte {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return key
+}
+
+// benchIndexOps runs op in parallel on each goroutine for every value size and
+// concurrency level, after putting keys values of the size. Throughput is reported
+// for operations that transfer values.
+func benchIndexOps(b *testing.B, keys int, transfers bool, op func(idx Index, keys [][]byte, value []byte, r *mrand.Rand) error) {
+	for _, size := range benchSizes {
+		for _, conc := range benchConcurrency {
+			b.Run(fmt.Sprintf("size=%s/conc=%d", sizeName(size), conc), func(b *testing.B) {
+				idx := benchIndex(b)
+				value := make([]byte, size)
+				rand.Read(value)
+				stored := make([][]byte, keys)
+				for i := range stored {
+					stored[i] = randomKey()
+					if err := idx.Put(stored[i], value, true); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.Cleanup(func() {
+					for _, k := range stored {
+						idx.Delete(k)
+					}
+				})
+				if transfers {
+					b.SetBytes(int64(size))
+				}
+				b.SetParallelism(conc)
+				b.ResetTimer()
+				var seed int64
+				b.RunParallel(func(pb *testing.PB) {
+					r := mrand.New(mrand.NewSource(atomic.AddInt64(&seed, 1)))
+					for pb.Next() {
+						if err := op(idx, stored, value, r); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+func BenchmarkIndexPut(b *testing.B) {
+	benchIndexOps(b, 256, true, func(idx Index, keys [][]byte, value []byte, r *mrand.Rand) error {
+		return idx.Put(keys[r.Intn(len(keys))], value, true)
+	})
+}
+
+func BenchmarkIndexGet(b *testing.B) {
+	benchIndexOps(b, 256, true, func(idx Index, keys [][]byte, value []byte, r *mrand.Rand) error {
+		_, err := idx.Get(keys[r.Intn(len(keys))])
+		return err
+	})
+}
+
+func BenchmarkIndexHas(b *testing.B) {
+	benchIndexOps(b, 256, false, func(idx Index, keys [][]byte, value []byte, r *mrand.Rand) error {
+		if has, err := idx.Has(keys[r.Intn(len(keys))]); err != nil {
+			return err
+		} else if !has {
+			return fmt.Errorf("stored key not found")
+		}
+		return nil
+	})
+}
+
+// Size of the objects of the I/O benchmarks.
+const benchObjectSize = 64 << 20
+
+var benchBlockSizes = []int{4 << 10, 1 << 20, 16 << 20}
+
+func BenchmarkObjectSequential(b *testing.B) {
+	for _, bs := range benchBlockSizes {
+		buf := make([]byte, bs)
+		rand.Read(buf)
+		b.Run(fmt.Sprintf("write/bs=%s", sizeName(bs)), func(b *testing.B) {
+			obj := benchObject(b, benchObjectSize)
+			b.SetBytes(int64(bs))
+			b.ResetTimer()
+			for i, off := 0, 0; i < b.N; i, off = i+1, off+bs {
+				if off+bs > benchObjectSize {
+					// Start again at the end of the object.
+					if _, err := obj.Seek(0, io.SeekStart); err != nil {
+						b.Fatal(err)
+					}
+					off = 0
+				}
+				if _, err := obj.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("read/bs=%s", sizeName(bs)), func(b *testing.B) {
+			obj := benchObject(b, benchObjectSize)
+			for off := 0; off < benchObjectSize; off += len(buf) {
+				if _, err := obj.WriteAt(buf, int64(off)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.SetBytes(int64(bs))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := obj.Read(buf); err != nil {
+					// Start again at the end of the object.
+					if _, err := obj.Seek(0, io.SeekStart); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkObjectRandom(b *testing.B) {
+	for _, bs := range benchBlockSizes[:2] {
+		buf := make([]byte, bs)
+		rand.Read(buf)
+		obj := benchObject(b, benchObjectSize)
+		for off := 0; off < benchObjectSize; off += len(buf) {
+			if _, err := obj.WriteAt(buf, int64(off)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		blocks := benchObjectSize / bs
+		r := mrand.New(mrand.NewSource(1))
+		b.Run(fmt.Sprintf("write/bs=%s", sizeName(bs)), func(b *testing.B) {
+			b.SetBytes(int64(bs))
+			for i := 0; i < b.N; i++ {
+				if _, err := obj.WriteAt(buf, int64(r.Intn(blocks)*bs)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("read/bs=%s", sizeName(bs)), func(b *testing.B) {
+			b.SetBytes(int64(bs))
+			for i := 0; i < b.N; i++ {
+				if _, err := obj.ReadAt(buf, int64(r.Intn(blocks)*bs)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package mio
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Operations faults can be injected into.
+const (
+	OpOpen    = "open"
+	OpCreate  = "create"
+	OpClose   = "close"
+	OpPut     = "put"
+	OpGet     = "get"
+	OpDelete  = "delete"
+	OpHas     = "has"
+	OpGetSize = "getsize"
+	OpNext    = "next"
+	OpRead    = "read"
+	OpWrite   = "write"
+	OpSeek    = "seek"
+)
+
+var FaultOps = []string{OpOpen, OpCreate, OpClose, OpPut, OpGet, OpDelete, OpHas, OpGetSize, OpNext, OpRead, OpWrite, OpSeek}
+
+// Fault describes a failure injected into the index and object operations it matches.
+type Fault struct {
+	// Operations the fault applies to, from FaultOps. All operations when empty.
+	Ops []string
+	// Regular expression matched against index keys, formatted as Motr fids when they
+	// are 128 bits long and in hex otherwise, and against index and object IDs for
+	// open, create and close. All keys when empty.
+	Keys string
+	// Probability that a matching operation is affected, between 0 and 1. Always when 0.
+	Probability float64
+	// Number of matching operations let through before the fault starts, to fail a
+	// sequence of operations midway.
+	After int
+	// Number of operations affected before the fault stops. No limit when 0.
+	Count int
+	// Delay added to affected operations.
+	Latency time.Duration
+	// Block affected operations until the faults are changed or cleared.
+	Hang bool
+	// Error message affected operations fail with. Operations only get delayed or hang
+	// when empty.
+	Error string
+	// Fail after doing part of the work: next returns the first half of the keys,
+	// and read and write transfer the first half of the buffer.
+	Partial bool
+}
+
+// ErrInjected is wrapped by the errors of injected faults.
+var ErrInjected = errors.New("mio: injected fault")
+
+type fault struct {
+	Fault
+	ops     map[string]bool
+	keys    *regexp.Regexp
+	matched int
+	applied int
+}
+
+// FaultInjector injects faults into the indexes and objects it wraps. Faults can be
+// changed while the wrapped indexes and objects are in use.
+type FaultInjector struct {
+	mu      sync.Mutex
+	faults  []*fault
+	rand    *rand.Rand
+	release chan struct{}
+}
+
+// NewFaultInjector returns an injector of faults, which are checked in order for
+// each operation; the first fault that affects an operation is injected.
+func NewFaultInjector(faults []Fault) (*FaultInjector, error) {
+	fi := &FaultInjector{rand: rand.New(rand.NewSource(time.Now().UnixNano())), release: make(chan struct{})}
+	return fi, fi.SetFaults(faults)
+}
+
+// SetFaults replaces the faults injected, releasing operations that hang.
+func (fi *FaultInjector) SetFaults(faults []Fault) error {
+	fs := make([]*fault, len(faults))
+	for i, f := range faults {
+		fs[i] = &fault{Fault: f, ops: map[string]bool{}}
+		for _, op := range f.Ops {
+			if !validOp(op) {
+				return fmt.Errorf("unknown operation %q in fault", op)
+			}
+			fs[i].ops[op] = true
+		}
+		if f.Keys != "" {
+			re, err := regexp.Compile(f.Keys)
+			if err != nil {
+				return fmt.Errorf("invalid key pattern in fault: %v", err)
+			}
+			fs[i].keys = re
+		}
+		if f.Probability < 0 || f.Probability > 1 {
+			return fmt.Errorf("fault probability %v is not between 0 and 1", f.Probability)
+		}
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.faults = fs
+	close(fi.release)
+	fi.release = make(chan struct{})
+	return nil
+}
+
+func validOp(op string) bool {
+	for _, o := range FaultOps {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// inject applies the first fault affecting an operation on key and returns it, or
+// nil if no fault affects the operation.
+func (fi *FaultInjector) inject(op string, key string) (*Fault, error) {
+	fi.mu.Lock()
+	var hit *Fault
+	for _, f := range fi.faults {
+		if (len(f.ops) > 0 && !f.ops[op]) || (f.keys != nil && !f.keys.MatchString(key)) {
+			continue
+		}
+		if f.matched++; f.matched <= f.After || (f.Count > 0 && f.applied >= f.Count) {
+			continue
+		}
+		if f.Probability > 0 && fi.rand.Float64() >= f.Probability {
+			continue
+		}
+		f.applied++
+		hit = &f.Fault
+		break
+	}
+	release := fi.release
+	fi.mu.Unlock()
+	if hit == nil {
+		return nil, nil
+	}
+	log.Debugf("Injecting fault into %s of %s: %+v.", op, key, *hit)
+	if hit.Latency > 0 {
+		time.Sleep(hit.Latency)
+	}
+	if hit.Hang {
+		<-release
+	}
+	if hit.Error != "" {
+		return hit, fmt.Errorf("%w in %s of %s: %s", ErrInjected, op, key, hit.Error)
+	}
+	return nil, nil
+}
+
+// Index returns idx with faults injected into its operations.
+func (fi *FaultInjector) Index(idx Index) Index {
+	return &faultyIndex{idx: idx, fi: fi}
+}
+
+// Object returns obj with faults injected into its operations.
+func (fi *FaultInjector) Object(obj Object) Object {
+	return &faultyObject{obj: obj, fi: fi}
+}
+
+type faultyIndex struct {
+	idx Index
+	fi  *FaultInjector
+	id  string
+}
+
+func (f *faultyIndex) Open(id string, create bool) error {
+	if _, err := f.fi.inject(OpOpen, id); err != nil {
+		return err
+	}
+	f.id = id
+	return f.idx.Open(id, create)
+}
+
+func (f *faultyIndex) Close() error {
+	if _, err := f.fi.inject(OpClose, f.id); err != nil {
+		return err
+	}
+	return f.idx.Close()
+}
+
+func (f *faultyIndex) Put(key []byte, value []byte, update bool) error {
+	if _, err := f.fi.inject(OpPut, getOIDstr(key)); err != nil {
+		return err
+	}
+	return f.idx.Put(key, value, update)
+}
+
+func (f *faultyIndex) Get(key []byte) ([]byte, error) {
+	if _, err := f.fi.inject(OpGet, getOIDstr(key)); err != nil {
+		return nil, err
+	}
+	return f.idx.Get(key)
+}
+
+func (f *faultyIndex) Delete(key []byte) error {
+	if _, err := f.fi.inject(OpDelete, getOIDstr(key)); err != nil {
+		return err
+	}
+	return f.idx.Delete(key)
+}
+
+func (f *faultyIndex) Has(key []byte) (bool, error) {
+	if _, err := f.fi.inject(OpHas, getOIDstr(key)); err != nil {
+		return false, err
+	}
+	return f.idx.Has(key)
+}
+
+func (f *faultyIndex) GetSize(key []byte) (int, error) {
+	if _, err := f.fi.inject(OpGetSize, getOIDstr(key)); err != nil {
+		return -1, err
+	}
+	return f.idx.GetSize(key)
+}
+
+func (f *faultyIndex) Next(key []byte, nr int) ([][]byte, [][]byte, error) {
+	hit, err := f.fi.inject(OpNext, getOIDstr(key))
+	if err == nil {
+		return f.idx.Next(key, nr)
+	} else if !hit.Partial {
+		return nil, nil, err
+	}
+	keys, values, enext := f.idx.Next(key, nr)
+	if enext != nil {
+		return nil, nil, enext
+	}
+	return keys[:len(keys)/2], values[:len(keys)/2], err
+}
+
+type faultyObject struct {
+	obj Object
+	fi  *FaultInjector
+	id  string
+}
+
+func (f *faultyObject) Open(id string, anySz ...uint64) error {
+	if _, err := f.fi.inject(OpOpen, id); err != nil {
+		return err
+	}
+	f.id = id
+	return f.obj.Open(id, anySz...)
+}
+
+func (f *faultyObject) Create(id string, sz uint64, anyPool ...string) error {
+	if _, err := f.fi.inject(OpCreate, id); err != nil {
+		return err
+	}
+	f.id = id
+	return f.obj.Create(id, sz, anyPool...)
+}
+
+func (f *faultyObject) Close() error {
+	if _, err := f.fi.inject(OpClose, f.id); err != nil {
+		return err
+	}
+	return f.obj.Close()
+}
+
+func (f *faultyObject) GetPool() string {
+	return f.obj.GetPool()
+}
+
+func (f *faultyObject) InPool(pool string) bool {
+	return f.obj.InPool(pool)
+}
+
+// transfer injects faults into a read or write of p, doing the first half of it when
+// the fault is partial.
+func (f *faultyObject) transfer(op string, p []byte, do func([]byte) (int, error)) (int, error) {
+	hit, err := f.fi.inject(op, f.id)
+	if err == nil {
+		return do(p)
+	} else if !hit.Partial {
+		return 0, err
+	}
+	n, edo := do(p[:len(p)/2])
+	if edo != nil {
+		return n, edo
+	}
+	return n, err
+}
+
+func (f *faultyObject) Read(p []byte) (int, error) {
+	return f.transfer(OpRead, p, f.obj.Read)
+}
+
+func (f *faultyObject) ReadAt(p []byte, off int64) (int, error) {
+	return f.transfer(OpRead, p, func(p []byte) (int, error) { return f.obj.ReadAt(p, off) })
+}
+
+func (f *faultyObject) Write(p []byte) (int, error) {
+	return f.transfer(OpWrite, p, f.obj.Write)
+}
+
+func (f *faultyObject) WriteAt(p []byte, off int64) (int, error) {
+	return f.transfer(OpWrite, p, func(p []byte) (int, error) { return f.obj.WriteAt(p, off) })
+}
+
+func (f *faultyObject) Seek(offset int64, whence int) (int64, error) {
+	if _, err := f.fi.inject(OpSeek, f.id); err != nil {
+		return 0, err
+	}
+	return f.obj.Seek(offset, whence)
+}
@@ -0,0 +1,118 @@
+package mio
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func faultyTestIndex(t *testing.T, faults []Fault) (*FaultInjector, Index) {
+	fi, err := NewFaultInjector(faults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := fi.Index(&MemIndex{})
+	if err := idx.Open(fmt.Sprintf("0x7800000000000001:0x%x", time.Now().UnixNano()), true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fi.SetFaults(nil); idx.Close() })
+	return fi, idx
+}
+
+func TestFaultMatching(t *testing.T) {
+	fi, idx := faultyTestIndex(t, []Fault{{Ops: []string{OpPut}, Keys: "^0x62", Error: "disk on fire"}})
+	if err := idx.Put([]byte("a"), []byte("1"), true); err != nil {
+		t.Fatalf("put of a key not matching the fault failed: %v", err)
+	}
+	if err := idx.Put([]byte("b"), []byte("1"), true); !errors.Is(err, ErrInjected) {
+		t.Fatalf("put of a matching key returned %v", err)
+	}
+	if _, err := idx.Get([]byte("b")); err == nil {
+		t.Fatal("failed put stored a value")
+	}
+
+	if err := fi.SetFaults([]Fault{{Ops: []string{OpGet}, After: 2, Count: 3, Error: "timeout"}}); err != nil {
+		t.Fatal(err)
+	}
+	var failed []int
+	for i := 0; i < 10; i++ {
+		if _, err := idx.Get([]byte("a")); err != nil {
+			failed = append(failed, i)
+		}
+	}
+	if fmt.Sprint(failed) != "[2 3 4]" {
+		t.Fatalf("gets %v failed", failed)
+	}
+
+	if err := fi.SetFaults([]Fault{{Ops: []string{OpHas}, Probability: 0.5, Error: "flaky"}}); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := idx.Has([]byte("a")); err != nil {
+			n++
+		}
+	}
+	if n < 350 || n > 650 {
+		t.Fatalf("%d of 1000 operations failed with probability 0.5", n)
+	}
+
+	for _, f := range []Fault{{Ops: []string{"fsync"}}, {Keys: "("}, {Probability: 2}} {
+		if err := fi.SetFaults([]Fault{f}); err == nil {
+			t.Fatalf("invalid fault %+v accepted", f)
+		}
+	}
+}
+
+func TestFaultLatencyAndHang(t *testing.T) {
+	fi, idx := faultyTestIndex(t, []Fault{{Ops: []string{OpHas}, Latency: 50 * time.Millisecond}})
+	start := time.Now()
+	if _, err := idx.Has([]byte("a")); err != nil {
+		t.Fatal(err)
+	} else if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("operation was not delayed")
+	}
+
+	fi.SetFaults([]Fault{{Ops: []string{OpGet}, Hang: true, Error: "hung"}})
+	done := make(chan error)
+	go func() {
+		_, err := idx.Get([]byte("a"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("hanging operation returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := idx.Put([]byte("a"), []byte("1"), true); err != nil {
+		t.Fatalf("operation not matching the hanging fault failed: %v", err)
+	}
+	fi.SetFaults(nil)
+	if err := <-done; !errors.Is(err, ErrInjected) {
+		t.Fatalf("released operation returned %v", err)
+	}
+}
+
+func TestPartialFaults(t *testing.T) {
+	fi, idx := faultyTestIndex(t, nil)
+	for i := 0; i < 10; i++ {
+		if err := idx.Put([]byte{byte(i)}, []byte("v"), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi.SetFaults([]Fault{{Ops: []string{OpNext}, Partial: true, Error: "connection reset"}})
+	if keys, values, err := idx.Next(nil, 10); !errors.Is(err, ErrInjected) || len(keys) != 5 || len(values) != 5 {
+		t.Fatalf("partial next returned %d keys, %v", len(keys), err)
+	}
+
+	obj := fi.Object(&MemObject{})
+	if err := obj.Create(fmt.Sprintf("0x1:0x%x", time.Now().UnixNano()), 100); err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	fi.SetFaults([]Fault{{Ops: []string{OpWrite}, Partial: true, Error: "ENOSPC"}})
+	if n, err := obj.WriteAt(make([]byte, 100), 0); !errors.Is(err, ErrInjected) || n != 50 {
+		t.Fatalf("partial write wrote %d bytes, %v", n, err)
+	}
+}
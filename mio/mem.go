@@ -0,0 +1,363 @@
+package mio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Size of the blocks objects of the memory backend are stored in. Blocks that were
+// never written take no memory and read as zeros.
+const memBlockSize = 4096
+
+// Indexes and objects of the memory backend by ID. They live as long as the process,
+// so an index or object can be closed and opened again like on a cluster.
+var mem = struct {
+	sync.Mutex
+	indexes map[string]*memIndex
+	objects map[string]*memObject
+}{indexes: map[string]*memIndex{}, objects: map[string]*memObject{}}
+
+// parseID parses a Motr fid of the form 0x<hi>:0x<lo>. Like m0_uint128_sscanf, both
+// parts are read as hexadecimal with or without the 0x prefix.
+func parseID(id string) (hi, lo uint64, err error) {
+	parts := strings.Split(id, ":")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if hi, lo, err = ParseFid(strings.Join(parts, ":")); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse fid: %v", err)
+	}
+	return hi, lo, nil
+}
+
+func canonicalID(hi, lo uint64) string {
+	return fmt.Sprintf("0x%x:0x%x", hi, lo)
+}
+
+// memIndex keeps the keys of an index sorted for Next.
+type memIndex struct {
+	sync.RWMutex
+	keys   []string
+	values map[string][]byte
+}
+
+// MemIndex is an Index kept in memory. Like Motr indexes, index IDs must have the
+// index fid type 0x78 in the most significant byte. Indexes are created when opened
+// with create set, opening an index that doesn't exist otherwise fails, and
+// operations fail with the same errors as on Motr.
+type MemIndex struct {
+	idx *memIndex
+}
+
+func (mkv *MemIndex) Open(id string, create bool) error {
+	if mkv.idx != nil {
+		return errors.New("index is already opened")
+	}
+	hi, lo, err := parseID(id)
+	if err != nil {
+		return err
+	} else if hi>>56 != IndexFidType {
+		return fmt.Errorf("index fid must start with 0x78 in MSByte, for example: 0x7800000000000123:0x")
+	}
+	mem.Lock()
+	defer mem.Unlock()
+	id = canonicalID(hi, lo)
+	if mem.indexes[id] == nil {
+		if !create {
+			return fmt.Errorf("index %s does not exist: %d", id, -int(syscall.ENOENT))
+		}
+		mem.indexes[id] = &memIndex{values: map[string][]byte{}}
+	}
+	mkv.idx = mem.indexes[id]
+	return nil
+}
+
+func (mkv *MemIndex) Close() error {
+	if mkv.idx == nil {
+		return errors.New("index is not opened")
+	}
+	mkv.idx = nil
+	return nil
+}
+
+func indexOpError(errno syscall.Errno) error {
+	return fmt.Errorf("index op failed: %d", -int(errno))
+}
+
+func (mkv *MemIndex) Put(key []byte, value []byte, update bool) error {
+	if mkv.idx == nil {
+		return errors.New("index is not opened")
+	}
+	mkv.idx.Lock()
+	defer mkv.idx.Unlock()
+	k := string(key)
+	if _, ok := mkv.idx.values[k]; ok {
+		if !update {
+			return indexOpError(syscall.EEXIST)
+		}
+	} else {
+		i := sort.SearchStrings(mkv.idx.keys, k)
+		mkv.idx.keys = append(mkv.idx.keys, "")
+		copy(mkv.idx.keys[i+1:], mkv.idx.keys[i:])
+		mkv.idx.keys[i] = k
+	}
+	mkv.idx.values[k] = append([]byte{}, value...)
+	return nil
+}
+
+func (mkv *MemIndex) Get(key []byte) ([]byte, error) {
+	if mkv.idx == nil {
+		return nil, errors.New("index is not opened")
+	}
+	mkv.idx.RLock()
+	defer mkv.idx.RUnlock()
+	if v, ok := mkv.idx.values[string(key)]; ok {
+		return append([]byte{}, v...), nil
+	}
+	return nil, indexOpError(syscall.ENOENT)
+}
+
+func (mkv *MemIndex) Delete(key []byte) error {
+	if mkv.idx == nil {
+		return errors.New("index is not opened")
+	}
+	mkv.idx.Lock()
+	defer mkv.idx.Unlock()
+	k := string(key)
+	if _, ok := mkv.idx.values[k]; !ok {
+		return indexOpError(syscall.ENOENT)
+	}
+	delete(mkv.idx.values, k)
+	i := sort.SearchStrings(mkv.idx.keys, k)
+	mkv.idx.keys = append(mkv.idx.keys[:i], mkv.idx.keys[i+1:]...)
+	return nil
+}
+
+func (mkv *MemIndex) Has(key []byte) (bool, error) {
+	if mkv.idx == nil {
+		return false, errors.New("index is not opened")
+	}
+	mkv.idx.RLock()
+	defer mkv.idx.RUnlock()
+	_, ok := mkv.idx.values[string(key)]
+	return ok, nil
+}
+
+func (mkv *MemIndex) GetSize(key []byte) (int, error) {
+	if mkv.idx == nil {
+		return -1, errors.New("index is not opened")
+	}
+	mkv.idx.RLock()
+	defer mkv.idx.RUnlock()
+	if v, ok := mkv.idx.values[string(key)]; ok {
+		return len(v), nil
+	}
+	return -1, ds.ErrNotFound
+}
+
+// Next returns up to nr keys of the index in key order and their values, starting
+// after key or from the first key of the index when key is nil.
+func (mkv *MemIndex) Next(key []byte, nr int) ([][]byte, [][]byte, error) {
+	if mkv.idx == nil {
+		return nil, nil, errors.New("index is not opened")
+	}
+	mkv.idx.RLock()
+	defer mkv.idx.RUnlock()
+	i := 0
+	if len(key) > 0 {
+		i = sort.Search(len(mkv.idx.keys), func(i int) bool { return mkv.idx.keys[i] > string(key) })
+	}
+	keys, values := make([][]byte, 0, nr), make([][]byte, 0, nr)
+	for ; i < len(mkv.idx.keys) && len(keys) < nr; i++ {
+		keys = append(keys, []byte(mkv.idx.keys[i]))
+		values = append(values, append([]byte{}, mkv.idx.values[mkv.idx.keys[i]]...))
+	}
+	return keys, values, nil
+}
+
+// memObject stores the blocks of an object that have been written.
+type memObject struct {
+	sync.RWMutex
+	pool   string
+	blocks map[int64][]byte
+}
+
+// MemObject is an Object kept in memory, stored sparsely in blocks. Like Motr objects
+// it has no size of its own: the size given to Open or Create limits reads.
+type MemObject struct {
+	obj *memObject
+	sz  uint64
+	off int64
+}
+
+func (mio *MemObject) Open(id string, anySz ...uint64) error {
+	if mio.obj != nil {
+		return errors.New("object is already opened")
+	}
+	hi, lo, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	mem.Lock()
+	obj := mem.objects[canonicalID(hi, lo)]
+	mem.Unlock()
+	if obj == nil {
+		return fmt.Errorf("failed to open object entity: %d", -int(syscall.ENOENT))
+	}
+	mio.obj, mio.sz, mio.off = obj, 0, 0
+	for _, v := range anySz {
+		mio.sz = v
+	}
+	return nil
+}
+
+func (mio *MemObject) Create(id string, sz uint64, anyPool ...string) error {
+	if mio.obj != nil {
+		return errors.New("object is already opened")
+	}
+	hi, lo, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	pool := canonicalID(0, 0)
+	for _, p := range anyPool {
+		if p != "" {
+			phi, plo, err := parseID(p)
+			if err != nil {
+				return fmt.Errorf("invalid pool: %v", p)
+			}
+			pool = canonicalID(phi, plo)
+		}
+		break
+	}
+	mem.Lock()
+	defer mem.Unlock()
+	id = canonicalID(hi, lo)
+	if mem.objects[id] != nil {
+		return fmt.Errorf("create op failed: %d", -int(syscall.EEXIST))
+	}
+	mio.obj = &memObject{pool: pool, blocks: map[int64][]byte{}}
+	mem.objects[id] = mio.obj
+	mio.sz, mio.off = sz, 0
+	return nil
+}
+
+func (mio *MemObject) Close() error {
+	if mio.obj == nil {
+		return errors.New("object is not opened")
+	}
+	mio.obj = nil
+	return nil
+}
+
+func (mio *MemObject) GetPool() string {
+	if mio.obj == nil {
+		return ""
+	}
+	return mio.obj.pool
+}
+
+func (mio *MemObject) InPool(pool string) bool {
+	if mio.obj == nil {
+		return false
+	}
+	hi, lo, err := parseID(pool)
+	return err == nil && canonicalID(hi, lo) == mio.obj.pool
+}
+
+func (mio *MemObject) write(p []byte, off *int64) (n int, err error) {
+	if mio.obj == nil {
+		return 0, errors.New("object is not opened")
+	}
+	mio.obj.Lock()
+	defer mio.obj.Unlock()
+	for n < len(p) {
+		b, boff := *off/memBlockSize, *off%memBlockSize
+		block := mio.obj.blocks[b]
+		if block == nil {
+			block = make([]byte, memBlockSize)
+			mio.obj.blocks[b] = block
+		}
+		c := copy(block[boff:], p[n:])
+		n += c
+		*off += int64(c)
+	}
+	return n, nil
+}
+
+func (mio *MemObject) Write(p []byte) (n int, err error) {
+	return mio.write(p, &mio.off)
+}
+
+func (mio *MemObject) WriteAt(p []byte, off int64) (n int, err error) {
+	return mio.write(p, &off)
+}
+
+func (mio *MemObject) read(p []byte, off *int64) (n int, err error) {
+	if mio.obj == nil {
+		return 0, errors.New("object is not opened")
+	}
+	left := len(p)
+	if uint64(*off) >= mio.sz {
+		return 0, io.EOF
+	} else if uint64(*off)+uint64(left) > mio.sz {
+		left = int(mio.sz - uint64(*off))
+	}
+	mio.obj.RLock()
+	defer mio.obj.RUnlock()
+	for n < left {
+		b, boff := *off/memBlockSize, *off%memBlockSize
+		end := int(memBlockSize - boff)
+		if end > left-n {
+			end = left - n
+		}
+		if block := mio.obj.blocks[b]; block != nil {
+			copy(p[n:n+end], block[boff:])
+		} else {
+			for i := n; i < n+end; i++ {
+				p[i] = 0
+			}
+		}
+		n += end
+		*off += int64(end)
+	}
+	return n, nil
+}
+
+func (mio *MemObject) Read(p []byte) (n int, err error) {
+	return mio.read(p, &mio.off)
+}
+
+func (mio *MemObject) ReadAt(p []byte, off int64) (n int, err error) {
+	return mio.read(p, &off)
+}
+
+func (mio *MemObject) Seek(offset int64, whence int) (int64, error) {
+	if mio.obj == nil {
+		return 0, errors.New("object is not opened")
+	}
+	switch whence {
+	case io.SeekStart:
+		if offset < 0 {
+			return 0, errors.New("offset must be >= 0 for SeekStart")
+		}
+		mio.off = offset
+	case io.SeekCurrent:
+		if mio.off+offset < 0 {
+			return 0, fmt.Errorf("curr+offset (%v+%v) must be >= 0", mio.off, offset)
+		}
+		mio.off += offset
+	case io.SeekEnd:
+		return 0, errors.New("Motr object is size-less, its end is unknown")
+	default:
+		return 0, fmt.Errorf("Invalid / unknown whence argument: %v", whence)
+	}
+	return mio.off, nil
+}
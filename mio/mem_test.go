@@ -0,0 +1,148 @@
+package mio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestMemIndex(t *testing.T) {
+	var mkv MemIndex
+	if err := mkv.Open("0x1:0x1", false); err == nil {
+		t.Fatal("opened an index without the index fid type")
+	}
+	if err := mkv.Open("0x7800000000000000:0x10", false); err == nil {
+		t.Fatal("opened an index that doesn't exist without create")
+	}
+	if err := mkv.Open("0x7800000000000000:0x10", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"c", "a", "e", "b", "d"} {
+		if err := mkv.Put([]byte(k), []byte("v"+k), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mkv.Put([]byte("a"), []byte("x"), false); err == nil {
+		t.Fatal("put an existing key without update")
+	}
+	if err := mkv.Put([]byte("a"), []byte("va2"), true); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := mkv.Get([]byte("a")); err != nil || string(v) != "va2" {
+		t.Fatalf("Get(a) = %q, %v", v, err)
+	}
+	if size, err := mkv.GetSize([]byte("e")); err != nil || size != 2 {
+		t.Fatalf("GetSize(e) = %d, %v", size, err)
+	}
+	if err := mkv.Delete([]byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mkv.Delete([]byte("d")); err == nil {
+		t.Fatal("deleted a missing key")
+	}
+	if has, err := mkv.Has([]byte("d")); err != nil || has {
+		t.Fatalf("Has(d) = %v, %v", has, err)
+	}
+	if _, err := mkv.Get([]byte("d")); err == nil {
+		t.Fatal("got a deleted key")
+	}
+
+	var keys []string
+	for start := []byte(nil); ; {
+		batch, values, err := mkv.Next(start, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, k := range batch {
+			keys = append(keys, string(k)+"="+string(values[i]))
+		}
+		if len(batch) < 2 {
+			break
+		}
+		start = batch[len(batch)-1]
+	}
+	if fmt.Sprint(keys) != "[a=va2 b=vb c=vc e=ve]" {
+		t.Fatalf("Next returned keys %v", keys)
+	}
+
+	// The index outlives its handles.
+	if err := mkv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var again, created MemIndex
+	if err := again.Open("0x7800000000000000:0x10", false); err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if err := created.Open("0x7800000000000000:0x10", true); err != nil {
+		t.Fatal(err)
+	}
+	defer created.Close()
+	if has, err := created.Has([]byte("e")); err != nil || !has {
+		t.Fatalf("Has(e) after opening with create = %v, %v", has, err)
+	}
+	if has, err := again.Has([]byte("e")); err != nil || !has {
+		t.Fatalf("Has(e) after reopening = %v, %v", has, err)
+	}
+
+	// Like on Motr, both parts of an ID are hexadecimal with or without 0x.
+	var bare, decimal MemIndex
+	if err := bare.Open("7800000000000000:10", false); err != nil {
+		t.Fatal(err)
+	}
+	defer bare.Close()
+	if has, err := bare.Has([]byte("e")); err != nil || !has {
+		t.Fatalf("Has(e) in index 7800000000000000:10 = %v, %v", has, err)
+	}
+	if err := decimal.Open("0x7800000000000000:16", false); err == nil {
+		t.Fatal("read ID 0x7800000000000000:16 as 0x7800000000000000:0x10")
+	}
+}
+
+func TestMemObject(t *testing.T) {
+	var obj MemObject
+	if err := obj.Open("0x1:0x20"); err == nil {
+		t.Fatal("opened an object that doesn't exist")
+	}
+	const size = 3*memBlockSize + 100
+	if err := obj.Create("0x1:0x20", size, "0x6f00000000000001:0x1"); err != nil {
+		t.Fatal(err)
+	}
+	if !obj.InPool("0x6f00000000000001:0x1") {
+		t.Fatalf("object is in pool %s", obj.GetPool())
+	}
+	data := bytes.Repeat([]byte("0123456789"), 500)
+	if n, err := obj.WriteAt(data, memBlockSize-10); err != nil || n != len(data) {
+		t.Fatalf("WriteAt = %d, %v", n, err)
+	}
+	obj.Close()
+
+	var dup MemObject
+	if err := dup.Create("0x1:0x20", size); err == nil {
+		t.Fatal("created an existing object")
+	}
+	if err := obj.Open("0x1:0x20", size); err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	all, err := io.ReadAll(&obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != size {
+		t.Fatalf("read %d bytes of a %d byte object", len(all), size)
+	}
+	if !bytes.Equal(all[:memBlockSize-10], make([]byte, memBlockSize-10)) {
+		t.Fatal("unwritten bytes are not zero")
+	}
+	if !bytes.Equal(all[memBlockSize-10:memBlockSize-10+len(data)], data) {
+		t.Fatal("read different bytes than were written")
+	}
+	if _, err := obj.Seek(0, io.SeekEnd); err == nil {
+		t.Fatal("seeked to the end of a size-less object")
+	}
+	if _, err := obj.ReadAt(make([]byte, 1), size); err != io.EOF {
+		t.Fatalf("ReadAt past the object size returned %v", err)
+	}
+}
@@ -1,3 +1,6 @@
+//go:build !nomotr
+// +build !nomotr
+
 /*
  * Based on: https://github.com/Seagate/cortx-motr/blob/main/bindings/go/mio/mio.go
  * mio.go has the following copyright notice:
@@ -125,6 +128,11 @@ var threadsN int
 
 // initialises mio module.
 func Init(localEP *string, haxEP *string, profile *string, procFid *string, threads int, enableTrace bool) (bool, error) {
+	return InitClient(localEP, haxEP, profile, procFid, ClientConfig{Threads: threads, Trace: enableTrace})
+}
+
+// InitClient initialises the Motr client with the tunables in cc.
+func InitClient(localEP *string, haxEP *string, profile *string, procFid *string, cc ClientConfig) (bool, error) {
 
 	if localEP == nil {
 		return false, fmt.Errorf("%s must be specified", "localEP")
@@ -135,20 +143,25 @@ func Init(localEP *string, haxEP *string, profile *string, procFid *string, thre
 	} else if procFid == nil {
 		return false, fmt.Errorf("%s must be specified", "procFID")
 	}
-	threadsN = threads
-	if !enableTrace {
+	if err := cc.Validate(); err != nil {
+		return false, err
+	}
+	cc = cc.withDefaults()
+	threadsN = cc.Threads
+	if !cc.Trace {
 		C.m0_trace_set_mmapped_buffer(false)
 		C.m0_trace_level_allow(C.M0_WARN)
 	}
-	C.conf.mc_is_oostore = true
+	C.conf.mc_is_oostore = C.bool(!cc.NoOostore)
+	C.conf.mc_is_read_verify = C.bool(cc.ReadVerify)
 	C.conf.mc_local_addr = C.CString(*localEP)
 	C.conf.mc_ha_addr = C.CString(*haxEP)
 	C.conf.mc_profile = C.CString(*profile)
 	C.conf.mc_process_fid = C.CString(*procFid)
-	C.conf.mc_tm_recv_queue_min_len = 64
-	C.conf.mc_max_rpc_msg_size = 65536
+	C.conf.mc_tm_recv_queue_min_len = C.uint32_t(cc.RecvQueueMinLen)
+	C.conf.mc_max_rpc_msg_size = C.uint32_t(cc.MaxRPCMsgSize)
 	C.conf.mc_idx_service_id = C.M0_IDX_DIX
-	C.dix_conf.kc_create_meta = false
+	C.dix_conf.kc_create_meta = C.bool(cc.CreateIndexMeta)
 	C.conf.mc_idx_service_conf = unsafe.Pointer(&C.dix_conf)
 
 	rc := C.m0_client_init(&C.instance, &C.conf, true)
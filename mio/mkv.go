@@ -1,3 +1,6 @@
+//go:build !nomotr
+// +build !nomotr
+
 /*
  * Copyright (c) 2021 Seagate Technology LLC and/or its Affiliates
  *
@@ -34,13 +37,9 @@ import "C"
 import (
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"unsafe"
 
 	ds "github.com/ipfs/go-datastore"
-	logging "github.com/ipfs/go-log/v2"
-
-	"github.com/allisterb/go-ds-motr/uint128"
 )
 
 // Mkv provides key-value API to Motr
@@ -49,9 +48,6 @@ type Mkv struct {
 	idx   *C.struct_m0_idx
 }
 
-var log = logging.Logger("motrds")
-var hash128 = fnv.New128()
-
 func uint128fid(u C.struct_m0_uint128) (f C.struct_m0_fid) {
 	f.f_container = u.u_hi
 	f.f_key = u.u_lo
@@ -311,6 +307,65 @@ func (mkv *Mkv) GetSize(key []byte) (int, error) {
 	}
 }
 
+// Next returns up to nr keys of the index in key order and their values, starting
+// after key or from the first key of the index when key is nil. The returned slices
+// are shorter than nr when the end of the index is reached.
+func (mkv *Mkv) Next(key []byte, nr int) ([][]byte, [][]byte, error) {
+	if mkv.idx == nil {
+		return nil, nil, errors.New("index is not opened")
+	}
+	var k, v C.struct_m0_bufvec
+	if C.m0_bufvec_empty_alloc(&k, C.uint32_t(nr)) != 0 {
+		return nil, nil, errors.New("failed to allocate key bufvec")
+	}
+	defer C.m0_bufvec_free(&k) // Motr allocates the returned keys
+	if C.m0_bufvec_empty_alloc(&v, C.uint32_t(nr)) != 0 {
+		return nil, nil, errors.New("failed to allocate value bufvec")
+	}
+	defer C.m0_bufvec_free(&v) // and values
+
+	bufs := (*[1 << 28]unsafe.Pointer)(unsafe.Pointer(k.ov_buf))[:nr:nr]
+	counts := (*[1 << 28]C.ulong)(unsafe.Pointer(k.ov_vec.v_count))[:nr:nr]
+	flags := C.uint(0)
+	if len(key) > 0 {
+		// The start key is freed with the returned keys so it's copied to C memory.
+		bufs[0] = C.CBytes(key)
+		counts[0] = C.ulong(len(key))
+		flags = C.M0_OIF_EXCLUDE_START_KEY
+	}
+	rcs := (*C.int32_t)(C.calloc(C.ulong(nr), C.sizeof_int32_t))
+	defer C.free(unsafe.Pointer(rcs))
+
+	var op *C.struct_m0_op
+	rc := C.m0_idx_op(mkv.idx, C.M0_IC_NEXT, &k, &v, rcs, flags, &op)
+	if rc != 0 {
+		return nil, nil, fmt.Errorf("failed to init index op: %d", rc)
+	}
+
+	C.m0_op_launch(&op, 1)
+	rc = C.m0_op_wait(op, bits(C.M0_OS_FAILED,
+		C.M0_OS_STABLE), C.M0_TIME_NEVER)
+	if rc == 0 {
+		rc = C.m0_rc(op)
+	}
+	C.m0_op_fini(op)
+	C.m0_op_free(op)
+
+	if rc != 0 {
+		return nil, nil, fmt.Errorf("op failed: %d", rc)
+	}
+	res := (*[1 << 28]C.int32_t)(unsafe.Pointer(rcs))[:nr:nr]
+	vbufs := (*[1 << 28]unsafe.Pointer)(unsafe.Pointer(v.ov_buf))[:nr:nr]
+	vcounts := (*[1 << 28]C.ulong)(unsafe.Pointer(v.ov_vec.v_count))[:nr:nr]
+	keys, values := make([][]byte, 0, nr), make([][]byte, 0, nr)
+	for i := 0; i < nr && res[i] == 0 && bufs[i] != nil; i++ {
+		keys = append(keys, C.GoBytes(bufs[i], C.int(counts[i])))
+		values = append(values, C.GoBytes(vbufs[i], C.int(vcounts[i])))
+	}
+	log.Debugf("        Next %v keys after OID %s from Motr: %v keys.", nr, getOIDstr(key), len(keys))
+	return keys, values, nil
+}
+
 /*
 func (mkv *Mkv) GetSize(key []byte) (int, error) {
 	if v, eget := mkv.Get(key); eget != nil {
@@ -321,13 +376,5 @@ func (mkv *Mkv) GetSize(key []byte) (int, error) {
 
 }
 */
-func getOID(key ds.Key) []byte {
-	return hash128.Sum(key.Bytes())
-}
-
-func getOIDstr(oid []byte) string {
-	u := uint128.FromBytes(oid)
-	return fmt.Sprintf("0x%x:0x%x", u.Hi, u.Lo)
-}
 
 // vi: sw=4 ts=4 expandtab ai
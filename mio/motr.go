@@ -0,0 +1,18 @@
+//go:build !nomotr
+// +build !nomotr
+
+package mio
+
+// Backend used when none is specified.
+const DefaultBackend = MotrBackend
+
+var _ Index = (*Mkv)(nil)
+var _ Object = (*Mio)(nil)
+
+func newMotrIndex() (Index, error) {
+	return &Mkv{}, nil
+}
+
+func newMotrObject() (Object, error) {
+	return &Mio{}, nil
+}
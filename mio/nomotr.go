@@ -0,0 +1,30 @@
+//go:build nomotr
+// +build nomotr
+
+package mio
+
+import "errors"
+
+// Backend used when none is specified. Builds with the nomotr tag don't link the
+// Motr client library and only have the memory backend.
+const DefaultBackend = MemoryBackend
+
+var errNoMotr = errors.New("mio: built without the Motr client library (nomotr build tag)")
+
+// Init fails in builds without the Motr client library.
+func Init(localEP *string, haxEP *string, profile *string, procFid *string, threads int, enableTrace bool) (bool, error) {
+	return false, errNoMotr
+}
+
+// InitClient fails in builds without the Motr client library.
+func InitClient(localEP *string, haxEP *string, profile *string, procFid *string, cc ClientConfig) (bool, error) {
+	return false, errNoMotr
+}
+
+func newMotrIndex() (Index, error) {
+	return nil, errNoMotr
+}
+
+func newMotrObject() (Object, error) {
+	return nil, errNoMotr
+}
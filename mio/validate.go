@@ -0,0 +1,157 @@
+package mio
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Types of the fids in a Motr client configuration, stored in the most significant
+// byte of the fid container.
+const (
+	ProfileFidType = 0x70
+	ProcessFidType = 0x72
+	IndexFidType   = 0x78
+)
+
+// ParseFid parses a Motr fid written as <container>:<key> in hexadecimal, with or
+// without 0x prefixes, as m0_fid_sscanf does.
+func ParseFid(fid string) (container, key uint64, err error) {
+	parts := strings.Split(fid, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("fid %q is not written as <container>:<key>, for example 0x7800000000000123:0x1", fid)
+	}
+	for i, p := range parts {
+		name := [...]string{"container", "key"}[i]
+		h := strings.TrimPrefix(strings.TrimPrefix(p, "0x"), "0X")
+		if h == "" {
+			return 0, 0, fmt.Errorf("fid %q has an empty %s", fid, name)
+		} else if len(h) > 16 {
+			return 0, 0, fmt.Errorf("fid %q has a %s longer than 64 bits", fid, name)
+		}
+		v, err := strconv.ParseUint(h, 16, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("fid %q has a %s %q that is not hexadecimal", fid, name, p)
+		}
+		if i == 0 {
+			container = v
+		} else {
+			key = v
+		}
+	}
+	return container, key, nil
+}
+
+// ValidateFid checks fid is a Motr fid of the given type.
+func ValidateFid(fid string, typ byte) error {
+	container, _, err := ParseFid(fid)
+	if err != nil {
+		return err
+	}
+	if t := byte(container >> 56); t != typ {
+		return fmt.Errorf("fid %q has type 0x%02x, must start with 0x%02x in its most significant byte, for example 0x%02x00000000000001:0x1", fid, t, typ, typ)
+	}
+	return nil
+}
+
+// Transports of the inet:<transport>:<host>@<port> endpoint addresses of the
+// libfabric and socket network transports.
+var inetTransports = []string{"tcp", "verbs", "stream", "dgram"}
+
+// LNet process id of Motr endpoints.
+const lnetPID = 12345
+
+// ValidateEndpoint checks ep is a Motr endpoint address, either
+// inet:<transport>:<host>@<port> or the LNet form <nid>@<net>:12345:<portal>:<tmid>.
+func ValidateEndpoint(ep string) error {
+	if ep == "" {
+		return fmt.Errorf("endpoint address is empty")
+	}
+	if strings.HasPrefix(ep, "inet:") {
+		return validateInetEndpoint(ep)
+	}
+	return validateLNetEndpoint(ep)
+}
+
+func validateInetEndpoint(ep string) error {
+	parts := strings.SplitN(ep, ":", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("endpoint %q is not written as inet:<transport>:<host>@<port>", ep)
+	}
+	valid := false
+	for _, t := range inetTransports {
+		valid = valid || parts[1] == t
+	}
+	if !valid {
+		return fmt.Errorf("endpoint %q has unknown transport %q, must be one of %s", ep, parts[1], strings.Join(inetTransports, ", "))
+	}
+	at := strings.LastIndex(parts[2], "@")
+	if at < 0 {
+		return fmt.Errorf("endpoint %q has no port, it must end in @<port>", ep)
+	}
+	host, port := parts[2][:at], parts[2][at+1:]
+	if err := validateHost(host); err != nil {
+		return fmt.Errorf("endpoint %q: %v", ep, err)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("endpoint %q has port %q, must be a number from 1 to 65535", ep, port)
+	}
+	return nil
+}
+
+func validateLNetEndpoint(ep string) error {
+	parts := strings.Split(ep, ":")
+	if len(parts) != 4 {
+		return fmt.Errorf("endpoint %q is neither inet:<transport>:<host>@<port> nor <nid>@<net>:%d:<portal>:<tmid>", ep, lnetPID)
+	}
+	at := strings.LastIndex(parts[0], "@")
+	if at < 0 {
+		return fmt.Errorf("endpoint %q has NID %q with no network, it must be written as <address>@<net>", ep, parts[0])
+	}
+	addr, lnet := parts[0][:at], parts[0][at+1:]
+	switch kind := strings.TrimRight(lnet, "0123456789"); kind {
+	case "lo":
+		if addr != "0" || lnet != "lo" {
+			return fmt.Errorf("endpoint %q has loopback NID %q, must be 0@lo", ep, parts[0])
+		}
+	case "tcp", "o2ib":
+		if ip := net.ParseIP(addr); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("endpoint %q has NID address %q, must be an IPv4 address", ep, addr)
+		}
+	default:
+		return fmt.Errorf("endpoint %q has unknown LNet network %q, must be tcp, o2ib or lo with an optional number", ep, lnet)
+	}
+	if parts[1] != strconv.Itoa(lnetPID) {
+		return fmt.Errorf("endpoint %q has process id %q, must be %d", ep, parts[1], lnetPID)
+	}
+	if _, err := strconv.ParseUint(parts[2], 10, 32); err != nil {
+		return fmt.Errorf("endpoint %q has portal %q, must be a number", ep, parts[2])
+	}
+	if _, err := strconv.ParseUint(parts[3], 10, 32); err != nil && parts[3] != "*" {
+		return fmt.Errorf("endpoint %q has transfer machine id %q, must be a number or *", ep, parts[3])
+	}
+	return nil
+}
+
+func validateHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("host is empty")
+	} else if net.ParseIP(host) != nil {
+		return nil
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("host name %q is longer than 253 characters", host)
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("%q is neither an IP address nor a valid host name", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("%q is neither an IP address nor a valid host name", host)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package mio
+
+import "testing"
+
+func TestValidateEndpoint(t *testing.T) {
+	for ep, valid := range map[string]bool{
+		"inet:tcp:192.168.1.161@22001":  true,
+		"inet:verbs:10.0.0.1@3000":      true,
+		"inet:tcp:motr-node-1.lan@3000": true,
+		"192.168.1.161@tcp:12345:34:1":  true,
+		"10.0.0.1@o2ib1:12345:41:301":   true,
+		"0@lo:12345:34:*":               true,
+		"":                              false,
+		"inet:udp:192.168.1.161@22001":  false,
+		"inet:tcp:192.168.1.161":        false,
+		"inet:tcp:192.168.1.161@0":      false,
+		"inet:tcp:192.168.1.161@65536":  false,
+		"inet:tcp:-bad-@22001":          false,
+		"192.168.1.161@tcp:12346:34:1":  false,
+		"192.168.1.161@udp:12345:34:1":  false,
+		"192.168.1.161@tcp:12345:x:1":   false,
+		"192.168.1.161:12345:34:1":      false,
+		"1@lo:12345:34:1":               false,
+		"host@tcp:12345:34:1":           false,
+	} {
+		if err := ValidateEndpoint(ep); (err == nil) != valid {
+			t.Errorf("ValidateEndpoint(%q) = %v", ep, err)
+		}
+	}
+}
+
+func TestValidateFid(t *testing.T) {
+	for _, c := range []struct {
+		fid   string
+		typ   byte
+		valid bool
+	}{
+		{"0x7800000000000123:0x123456780", IndexFidType, true},
+		{"7800000000000123:123456780", IndexFidType, true},
+		{"0x7000000000000001:0x0", ProfileFidType, true},
+		{"0x7200000000000001:0x3", ProcessFidType, true},
+		{"0x7200000000000001:0x3", ProfileFidType, false},
+		{"0x123:0x1", IndexFidType, false},
+		{"0x7800000000000123", IndexFidType, false},
+		{"0x7800000000000123:", IndexFidType, false},
+		{"0x7800000000000123:0xg", IndexFidType, false},
+		{"0x780000000000000123:0x1", IndexFidType, false},
+		{"0x7800000000000123:0x1:0x2", IndexFidType, false},
+	} {
+		if err := ValidateFid(c.fid, c.typ); (err == nil) != c.valid {
+			t.Errorf("ValidateFid(%q, 0x%x) = %v", c.fid, c.typ, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package motrds
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"sync/atomic"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// Benchmarks run on the datastore opened by testDatastore, against a Motr cluster
+// when the MOTRDS_TEST_* environment variables are set.
+
+var benchSizes = []int{128, 4 << 10, 256 << 10, 1 << 20}
+var benchConcurrency = []int{1, 16}
+
+func sizeName(size int) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%dMiB", size>>20)
+	case size >= 1<<10:
+		return fmt.Sprintf("%dKiB", size>>10)
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
+
+func benchKey(i int) ds.Key {
+	return ds.NewKey(fmt.Sprintf("/bench/%08d", i))
+}
+
+// putBenchValues puts n values of size bytes at benchKey(0) to benchKey(n-1).
+func putBenchValues(b *testing.B, d *MotrDatastore, n int, size int) {
+	ctx := context.Background()
+	value := make([]byte, size)
+	rand.Read(value)
+	for i := 0; i < n; i++ {
+		if err := d.Put(ctx, benchKey(i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchOps runs op in parallel for every value size and concurrency level on a
+// datastore holding keys values of the size.
+func benchOps(b *testing.B, keys int, op func(d *MotrDatastore, value []byte, r *mrand.Rand) error) {
+	for _, size := range benchSizes {
+		for _, conc := range benchConcurrency {
+			b.Run(fmt.Sprintf("size=%s/conc=%d", sizeName(size), conc), func(b *testing.B) {
+				d := testDatastore(b)
+				putBenchValues(b, d, keys, size)
+				value := make([]byte, size)
+				rand.Read(value)
+				b.SetBytes(int64(size))
+				b.SetParallelism(conc)
+				b.ResetTimer()
+				var seed int64
+				b.RunParallel(func(pb *testing.PB) {
+					r := mrand.New(mrand.NewSource(atomic.AddInt64(&seed, 1)))
+					for pb.Next() {
+						if err := op(d, value, r); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	benchOps(b, 256, func(d *MotrDatastore, value []byte, r *mrand.Rand) error {
+		return d.Put(context.Background(), benchKey(r.Intn(256)), value)
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchOps(b, 256, func(d *MotrDatastore, value []byte, r *mrand.Rand) error {
+		_, err := d.Get(context.Background(), benchKey(r.Intn(256)))
+		return err
+	})
+}
+
+func BenchmarkQuery(b *testing.B) {
+	const keys = 1000
+	for _, keysOnly := range []bool{true, false} {
+		b.Run(fmt.Sprintf("keysOnly=%v", keysOnly), func(b *testing.B) {
+			d := testDatastore(b)
+			putBenchValues(b, d, keys, 4<<10)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, err := d.Query(context.Background(), query.Query{Prefix: "/bench", KeysOnly: keysOnly})
+				if err != nil {
+					b.Fatal(err)
+				}
+				n := 0
+				for res := range r.Next() {
+					if res.Error != nil {
+						b.Fatal(res.Error)
+					}
+					n++
+				}
+				r.Close()
+				if n != keys {
+					b.Fatalf("query returned %d of %d keys", n, keys)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBatch(b *testing.B) {
+	const batchSize = 100
+	for _, size := range benchSizes[:3] {
+		b.Run(fmt.Sprintf("size=%s", sizeName(size)), func(b *testing.B) {
+			ctx := context.Background()
+			d := testDatastore(b)
+			value := make([]byte, size)
+			rand.Read(value)
+			b.SetBytes(int64(size * batchSize))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				batch, _ := d.Batch(ctx)
+				for k := 0; k < batchSize; k++ {
+					batch.Put(ctx, benchKey(k), value)
+				}
+				if err := batch.Commit(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package motrds
+
+import (
+	"container/list"
+	"sync"
+)
+
+// valueCache is a 2Q cache of object values bounded by the total size of the values.
+// New values enter a FIFO of recently added entries and are only promoted to the LRU
+// of frequently used entries when they are added again shortly after eviction, so a
+// single scan through the datastore doesn't flush hot blocks.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int
+	// Share of the capacity the FIFO of recently added entries can grow to.
+	recentCapacity int
+	size           int
+	recentSize     int
+	recent         *list.List
+	frequent       *list.List
+	ghosts         *list.List
+	entries        map[string]*list.Element
+	ghostEntries   map[string]*list.Element
+	// Incremented by every invalidation so values read before it are not cached.
+	generation uint64
+	hits       uint64
+	misses     uint64
+}
+
+type cacheEntry struct {
+	key      string
+	value    []byte
+	frequent bool
+}
+
+// CacheStats reports the state of the datastore's value cache.
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Entries  int
+	Size     int
+	Capacity int
+}
+
+func newValueCache(capacity int) *valueCache {
+	return &valueCache{
+		capacity:       capacity,
+		recentCapacity: capacity / 4,
+		recent:         list.New(),
+		frequent:       list.New(),
+		ghosts:         list.New(),
+		entries:        make(map[string]*list.Element),
+		ghostEntries:   make(map[string]*list.Element),
+	}
+}
+
+// Get returns a copy of the cached value of a key, and the cache generation to pass
+// to Add when the value has to be read from Motr instead.
+func (c *valueCache) Get(key string) ([]byte, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		if e := el.Value.(*cacheEntry); e.frequent {
+			c.frequent.MoveToFront(el)
+		}
+		c.hits++
+		return append([]byte{}, el.Value.(*cacheEntry).value...), c.generation, true
+	}
+	c.misses++
+	return nil, c.generation, false
+}
+
+// Add caches a copy of the value of a key unless the cache was invalidated since
+// generation.
+func (c *valueCache) Add(key string, value []byte, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation || len(value) > c.capacity/8 {
+		return
+	}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	value = append([]byte{}, value...)
+	e := &cacheEntry{key: key, value: value}
+	if g, ok := c.ghostEntries[key]; ok {
+		c.ghosts.Remove(g)
+		delete(c.ghostEntries, key)
+		e.frequent = true
+		c.entries[key] = c.frequent.PushFront(e)
+	} else {
+		c.entries[key] = c.recent.PushFront(e)
+		c.recentSize += len(value)
+	}
+	c.size += len(value)
+	c.evict()
+}
+
+// Remove invalidates the cached value of a key.
+func (c *valueCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *valueCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Entries:  len(c.entries),
+		Size:     c.size,
+		Capacity: c.capacity,
+	}
+}
+
+func (c *valueCache) evict() {
+	for c.size > c.capacity {
+		if c.recentSize > c.recentCapacity || c.frequent.Len() == 0 {
+			el := c.recent.Back()
+			c.removeElement(el)
+			key := el.Value.(*cacheEntry).key
+			c.ghostEntries[key] = c.ghosts.PushFront(key)
+			for c.ghosts.Len() > len(c.entries)+1 {
+				g := c.ghosts.Back()
+				c.ghosts.Remove(g)
+				delete(c.ghostEntries, g.Value.(string))
+			}
+		} else {
+			c.removeElement(c.frequent.Back())
+		}
+	}
+}
+
+func (c *valueCache) removeElement(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	if e.frequent {
+		c.frequent.Remove(el)
+	} else {
+		c.recent.Remove(el)
+		c.recentSize -= len(e.value)
+	}
+	c.size -= len(e.value)
+	delete(c.entries, e.key)
+}
@@ -0,0 +1,162 @@
+package motrds
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// TestValueCache checks hits and misses, that cached values can't be changed
+// through the slices passed to Add or returned by Get, and that values read before
+// an invalidation are not cached.
+func TestValueCache(t *testing.T) {
+	c := newValueCache(1 << 10)
+	if _, gen, ok := c.Get("/a"); ok {
+		t.Fatal("hit in an empty cache")
+	} else {
+		v := []byte("Hello")
+		c.Add("/a", v, gen)
+		v[0] = 'X'
+	}
+	v, _, ok := c.Get("/a")
+	if !ok || string(v) != "Hello" {
+		t.Fatalf("Get = %q, %v after changing the added slice", v, ok)
+	}
+	v[0] = 'X'
+	if v, _, ok := c.Get("/a"); !ok || string(v) != "Hello" {
+		t.Fatalf("Get = %q, %v after changing a returned slice", v, ok)
+	}
+	if s := c.Stats(); s.Hits != 2 || s.Misses != 1 || s.Entries != 1 || s.Size != 5 {
+		t.Fatalf("stats %+v", s)
+	}
+
+	// A value read from Motr while the key is invalidated is stale.
+	_, gen, _ := c.Get("/b")
+	c.Remove("/other")
+	c.Add("/b", []byte("stale"), gen)
+	if v, _, ok := c.Get("/b"); ok {
+		t.Fatalf("Get = %q for a value added with a generation older than an invalidation", v)
+	}
+	c.Remove("/a")
+	if _, _, ok := c.Get("/a"); ok {
+		t.Fatal("hit after Remove")
+	}
+}
+
+// TestValueCacheSize checks the cache stays within its capacity, doesn't cache
+// values larger than an eighth of it, and keeps frequently used values when many
+// values are added once.
+func TestValueCacheSize(t *testing.T) {
+	c := newValueCache(1 << 10)
+	_, gen, _ := c.Get("/large")
+	c.Add("/large", make([]byte, 1<<10/8+1), gen)
+	if _, _, ok := c.Get("/large"); ok {
+		t.Fatal("cached a value larger than an eighth of the capacity")
+	}
+	// Adding a value again shortly after it was evicted makes it frequent.
+	add := func(key string) {
+		_, gen, _ := c.Get(key)
+		c.Add(key, make([]byte, 100), gen)
+	}
+	add("/hot")
+	for i := 0; i < 12; i++ {
+		add(fmt.Sprintf("/cold/%d", i))
+	}
+	add("/hot")
+	for i := 0; i < 100; i++ {
+		add(fmt.Sprintf("/scan/%d", i))
+		if s := c.Stats(); s.Size > s.Capacity {
+			t.Fatalf("cache size %v exceeds capacity %v", s.Size, s.Capacity)
+		}
+	}
+	if _, _, ok := c.Get("/hot"); !ok {
+		t.Fatal("a scan evicted a frequently used value")
+	}
+}
+
+// TestCacheInvalidation checks that puts, deletes and committed transactions are
+// seen by reads through the cache.
+func TestCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	conf.CacheSize = 1 << 20
+	d := openTestDatastore(t, conf)
+	defer d.Close()
+	key := ds.NewKey("/cache/key")
+	get := func(want string) {
+		t.Helper()
+		if v, err := d.Get(ctx, key); err != nil || string(v) != want {
+			t.Fatalf("Get = %q, %v, want %q", v, err, want)
+		}
+	}
+	if err := d.Put(ctx, key, []byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	get("Hello")
+	v, _ := d.Get(ctx, key)
+	v[0] = 'X'
+	get("Hello")
+	if s := d.CacheStats(); s.Hits == 0 {
+		t.Fatalf("no cache hits: %+v", s)
+	}
+
+	if err := d.Put(ctx, key, []byte("put")); err != nil {
+		t.Fatal(err)
+	}
+	get("put")
+	txn, _ := d.NewTransaction(ctx, false)
+	txn.Put(ctx, key, []byte("committed"))
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	get("committed")
+	if err := d.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, key); err != ds.ErrNotFound {
+		t.Fatalf("Get returned %v after Delete", err)
+	}
+}
+
+// TestCacheRace checks that reads racing with puts of a key don't leave a stale
+// value in the cache.
+func TestCacheRace(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	conf.CacheSize = 1 << 20
+	d := openTestDatastore(t, conf)
+	defer d.Close()
+	key := ds.NewKey("/cache/race")
+	if err := d.Put(ctx, key, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					d.Get(ctx, key)
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 200; i++ {
+		if err := d.Put(ctx, key, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if v, err := d.Get(ctx, key); err != nil || string(v) != "200" {
+		t.Fatalf("Get = %q, %v after the last put", v, err)
+	}
+}
@@ -0,0 +1,102 @@
+package motrds
+
+import (
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Catalogue backends for the store of datastore keys and their records.
+const (
+	LevelDBCatalogue = "leveldb"
+	MemoryCatalogue  = "memory"
+	BadgerCatalogue  = "badger"
+	MotrCatalogue    = "motr"
+)
+
+var CatalogueBackends = []string{LevelDBCatalogue, MemoryCatalogue, BadgerCatalogue, MotrCatalogue}
+
+// Catalogue is the ordered key-value store holding the catalogue record of every
+// datastore key, along with the datastore's own bookkeeping under keys starting with
+// 0x00. It has the semantics of the subset of the goleveldb API the datastore uses:
+// Get returns leveldb.ErrNotFound for missing keys, and batches are written
+// atomically: a batch that fails leaves none of its operations applied, once the
+// catalogue is opened again for the motr backend, and the badger backend refuses
+// batches too large for one transaction. Iterators and snapshots see a consistent
+// view, except with the motr backend, whose iterators read the index as they move.
+type Catalogue interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	Has(key []byte, ro *opt.ReadOptions) (bool, error)
+	Put(key []byte, value []byte, wo *opt.WriteOptions) error
+	Delete(key []byte, wo *opt.WriteOptions) error
+	Write(batch *leveldb.Batch, wo *opt.WriteOptions) error
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+	GetSnapshot() (CatalogueSnapshot, error)
+	// CompactRange reclaims space used by deleted and overwritten records.
+	CompactRange(r util.Range) error
+	Close() error
+}
+
+// CatalogueSnapshot is a read-only view of a catalogue at a point in time.
+type CatalogueSnapshot interface {
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+	Release()
+}
+
+// levelDBCatalogue stores the catalogue in a LevelDB database on disk or in memory.
+type levelDBCatalogue struct {
+	*leveldb.DB
+}
+
+func (c levelDBCatalogue) GetSnapshot() (CatalogueSnapshot, error) {
+	return c.DB.GetSnapshot()
+}
+
+// OpenCatalogue opens the catalogue backend selected in the datastore configuration,
+// refusing writes to it when the configuration is read-only.
+func OpenCatalogue(conf Config) (Catalogue, error) {
+	cat, err := openCatalogue(conf)
+	if err != nil || !conf.ReadOnly {
+		return cat, err
+	}
+	return readOnlyCatalogue{cat}, nil
+}
+
+func openCatalogue(conf Config) (Catalogue, error) {
+	switch conf.CatalogueBackend {
+	case "", LevelDBCatalogue:
+		if conf.LevelDBPath == "" {
+			return nil, fmt.Errorf("motrds: no LevelDB path specified")
+		}
+		db, eldb := leveldb.OpenFile(conf.LevelDBPath, &opt.Options{ReadOnly: conf.ReadOnly, ErrorIfMissing: conf.ReadOnly})
+		if eldb != nil {
+			log.Errorf("Failed to open LevelDB database at %s.", conf.LevelDBPath)
+			return nil, eldb
+		}
+		log.Infof("Opened LevelDB database at %v.", conf.LevelDBPath)
+		return levelDBCatalogue{db}, nil
+	case MemoryCatalogue:
+		db, eldb := leveldb.Open(storage.NewMemStorage(), &opt.Options{})
+		if eldb != nil {
+			return nil, eldb
+		}
+		log.Warnf("Using in-memory catalogue, the datastore's keys will be lost when it is closed.")
+		return levelDBCatalogue{db}, nil
+	case BadgerCatalogue:
+		if conf.LevelDBPath == "" {
+			return nil, fmt.Errorf("motrds: no Badger catalogue path specified")
+		}
+		return openBadgerCatalogue(conf.LevelDBPath, conf.ReadOnly)
+	case MotrCatalogue:
+		if conf.CatalogueIdx == "" {
+			return nil, fmt.Errorf("motrds: no Motr catalogue index specified")
+		}
+		return openMotrCatalogue(conf.Backend, conf.CatalogueIdx, conf.CreateIndex, conf.ReadOnly)
+	default:
+		return nil, fmt.Errorf("motrds: unknown catalogue backend %q", conf.CatalogueBackend)
+	}
+}
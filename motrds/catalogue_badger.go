@@ -0,0 +1,317 @@
+package motrds
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// badgerCatalogue stores the catalogue in a Badger database, which keeps keys in an
+// LSM tree and large values in a separate log.
+type badgerCatalogue struct {
+	db *badger.DB
+}
+
+func openBadgerCatalogue(path string, readOnly bool) (Catalogue, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithReadOnly(readOnly))
+	if err != nil {
+		log.Errorf("Failed to open Badger database at %s.", path)
+		return nil, err
+	}
+	log.Infof("Opened Badger database at %v.", path)
+	return &badgerCatalogue{db: db}, nil
+}
+
+func (c *badgerCatalogue) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
+	err = c.db.View(func(txn *badger.Txn) error {
+		item, eget := txn.Get(key)
+		if eget == badger.ErrKeyNotFound {
+			return leveldb.ErrNotFound
+		} else if eget != nil {
+			return eget
+		}
+		value, eget = item.ValueCopy(nil)
+		return eget
+	})
+	return value, err
+}
+
+func (c *badgerCatalogue) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	if _, err := c.Get(key, ro); err == leveldb.ErrNotFound {
+		return false, nil
+	} else {
+		return err == nil, err
+	}
+}
+
+func (c *badgerCatalogue) Put(key []byte, value []byte, wo *opt.WriteOptions) error {
+	return c.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte{}, key...), append([]byte{}, value...))
+	})
+}
+
+func (c *badgerCatalogue) Delete(key []byte, wo *opt.WriteOptions) error {
+	return c.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(append([]byte{}, key...))
+	})
+}
+
+// Write applies a batch atomically in a single Badger transaction. Batches too large
+// for one transaction fail with badger.ErrTxnTooBig and leave the catalogue
+// unchanged, as splitting them would break the atomicity transaction commits and
+// expiration times rely on.
+func (c *badgerCatalogue) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	w := &badgerBatchWriter{txn: c.db.NewTransaction(true)}
+	defer w.txn.Discard()
+	if err := batch.Replay(w); err != nil {
+		return err
+	} else if w.err != nil {
+		return w.err
+	}
+	return w.txn.Commit()
+}
+
+type badgerBatchWriter struct {
+	txn *badger.Txn
+	err error
+}
+
+func (w *badgerBatchWriter) Put(key, value []byte) {
+	w.apply(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte{}, key...), append([]byte{}, value...))
+	})
+}
+
+func (w *badgerBatchWriter) Delete(key []byte) {
+	w.apply(func(txn *badger.Txn) error {
+		return txn.Delete(append([]byte{}, key...))
+	})
+}
+
+func (w *badgerBatchWriter) apply(op func(*badger.Txn) error) {
+	if w.err != nil {
+		return
+	}
+	if w.err = op(w.txn); w.err == badger.ErrTxnTooBig {
+		log.Errorf("Catalogue batch is too large for a single Badger transaction.")
+	}
+}
+
+func (c *badgerCatalogue) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	i := newBadgerIterator(c.db.NewTransaction(false), slice)
+	i.ownTxn = true
+	return i
+}
+
+func (c *badgerCatalogue) GetSnapshot() (CatalogueSnapshot, error) {
+	return badgerSnapshot{c.db.NewTransaction(false)}, nil
+}
+
+// CompactRange garbage collects Badger's value log until no more space can be
+// reclaimed. Badger compacts its LSM tree by itself.
+func (c *badgerCatalogue) CompactRange(r util.Range) error {
+	for {
+		if err := c.db.RunValueLogGC(0.5); err == badger.ErrNoRewrite {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *badgerCatalogue) Close() error {
+	return c.db.Close()
+}
+
+// A read-only Badger transaction sees the database as it was when it started.
+type badgerSnapshot struct {
+	txn *badger.Txn
+}
+
+func (s badgerSnapshot) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return newBadgerIterator(s.txn, slice)
+}
+
+func (s badgerSnapshot) Release() {
+	s.txn.Discard()
+}
+
+// badgerIterator adapts Badger iterators, which only move in one direction, to the
+// goleveldb iterator interface by opening a new Badger iterator when the direction
+// changes.
+type badgerIterator struct {
+	util.BasicReleaser
+	txn *badger.Txn
+	// Whether the transaction is discarded when the iterator is released.
+	ownTxn  bool
+	start   []byte
+	limit   []byte
+	it      *badger.Iterator
+	reverse bool
+	key     []byte
+	value   []byte
+	err     error
+}
+
+func newBadgerIterator(txn *badger.Txn, slice *util.Range) *badgerIterator {
+	i := &badgerIterator{txn: txn}
+	if slice != nil {
+		i.start, i.limit = slice.Start, slice.Limit
+	}
+	return i
+}
+
+func (i *badgerIterator) Release() {
+	if !i.Released() {
+		i.close()
+		if i.ownTxn {
+			i.txn.Discard()
+		}
+		i.key, i.value = nil, nil
+		i.BasicReleaser.Release()
+	}
+}
+
+func (i *badgerIterator) open(reverse bool) {
+	i.close()
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = reverse
+	i.it, i.reverse = i.txn.NewIterator(opts), reverse
+}
+
+func (i *badgerIterator) close() {
+	if i.it != nil {
+		i.it.Close()
+		i.it = nil
+	}
+}
+
+// load reads the entry at the Badger iterator's position if it is inside the range.
+func (i *badgerIterator) load() bool {
+	i.key, i.value = nil, nil
+	if !i.it.Valid() {
+		return false
+	}
+	item := i.it.Item()
+	k := item.Key()
+	if bytes.Compare(k, i.start) < 0 || (i.limit != nil && bytes.Compare(k, i.limit) >= 0) {
+		return false
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	i.key, i.value = item.KeyCopy(nil), v
+	return true
+}
+
+func (i *badgerIterator) First() bool {
+	if i.Released() {
+		return false
+	}
+	i.open(false)
+	i.it.Seek(i.start)
+	return i.load()
+}
+
+func (i *badgerIterator) Last() bool {
+	if i.Released() {
+		return false
+	}
+	i.open(true)
+	if i.limit == nil {
+		i.it.Rewind()
+	} else {
+		// Seek in reverse finds the last key at or before limit, which is excluded.
+		i.it.Seek(i.limit)
+		if i.it.Valid() && bytes.Equal(i.it.Item().Key(), i.limit) {
+			i.it.Next()
+		}
+	}
+	return i.load()
+}
+
+func (i *badgerIterator) Seek(key []byte) bool {
+	if i.Released() {
+		return false
+	}
+	if bytes.Compare(key, i.start) < 0 {
+		key = i.start
+	}
+	i.open(false)
+	i.it.Seek(key)
+	return i.load()
+}
+
+func (i *badgerIterator) Next() bool {
+	switch {
+	case i.Released():
+		return false
+	case i.it == nil:
+		return i.First()
+	case i.reverse:
+		if i.key == nil {
+			return i.First()
+		}
+		k := i.key
+		i.open(false)
+		i.it.Seek(k)
+		if i.it.Valid() && bytes.Equal(i.it.Item().Key(), k) {
+			i.it.Next()
+		}
+		return i.load()
+	default:
+		if !i.it.Valid() {
+			return false
+		}
+		i.it.Next()
+		return i.load()
+	}
+}
+
+func (i *badgerIterator) Prev() bool {
+	switch {
+	case i.Released():
+		return false
+	case i.it == nil:
+		return i.Last()
+	case !i.reverse:
+		if i.key == nil {
+			return i.Last()
+		}
+		k := i.key
+		i.open(true)
+		i.it.Seek(k)
+		if i.it.Valid() && bytes.Equal(i.it.Item().Key(), k) {
+			i.it.Next()
+		}
+		return i.load()
+	default:
+		if !i.it.Valid() {
+			return false
+		}
+		i.it.Next()
+		return i.load()
+	}
+}
+
+func (i *badgerIterator) Valid() bool {
+	return i.key != nil
+}
+
+func (i *badgerIterator) Key() []byte {
+	return i.key
+}
+
+func (i *badgerIterator) Value() []byte {
+	return i.value
+}
+
+func (i *badgerIterator) Error() error {
+	return i.err
+}
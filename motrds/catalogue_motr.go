@@ -0,0 +1,431 @@
+package motrds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/allisterb/go-ds-motr/mio"
+)
+
+// Number of keys read from the Motr catalogue index at a time by iterators.
+const motrCatalogueBatchSize = 1000
+
+// Prefix of the keys of the Motr catalogue index holding the undo batch of each
+// batch being written, followed by a sequence number.
+var motrUndoPrefix = []byte("\x00motrds/catalogue-undo/")
+
+// motrCatalogue stores the catalogue in a second Motr key-value index, so the
+// datastore keeps no state on local disk. Motr has no multi-key transactions or
+// snapshots, so iterators read the index as they move and don't see a consistent
+// view of it, and batches are applied one operation at a time after recording a
+// batch undoing them, which rolls the batch back if it fails partway.
+type motrCatalogue struct {
+	idx string
+	mkv mio.Index
+	// Sequence number of the last undo batch.
+	undoSeq uint64
+}
+
+// openMotrCatalogue opens the catalogue index and, unless it is opened read-only,
+// rolls back the batches left partly written by a failure.
+func openMotrCatalogue(backend string, idx string, create bool, readOnly bool) (Catalogue, error) {
+	mkv, emkv := mio.NewIndex(backend)
+	if emkv != nil {
+		return nil, emkv
+	}
+	c := &motrCatalogue{idx: idx, mkv: mkv, undoSeq: uint64(time.Now().UnixNano())}
+	if eidx := c.mkv.Open(idx, create && !readOnly); eidx != nil {
+		log.Errorf("Failed to open Motr catalogue index %v: %v", idx, eidx)
+		return nil, eidx
+	}
+	log.Infof("Opened Motr catalogue index %v.", idx)
+	undos, eundo := c.undoKeys()
+	if eundo != nil {
+		c.mkv.Close()
+		return nil, eundo
+	} else if len(undos) > 0 && readOnly {
+		log.Warnf("Motr catalogue index %v has %v partly written batches, which will be rolled back when it is opened for writing.", idx, len(undos))
+		return c, nil
+	}
+	// Batches are rolled back newest first, so keys written by several end up with
+	// the value they had before the oldest.
+	for n := len(undos) - 1; n >= 0; n-- {
+		if eroll := c.rollback(undos[n]); eroll != nil {
+			log.Errorf("Failed to roll back partly written batch in Motr catalogue index %v: %v.", idx, eroll)
+			c.mkv.Close()
+			return nil, eroll
+		}
+	}
+	if len(undos) > 0 {
+		log.Infof("Rolled back %v partly written batches in Motr catalogue index %v.", len(undos), idx)
+	}
+	return c, nil
+}
+
+// undoKeys returns the keys of the undo batches in the index in the order they were
+// written.
+func (c *motrCatalogue) undoKeys() ([][]byte, error) {
+	var keys [][]byte
+	i := &motrIterator{c: c, start: motrUndoPrefix, limit: util.BytesPrefix(motrUndoPrefix).Limit}
+	defer i.Release()
+	for i.Next() {
+		keys = append(keys, append([]byte{}, i.Key()...))
+	}
+	return keys, i.Error()
+}
+
+func (c *motrCatalogue) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	v, eget := c.mkv.Get(key)
+	if eget != nil {
+		if has, ehas := c.mkv.Has(key); ehas == nil && !has {
+			return nil, leveldb.ErrNotFound
+		}
+		return nil, eget
+	}
+	return v, nil
+}
+
+func (c *motrCatalogue) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	return c.mkv.Has(key)
+}
+
+func (c *motrCatalogue) Put(key []byte, value []byte, wo *opt.WriteOptions) error {
+	return c.mkv.Put(key, value, true)
+}
+
+func (c *motrCatalogue) Delete(key []byte, wo *opt.WriteOptions) error {
+	if edel := c.mkv.Delete(key); edel != nil {
+		if has, ehas := c.mkv.Has(key); ehas == nil && !has {
+			return nil
+		}
+		return edel
+	}
+	return nil
+}
+
+// Write applies a batch atomically. The previous values of the keys of the batch are
+// recorded as an undo batch first, which is replayed to roll the batch back if one of
+// its operations fails, or when the catalogue is next opened if that fails too.
+func (c *motrCatalogue) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	if batch.Len() <= 1 {
+		return c.apply(batch)
+	}
+	undo := &motrUndoBuilder{c: c, batch: new(leveldb.Batch), seen: map[string]bool{}}
+	if err := batch.Replay(undo); err != nil {
+		return err
+	} else if undo.err != nil {
+		return undo.err
+	}
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, atomic.AddUint64(&c.undoSeq, 1))
+	undoKey := append(append([]byte{}, motrUndoPrefix...), seq...)
+	if err := c.mkv.Put(undoKey, undo.batch.Dump(), true); err != nil {
+		return err
+	}
+	err := c.apply(batch)
+	if err == nil {
+		if err = c.mkv.Delete(undoKey); err == nil {
+			return nil
+		}
+	}
+	log.Errorf("Error writing batch to Motr catalogue index %v, rolling it back: %v.", c.idx, err)
+	if eroll := c.rollback(undoKey); eroll != nil {
+		log.Errorf("Error rolling back batch in Motr catalogue index %v, it will be rolled back when the catalogue is opened again: %v.", c.idx, eroll)
+	}
+	return err
+}
+
+// apply applies the operations of a batch one at a time.
+func (c *motrCatalogue) apply(batch *leveldb.Batch) error {
+	w := &motrBatchWriter{c: c}
+	if err := batch.Replay(w); err != nil {
+		return err
+	}
+	return w.err
+}
+
+// rollback applies the undo batch stored at undoKey and deletes it.
+func (c *motrCatalogue) rollback(undoKey []byte) error {
+	v, eget := c.mkv.Get(undoKey)
+	if eget != nil {
+		return eget
+	}
+	undo := new(leveldb.Batch)
+	if eload := undo.Load(v); eload != nil {
+		return eload
+	}
+	if eapply := c.apply(undo); eapply != nil {
+		return eapply
+	}
+	return c.mkv.Delete(undoKey)
+}
+
+// motrUndoBuilder builds the batch restoring the values the keys of a batch had
+// before it.
+type motrUndoBuilder struct {
+	c     *motrCatalogue
+	batch *leveldb.Batch
+	seen  map[string]bool
+	err   error
+}
+
+func (u *motrUndoBuilder) Put(key, value []byte) {
+	u.Delete(key)
+}
+
+func (u *motrUndoBuilder) Delete(key []byte) {
+	if u.err != nil || u.seen[string(key)] {
+		return
+	}
+	u.seen[string(key)] = true
+	if v, eget := u.c.Get(key, nil); eget == nil {
+		u.batch.Put(key, v)
+	} else if eget == leveldb.ErrNotFound {
+		u.batch.Delete(key)
+	} else {
+		u.err = eget
+	}
+}
+
+type motrBatchWriter struct {
+	c   *motrCatalogue
+	err error
+}
+
+func (w *motrBatchWriter) Put(key, value []byte) {
+	if w.err == nil {
+		w.err = w.c.Put(key, value, nil)
+	}
+}
+
+func (w *motrBatchWriter) Delete(key []byte) {
+	if w.err == nil {
+		w.err = w.c.Delete(key, nil)
+	}
+}
+
+// NewIterator returns an iterator reading the entries of the range from the index
+// in batches as it moves forward. Moving backward with Last or Prev reads the rest of
+// the range into memory first, as Motr indexes can only be read in key order.
+func (c *motrCatalogue) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	i := &motrIterator{c: c}
+	if slice != nil {
+		i.start, i.limit = slice.Start, slice.Limit
+	}
+	return i
+}
+
+// loadRange reads the entries of the index from start up to limit into memory.
+func (c *motrCatalogue) loadRange(start, limit []byte) (*memdb.DB, error) {
+	db := memdb.New(comparer.DefaultComparer, 0)
+	i := &motrIterator{c: c, start: start, limit: limit}
+	defer i.Release()
+	for i.Next() {
+		db.Put(i.Key(), i.Value())
+	}
+	return db, i.Error()
+}
+
+// motrIterator iterates forward over a range of the Motr catalogue index, holding
+// one batch of entries at a time.
+type motrIterator struct {
+	c            *motrCatalogue
+	start, limit []byte
+	keys, values [][]byte
+	pos          int
+	// Last key read from the index, and whether the range has no keys after it.
+	last      []byte
+	exhausted bool
+	started   bool
+	// Iterator over the range in memory once the iterator has moved backward.
+	mem      iterator.Iterator
+	err      error
+	releaser util.Releaser
+}
+
+// seek positions the iterator on the first entry of the range at or after key.
+func (i *motrIterator) seek(key []byte) bool {
+	if i.mem != nil {
+		i.mem.Release()
+		i.mem = nil
+	}
+	i.started, i.exhausted, i.keys, i.values, i.pos = true, false, nil, nil, 0
+	if len(i.start) > 0 && bytes.Compare(key, i.start) < 0 {
+		key = i.start
+	}
+	i.last = nil
+	if len(key) > 0 {
+		// Next excludes the key it starts from.
+		if v, eget := i.c.Get(key, nil); eget == nil {
+			if i.limit == nil || bytes.Compare(key, i.limit) < 0 {
+				i.keys, i.values = [][]byte{append([]byte{}, key...)}, [][]byte{v}
+			}
+		} else if eget != leveldb.ErrNotFound {
+			i.err = eget
+			return false
+		}
+		i.last = append([]byte{}, key...)
+	}
+	if len(i.keys) > 0 {
+		return true
+	}
+	return i.load()
+}
+
+// load reads the next batch of entries of the range after the last key read.
+func (i *motrIterator) load() bool {
+	i.keys, i.values, i.pos = nil, nil, 0
+	for len(i.keys) == 0 && !i.exhausted {
+		keys, values, enext := i.c.mkv.Next(i.last, motrCatalogueBatchSize)
+		if enext != nil {
+			i.err = enext
+			return false
+		}
+		i.exhausted = len(keys) < motrCatalogueBatchSize
+		for j, k := range keys {
+			if i.limit != nil && bytes.Compare(k, i.limit) >= 0 {
+				i.exhausted = true
+				break
+			}
+			i.keys, i.values = append(i.keys, k), append(i.values, values[j])
+		}
+		if len(keys) > 0 {
+			i.last = keys[len(keys)-1]
+		}
+	}
+	return len(i.keys) > 0
+}
+
+// backward switches to iterating over the range in memory, positioned on key or on
+// the last entry when key is nil.
+func (i *motrIterator) backward(key []byte) bool {
+	db, err := i.c.loadRange(i.start, i.limit)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	i.started, i.mem = true, db.NewIterator(nil)
+	if key == nil {
+		return i.mem.Last()
+	}
+	return i.mem.Seek(key) && i.mem.Prev()
+}
+
+func (i *motrIterator) First() bool {
+	return i.seek(nil)
+}
+
+func (i *motrIterator) Last() bool {
+	return i.backward(nil)
+}
+
+func (i *motrIterator) Seek(key []byte) bool {
+	return i.seek(key)
+}
+
+func (i *motrIterator) Next() bool {
+	if i.err != nil {
+		return false
+	} else if i.mem != nil {
+		return i.mem.Next()
+	} else if !i.started {
+		return i.First()
+	}
+	if i.pos < len(i.keys) {
+		i.pos++
+	}
+	if i.pos < len(i.keys) {
+		return true
+	}
+	return i.load()
+}
+
+func (i *motrIterator) Prev() bool {
+	if i.err != nil {
+		return false
+	} else if i.mem != nil {
+		return i.mem.Prev()
+	} else if !i.Valid() {
+		return i.Last()
+	}
+	return i.backward(i.Key())
+}
+
+func (i *motrIterator) Valid() bool {
+	if i.mem != nil {
+		return i.mem.Valid()
+	}
+	return i.err == nil && i.pos < len(i.keys)
+}
+
+func (i *motrIterator) Key() []byte {
+	if i.mem != nil {
+		return i.mem.Key()
+	} else if !i.Valid() {
+		return nil
+	}
+	return i.keys[i.pos]
+}
+
+func (i *motrIterator) Value() []byte {
+	if i.mem != nil {
+		return i.mem.Value()
+	} else if !i.Valid() {
+		return nil
+	}
+	return i.values[i.pos]
+}
+
+func (i *motrIterator) Error() error {
+	return i.err
+}
+
+func (i *motrIterator) SetReleaser(releaser util.Releaser) {
+	i.releaser = releaser
+}
+
+func (i *motrIterator) Release() {
+	if i.mem != nil {
+		i.mem.Release()
+		i.mem = nil
+	}
+	i.keys, i.values = nil, nil
+	if i.releaser != nil {
+		i.releaser.Release()
+		i.releaser = nil
+	}
+}
+
+// GetSnapshot returns a view of the catalogue whose iterators read the index as they
+// move, as Motr indexes have no snapshots.
+func (c *motrCatalogue) GetSnapshot() (CatalogueSnapshot, error) {
+	return motrSnapshot{c}, nil
+}
+
+// CompactRange does nothing as Motr reclaims the space of deleted records itself.
+func (c *motrCatalogue) CompactRange(r util.Range) error {
+	return nil
+}
+
+func (c *motrCatalogue) Close() error {
+	return c.mkv.Close()
+}
+
+type motrSnapshot struct {
+	c *motrCatalogue
+}
+
+func (s motrSnapshot) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return s.c.NewIterator(slice, ro)
+}
+
+func (s motrSnapshot) Release() {}
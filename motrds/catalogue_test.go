@@ -0,0 +1,204 @@
+package motrds
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/allisterb/go-ds-motr/mio"
+)
+
+// TestMotrCatalogueIterator checks that iterators over the Motr catalogue, which read
+// the keys and values of the index in batches, return the same entries as LevelDB for
+// ranges spanning several batches, seeks and moves backward.
+func TestMotrCatalogueIterator(t *testing.T) {
+	motr, err := openMotrCatalogue(mio.MemoryBackend, newTestIndex(), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer motr.Close()
+	ldb, err := OpenCatalogue(Config{CatalogueBackend: MemoryCatalogue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+	batch := new(leveldb.Batch)
+	for i := 0; i < 2*motrCatalogueBatchSize+10; i++ {
+		batch.Put([]byte(fmt.Sprintf("/k/%05d", i)), []byte(fmt.Sprint(i)))
+	}
+	batch.Put([]byte("\x00motrds/other"), []byte("x"))
+	batch.Put([]byte("/l"), []byte("x"))
+	for _, c := range []Catalogue{motr, ldb} {
+		if err := c.Write(batch, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	i := motr.NewIterator(nil, nil)
+	for n := 0; n < motrCatalogueBatchSize+1 && i.Next(); n++ {
+		if held := len(i.(*motrIterator).keys); held > motrCatalogueBatchSize {
+			t.Fatalf("iterator holds %d entries", held)
+		}
+	}
+	i.Release()
+
+	// Values are read along with the keys rather than one at a time.
+	c := motr.(*motrCatalogue)
+	fi, err := mio.NewFaultInjector([]mio.Fault{{Ops: []string{mio.OpGet}, Error: "get while iterating"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := c.mkv
+	c.mkv = fi.Index(idx)
+	i = motr.NewIterator(nil, nil)
+	n := 0
+	for ; i.Next(); n++ {
+	}
+	if i.Error() != nil || n != batch.Len() {
+		t.Fatalf("iterated over %d of %d entries: %v", n, batch.Len(), i.Error())
+	}
+	i.Release()
+	c.mkv = idx
+
+	moves := []struct {
+		name string
+		move func(iterator.Iterator) []string
+	}{
+		{"forward", func(i iterator.Iterator) (keys []string) {
+			for i.Next() {
+				keys = append(keys, string(i.Key())+"="+string(i.Value()))
+			}
+			return keys
+		}},
+		{"backward", func(i iterator.Iterator) (keys []string) {
+			for ok := i.Last(); ok; ok = i.Prev() {
+				keys = append(keys, string(i.Key()))
+			}
+			return keys
+		}},
+		{"seek", func(i iterator.Iterator) (keys []string) {
+			for ok := i.Seek([]byte("/k/01500")); ok && len(keys) < 5; ok = i.Next() {
+				keys = append(keys, string(i.Key()))
+			}
+			return keys
+		}},
+		{"turn", func(i iterator.Iterator) (keys []string) {
+			for n := 0; n < 3 && i.Next(); n++ {
+				keys = append(keys, string(i.Key()))
+			}
+			for i.Prev() {
+				keys = append(keys, string(i.Key()))
+			}
+			return keys
+		}},
+	}
+	for _, r := range []*util.Range{
+		nil,
+		util.BytesPrefix([]byte("/k/")),
+		{Start: []byte("/k/00999"), Limit: []byte("/k/02001")},
+		{Start: []byte("/k/00999x"), Limit: []byte("/k/01000")},
+	} {
+		for _, m := range moves {
+			mi, li := motr.NewIterator(r, nil), ldb.NewIterator(r, nil)
+			got, want := m.move(mi), m.move(li)
+			if mi.Error() != nil {
+				t.Fatal(mi.Error())
+			}
+			mi.Release()
+			li.Release()
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("moving %s over %v returned %d entries, want %d", m.name, r, len(got), len(want))
+			}
+		}
+	}
+}
+
+// TestMotrCatalogueWriteAtomic checks that a batch failing partway through leaves
+// none of its operations in the Motr catalogue, when it is rolled back straight away
+// and when the rollback fails too and is done the next time the catalogue is opened.
+func TestMotrCatalogueWriteAtomic(t *testing.T) {
+	idx := newTestIndex()
+	motr, err := openMotrCatalogue(mio.MemoryBackend, idx, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := new(leveldb.Batch)
+	before.Put([]byte("/a"), []byte("a1"))
+	before.Put([]byte("/b"), []byte("b1"))
+	if err := motr.Write(before, nil); err != nil {
+		t.Fatal(err)
+	}
+	batch := new(leveldb.Batch)
+	batch.Put([]byte("/a"), []byte("a2"))
+	batch.Delete([]byte("/b"))
+	batch.Put([]byte("/a"), []byte("a3"))
+	batch.Put([]byte("/c"), []byte("c2"))
+	check := func(c Catalogue) {
+		t.Helper()
+		var got []string
+		i := c.NewIterator(nil, nil)
+		for i.Next() {
+			got = append(got, string(i.Key())+"="+string(i.Value()))
+		}
+		i.Release()
+		if fmt.Sprint(got) != "[/a=a1 /b=b1]" {
+			t.Fatalf("catalogue holds %v after a failed batch", got)
+		}
+	}
+
+	// The undo batch and the first two operations are written, then the last put fails.
+	c := motr.(*motrCatalogue)
+	fi, err := mio.NewFaultInjector([]mio.Fault{{Ops: []string{mio.OpPut}, After: 2, Count: 1, Error: "put"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkv := c.mkv
+	c.mkv = fi.Index(mkv)
+	if err := motr.Write(batch, nil); err == nil {
+		t.Fatal("batch was written")
+	}
+	c.mkv = mkv
+	check(motr)
+
+	// Puts fail from the last operation of the batch on, so it can't be rolled back.
+	if err := fi.SetFaults([]mio.Fault{{Ops: []string{mio.OpPut}, After: 3, Error: "put"}}); err != nil {
+		t.Fatal(err)
+	}
+	c.mkv = fi.Index(mkv)
+	if err := motr.Write(batch, nil); err == nil {
+		t.Fatal("batch was written")
+	}
+	c.mkv = mkv
+	if err := motr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if motr, err = openMotrCatalogue(mio.MemoryBackend, idx, false, false); err != nil {
+		t.Fatal(err)
+	}
+	defer motr.Close()
+	check(motr)
+}
+
+// TestBadgerCatalogueBatchTooBig checks that a batch too large for one Badger
+// transaction fails without writing any of it.
+func TestBadgerCatalogueBatchTooBig(t *testing.T) {
+	c, err := OpenCatalogue(Config{CatalogueBackend: BadgerCatalogue, LevelDBPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	batch := new(leveldb.Batch)
+	for i := 0; i < 1<<18; i++ {
+		batch.Put([]byte(fmt.Sprintf("/big/%d", i)), []byte("v"))
+	}
+	if err := c.Write(batch, nil); err != badger.ErrTxnTooBig {
+		t.Fatalf("Write of a batch of %d entries returned %v", batch.Len(), err)
+	}
+	if has, err := c.Has([]byte("/big/0"), nil); err != nil || has {
+		t.Fatalf("Has = %v, %v for the first key of a batch that failed", has, err)
+	}
+}
@@ -0,0 +1,188 @@
+package motrds
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for values stored in Motr.
+const (
+	NoCompression     = "none"
+	ZstdCompression   = "zstd"
+	SnappyCompression = "snappy"
+)
+
+// Values smaller than this are stored verbatim when Config.CompressionMinSize is not set.
+const DefaultCompressionMinSize = 512
+
+// Values that aren't stored verbatim are wrapped in an envelope whose header lets
+// them be told apart from verbatim values, which are flagged in the catalogue record:
+//
+//	magic (2 bytes) | codec (1 byte) | logical value size (uvarint) | payload
+//
+// Encrypted payloads are described in crypt.go.
+var envelopeMagic = []byte{0xf3, 'm'}
+
+const (
+	codecNone   byte = 0
+	codecZstd   byte = 1
+	codecSnappy byte = 2
+)
+
+// Catalogue record flag set when the value in Motr is wrapped in an envelope.
+const recordEnveloped byte = 1 << 0
+
+var errBadEnvelope = fmt.Errorf("%w: malformed envelope", ErrCorrupt)
+
+// Largest value size an envelope header may give. The size read from a corrupt
+// header can be anything, so it is checked before any buffer is allocated for it.
+const maxValueSize = 1 << 30
+
+// Compressed values are decoded into a buffer of the size in their header when that
+// is at most this many times the size of the compressed payload, and into a buffer
+// grown as needed otherwise.
+const maxPreallocRatio = 16
+
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+
+// The zstd encoder and decoder are safe for concurrent use with EncodeAll and
+// DecodeAll so one of each is shared by all datastores.
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxValueSize))
+	})
+}
+
+func compressionCodec(compression string) (byte, error) {
+	switch compression {
+	case "", NoCompression:
+		return codecNone, nil
+	case ZstdCompression:
+		return codecZstd, nil
+	case SnappyCompression:
+		return codecSnappy, nil
+	default:
+		return codecNone, fmt.Errorf("motrds: unknown compression %q", compression)
+	}
+}
+
+// encodeValue returns the bytes to store in Motr for a value and the catalogue record
+// flags describing them. Values are compressed when they are at least the minimum
+// compression size and compressing them saves space, and always encrypted when the
+// datastore has encryption keys.
+func (d *MotrDatastore) encodeValue(key ds.Key, value []byte) ([]byte, byte) {
+	encrypt := d.keyring != nil && d.keyring.cipher != cipherNone
+	codec := codecNone
+	payload := value
+	if d.codec != codecNone && len(value) >= d.CompressionMinSize {
+		var compressed []byte
+		switch d.codec {
+		case codecZstd:
+			initZstd()
+			compressed = zstdEncoder.EncodeAll(value, nil)
+		case codecSnappy:
+			compressed = snappy.Encode(nil, value)
+		}
+		if len(compressed)+len(envelopeMagic)+1+binary.MaxVarintLen64 < len(value) {
+			codec, payload = d.codec, compressed
+		}
+	}
+	if codec == codecNone && !encrypt {
+		return value, 0
+	}
+	header := make([]byte, len(envelopeMagic)+1+binary.MaxVarintLen64)
+	n := copy(header, envelopeMagic)
+	header[n] = codec
+	if encrypt {
+		header[n] |= d.keyring.cipher << 4
+	}
+	n += 1 + binary.PutUvarint(header[n+1:], uint64(len(value)))
+	header = header[:n]
+	if encrypt {
+		return append(header, d.keyring.seal(payload, additionalData(key, header))...), recordEnveloped
+	}
+	return append(header, payload...), recordEnveloped
+}
+
+// decodeValue returns the value stored in Motr as described by its catalogue record.
+// Envelopes that can't be decoded return ErrCorrupt.
+func (d *MotrDatastore) decodeValue(key ds.Key, rec record, stored []byte) ([]byte, error) {
+	if rec.Flags&recordEnveloped == 0 {
+		return stored, nil
+	}
+	h, eh := parseEnvelope(stored)
+	if eh != nil {
+		return nil, eh
+	} else if h.size > maxValueSize {
+		return nil, fmt.Errorf("%w at key %s: envelope gives a size of %d bytes", ErrCorrupt, key, h.size)
+	}
+	payload := stored[h.headerLen:]
+	if h.cipher != cipherNone {
+		if d.keyring == nil {
+			return nil, fmt.Errorf("motrds: value at key %s is encrypted but no encryption keys are configured", key)
+		}
+		var eopen error
+		if payload, _, eopen = d.keyring.open(h.cipher, payload, additionalData(key, stored[:h.headerLen])); eopen != nil {
+			return nil, eopen
+		}
+	}
+	var value []byte
+	var err error
+	switch h.codec {
+	case codecNone:
+		value = payload
+	case codecZstd:
+		initZstd()
+		size := h.size
+		if size > maxPreallocRatio*len(payload) {
+			size = maxPreallocRatio * len(payload)
+		}
+		value, err = zstdDecoder.DecodeAll(payload, make([]byte, 0, size))
+	case codecSnappy:
+		if size, esize := snappy.DecodedLen(payload); esize != nil || size != h.size {
+			return nil, fmt.Errorf("%w at key %s: snappy payload doesn't decode to %d bytes", ErrCorrupt, key, h.size)
+		}
+		value, err = snappy.Decode(make([]byte, h.size), payload)
+	default:
+		return nil, fmt.Errorf("motrds: unknown value codec %d", h.codec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w at key %s: %v", ErrCorrupt, key, err)
+	} else if len(value) != h.size {
+		return nil, fmt.Errorf("%w at key %s: decoded value is %d bytes, expected %d", ErrCorrupt, key, len(value), h.size)
+	}
+	return value, nil
+}
+
+type envelopeHeader struct {
+	codec     byte
+	cipher    byte
+	size      int
+	headerLen int
+}
+
+func parseEnvelope(stored []byte) (envelopeHeader, error) {
+	if len(stored) < len(envelopeMagic)+2 || stored[0] != envelopeMagic[0] || stored[1] != envelopeMagic[1] {
+		return envelopeHeader{}, errBadEnvelope
+	}
+	b := stored[len(envelopeMagic)]
+	size, n := binary.Uvarint(stored[len(envelopeMagic)+1:])
+	if n <= 0 {
+		return envelopeHeader{}, errBadEnvelope
+	}
+	return envelopeHeader{codec: b & 0x0f, cipher: b >> 4, size: int(size), headerLen: len(envelopeMagic) + 1 + n}, nil
+}
+
+// Encrypted values are bound to their datastore key and envelope header so they can't
+// be swapped between keys or have their header altered.
+func additionalData(key ds.Key, header []byte) []byte {
+	return append(key.Bytes(), header...)
+}
@@ -0,0 +1,110 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// TestCompression checks that values are stored compressed with each codec when
+// they are large enough and compress, and stored verbatim otherwise.
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	compressible := bytes.Repeat([]byte("go-ds-motr "), 200)
+	random := make([]byte, 2048)
+	rand.Read(random)
+	for _, c := range []struct {
+		compression string
+		codec       byte
+	}{
+		{ZstdCompression, codecZstd},
+		{SnappyCompression, codecSnappy},
+	} {
+		t.Run(c.compression, func(t *testing.T) {
+			conf := testConfig(t)
+			conf.Compression = c.compression
+			d := openTestDatastore(t, conf)
+			defer d.Close()
+			for _, v := range []struct {
+				key        ds.Key
+				value      []byte
+				compressed bool
+			}{
+				{ds.NewKey("/compressible"), compressible, true},
+				{ds.NewKey("/small"), compressible[:DefaultCompressionMinSize-1], false},
+				{ds.NewKey("/random"), random, false},
+			} {
+				if err := d.Put(ctx, v.key, v.value); err != nil {
+					t.Fatal(err)
+				}
+				stored, err := d.Index.Get(d.getOID(v.key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v.compressed {
+					if h, err := parseEnvelope(stored); err != nil || h.codec != c.codec || h.size != len(v.value) || len(stored) >= len(v.value) {
+						t.Fatalf("%s stored as %d bytes with header %+v, %v", v.key, len(stored), h, err)
+					}
+				} else if !bytes.Equal(stored, v.value) {
+					t.Fatalf("%s not stored verbatim", v.key)
+				}
+				if got, err := d.Get(ctx, v.key); err != nil || !bytes.Equal(got, v.value) {
+					t.Fatalf("Get(%s) returned %d bytes, %v", v.key, len(got), err)
+				}
+			}
+		})
+	}
+}
+
+func testEnvelope(codec byte, size uint64, payload []byte) []byte {
+	e := append(append([]byte{}, envelopeMagic...), codec)
+	e = append(e, make([]byte, binary.MaxVarintLen64)...)
+	e = e[:len(envelopeMagic)+1+binary.PutUvarint(e[len(envelopeMagic)+1:], size)]
+	return append(e, payload...)
+}
+
+// TestDecodeCorrupt checks that truncated and garbled envelopes, and envelopes giving
+// sizes their payloads don't decode to, return ErrCorrupt.
+func TestDecodeCorrupt(t *testing.T) {
+	d := testDatastore(t)
+	value := bytes.Repeat([]byte("go-ds-motr "), 200)
+	enc, _ := zstd.NewWriter(nil)
+	zstdPayload := enc.EncodeAll(value, nil)
+	enc.Close()
+	snappyPayload := snappy.Encode(nil, value)
+	key := ds.NewKey("/corrupt")
+	rec := record{Flags: recordEnveloped}
+	for _, c := range []struct {
+		name   string
+		stored []byte
+	}{
+		{"empty", nil},
+		{"magic only", envelopeMagic},
+		{"garbled magic", append([]byte{0xf3, 'x'}, testEnvelope(codecNone, 1, []byte("v"))[2:]...)},
+		{"truncated size", append(append([]byte{}, envelopeMagic...), codecZstd, 0x80)},
+		{"huge size", testEnvelope(codecZstd, 1<<40, zstdPayload)},
+		{"zstd size too small", testEnvelope(codecZstd, uint64(len(value)-1), zstdPayload)},
+		{"zstd size too large", testEnvelope(codecZstd, maxValueSize, zstdPayload)},
+		{"zstd truncated", testEnvelope(codecZstd, uint64(len(value)), zstdPayload[:len(zstdPayload)/2])},
+		{"zstd garbled", testEnvelope(codecZstd, uint64(len(value)), bytes.Repeat([]byte{0xa5}, 64))},
+		{"snappy wrong size", testEnvelope(codecSnappy, uint64(len(value)+1), snappyPayload)},
+		{"snappy truncated", testEnvelope(codecSnappy, uint64(len(value)), snappyPayload[:len(snappyPayload)/2])},
+		{"verbatim wrong size", testEnvelope(codecNone, 2, []byte("v"))},
+	} {
+		if v, err := d.decodeValue(key, rec, c.stored); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: decodeValue returned %d bytes, %v", c.name, len(v), err)
+		}
+	}
+	for _, stored := range [][]byte{testEnvelope(codecZstd, uint64(len(value)), zstdPayload), testEnvelope(codecSnappy, uint64(len(value)), snappyPayload)} {
+		if v, err := d.decodeValue(key, rec, stored); err != nil || !bytes.Equal(v, value) {
+			t.Fatalf("decodeValue returned %d bytes, %v for a valid envelope", len(v), err)
+		}
+	}
+}
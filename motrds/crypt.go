@@ -0,0 +1,229 @@
+package motrds
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Authenticated encryption algorithms for values stored in Motr.
+const (
+	NoEncryption                = "none"
+	AESGCMEncryption            = "aes-gcm"
+	XChaCha20Poly1305Encryption = "xchacha20-poly1305"
+)
+
+// The cipher of an encrypted value is stored in the high nibble of the envelope codec
+// byte, followed after the value size by the id of the key it was encrypted with and
+// the nonce:
+//
+//	... | key id length (1 byte) | key id | nonce | ciphertext
+const (
+	cipherNone      byte = 0
+	cipherAESGCM    byte = 1
+	cipherXChaCha20 byte = 2
+)
+
+const maxKeyIDLen = 32
+
+// keyring holds the encryption keys of a datastore by id. Values are encrypted with
+// the active key and can be decrypted with any key in the keyring, so keys can be
+// rotated by adding a new key and re-encrypting the datastore.
+type keyring struct {
+	cipher byte
+	active string
+	aeads  map[byte]map[string]cipher.AEAD
+}
+
+func encryptionCipher(encryption string) (byte, error) {
+	switch encryption {
+	case "", NoEncryption:
+		return cipherNone, nil
+	case AESGCMEncryption:
+		return cipherAESGCM, nil
+	case XChaCha20Poly1305Encryption:
+		return cipherXChaCha20, nil
+	default:
+		return cipherNone, fmt.Errorf("motrds: unknown encryption %q", encryption)
+	}
+}
+
+// loadKeyring reads encryption keys from the configured key file or environment
+// variable. Keys are written as <key id>:<64 hex digits>, separated by newlines or
+// commas, and the last key is the active key. Returns nil when no keys are configured.
+func loadKeyring(conf Config) (*keyring, error) {
+	c, ecipher := encryptionCipher(conf.Encryption)
+	if ecipher != nil {
+		return nil, ecipher
+	}
+	var spec string
+	switch {
+	case conf.EncryptionKeyFile != "":
+		b, eread := os.ReadFile(conf.EncryptionKeyFile)
+		if eread != nil {
+			return nil, fmt.Errorf("motrds: could not read encryption key file: %v", eread)
+		}
+		spec = string(b)
+	case conf.EncryptionKeyEnv != "":
+		var ok bool
+		if spec, ok = os.LookupEnv(conf.EncryptionKeyEnv); !ok {
+			return nil, fmt.Errorf("motrds: encryption key environment variable %s is not set", conf.EncryptionKeyEnv)
+		}
+	case c != cipherNone:
+		return nil, fmt.Errorf("motrds: %s encryption needs an encryption key file or environment variable", conf.Encryption)
+	default:
+		return nil, nil
+	}
+	kr := &keyring{cipher: c, aeads: map[byte]map[string]cipher.AEAD{cipherAESGCM: {}, cipherXChaCha20: {}}}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == '\n' || r == '\r' || r == ',' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > maxKeyIDLen {
+			return nil, fmt.Errorf("motrds: encryption keys must be written as <key id>:<hex key> with ids of at most %d characters", maxKeyIDLen)
+		}
+		id := parts[0]
+		key, ehex := hex.DecodeString(strings.TrimSpace(parts[1]))
+		if ehex != nil || len(key) != 32 {
+			return nil, fmt.Errorf("motrds: encryption key %s is not 32 bytes of hex", id)
+		}
+		block, eaes := aes.NewCipher(cipherKey(key, cipherAESGCM))
+		if eaes != nil {
+			return nil, eaes
+		}
+		if kr.aeads[cipherAESGCM][id], eaes = cipher.NewGCM(block); eaes != nil {
+			return nil, eaes
+		}
+		var exc error
+		if kr.aeads[cipherXChaCha20][id], exc = chacha20poly1305.NewX(cipherKey(key, cipherXChaCha20)); exc != nil {
+			return nil, exc
+		}
+		kr.active = id
+	}
+	if kr.active == "" {
+		return nil, fmt.Errorf("motrds: no encryption keys found")
+	}
+	return kr, nil
+}
+
+// cipherKey derives the key used with a cipher from a configured key, so the same
+// key material is never used with two ciphers.
+func cipherKey(key []byte, c byte) []byte {
+	derived := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, append([]byte("go-ds-motr cipher "), c)), derived); err != nil {
+		panic(fmt.Sprintf("motrds: could not derive key: %v", err))
+	}
+	return derived
+}
+
+// seal encrypts a payload with the active key, returning the key id, nonce and
+// ciphertext section of the envelope.
+func (kr *keyring) seal(payload []byte, additional []byte) []byte {
+	aead := kr.aeads[kr.cipher][kr.active]
+	out := make([]byte, 1+len(kr.active)+aead.NonceSize(), 1+len(kr.active)+aead.NonceSize()+len(payload)+aead.Overhead())
+	out[0] = byte(len(kr.active))
+	copy(out[1:], kr.active)
+	nonce := out[1+len(kr.active):]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("motrds: could not generate nonce: %v", err))
+	}
+	return aead.Seal(out, nonce, payload, additional)
+}
+
+// open decrypts the key id, nonce and ciphertext section of an envelope.
+func (kr *keyring) open(c byte, sealed []byte, additional []byte) ([]byte, string, error) {
+	if len(sealed) < 1 || len(sealed) < 1+int(sealed[0]) {
+		return nil, "", errBadEnvelope
+	}
+	id := string(sealed[1 : 1+sealed[0]])
+	aead, ok := kr.aeads[c][id]
+	if !ok {
+		return nil, id, fmt.Errorf("motrds: value is encrypted with unknown key %s", id)
+	}
+	sealed = sealed[1+len(id):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, id, errBadEnvelope
+	}
+	payload, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+	return payload, id, err
+}
+
+// Reencrypt rewrites every value that isn't encrypted with the active key and cipher,
+// which encrypts values stored before encryption was enabled and completes a key
+// rotation once a new key has been added to the keyring.
+func (d *MotrDatastore) Reencrypt() error {
+	if d.keyring == nil {
+		return fmt.Errorf("motrds: no encryption keys are configured")
+	}
+	log.Infof("Re-encrypting values in Motr index %s with key %s using %s...", d.Idx, d.keyring.active, d.Encryption)
+	i := d.Catalogue.NewIterator(util.BytesPrefix([]byte("/")), nil)
+	defer i.Release()
+	rewritten, total := 0, 0
+	for i.Next() {
+		total++
+		key := ds.RawKey(string(i.Key()))
+		if done, err := d.reencryptKey(key); err != nil {
+			log.Errorf("Error re-encrypting value at key %s: %v.", key, err)
+			return err
+		} else if done {
+			rewritten++
+		}
+		if total%1000 == 0 {
+			log.Infof("Checked %v values, re-encrypted %v...", total, rewritten)
+		}
+	}
+	if eit := i.Error(); eit != nil {
+		return eit
+	}
+	log.Infof("Checked %v values, re-encrypted %v.", total, rewritten)
+	return nil
+}
+
+func (d *MotrDatastore) reencryptKey(key ds.Key) (bool, error) {
+	d.locks.Lock(key)
+	defer d.locks.Unlock(key)
+	rec, erec := d.getRecord(key)
+	if erec == ds.ErrNotFound {
+		return false, nil
+	} else if erec != nil {
+		return false, erec
+	}
+	oid := d.getOID(key)
+	stored, eget := d.Index.Get(oid)
+	if eget != nil {
+		return false, eget
+	}
+	if rec.Flags&recordEnveloped != 0 {
+		if h, eh := parseEnvelope(stored); eh == nil && h.cipher == d.keyring.cipher {
+			sealed := stored[h.headerLen:]
+			if len(sealed) > 0 && len(sealed) >= 1+int(sealed[0]) && string(sealed[1:1+sealed[0]]) == d.keyring.active {
+				return false, nil
+			}
+		}
+	}
+	value, edec := d.decodeValue(key, rec, stored)
+	if edec != nil {
+		return false, edec
+	}
+	stored, flags := d.encodeValue(key, value)
+	if eput := d.Index.Put(oid, stored, true); eput != nil {
+		return false, eput
+	}
+	nrec := newRecord(value)
+	nrec.Flags = flags
+	nrec.Expires = rec.Expires
+	return true, d.Catalogue.Put(key.Bytes(), nrec.encode(), nil)
+}
@@ -0,0 +1,161 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	testKey1 = "k1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "k2:202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+)
+
+// storedKeyID returns the cipher and key id of the value stored in Motr for key.
+func storedKeyID(t *testing.T, d *MotrDatastore, key ds.Key) (byte, string) {
+	t.Helper()
+	stored, err := d.Index.Get(d.getOID(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseEnvelope(stored)
+	if err != nil {
+		return cipherNone, ""
+	}
+	sealed := stored[h.headerLen:]
+	return h.cipher, string(sealed[1 : 1+sealed[0]])
+}
+
+// TestEncryption checks that values are encrypted with each cipher, that values
+// encrypted with one cipher can be read after switching to the other, and that the
+// ciphers don't use the same key.
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("MOTRDS_TEST_KEYS", testKey1)
+	conf := testConfig(t)
+	conf.EncryptionKeyEnv = "MOTRDS_TEST_KEYS"
+	value := []byte("a value that must not be stored in plain text")
+	for _, c := range []struct {
+		encryption string
+		cipher     byte
+		key        ds.Key
+	}{
+		{AESGCMEncryption, cipherAESGCM, ds.NewKey("/aes")},
+		{XChaCha20Poly1305Encryption, cipherXChaCha20, ds.NewKey("/xchacha")},
+	} {
+		conf.Encryption = c.encryption
+		d := openTestDatastore(t, conf)
+		if err := d.Put(ctx, c.key, value); err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := d.Index.Get(d.getOID(c.key)); bytes.Contains(stored, value) {
+			t.Fatalf("%s stored the value in plain text", c.encryption)
+		}
+		if cipher, id := storedKeyID(t, d, c.key); cipher != c.cipher || id != "k1" {
+			t.Fatalf("%s stored a value with cipher %d and key %q", c.encryption, cipher, id)
+		}
+		for _, key := range []ds.Key{ds.NewKey("/aes"), ds.NewKey("/xchacha")} {
+			if has, _ := d.Has(ctx, key); !has {
+				continue
+			}
+			if v, err := d.Get(ctx, key); err != nil || !bytes.Equal(v, value) {
+				t.Fatalf("Get(%s) with %s = %q, %v", key, c.encryption, v, err)
+			}
+		}
+		d.Close()
+	}
+
+	if bytes.Equal(cipherKey([]byte("key"), cipherAESGCM), cipherKey([]byte("key"), cipherXChaCha20)) {
+		t.Fatal("the ciphers use the same key")
+	}
+}
+
+// TestKeyRotation checks that values stay readable while a new key is added, that
+// Reencrypt moves every value to the new key, including values stored before
+// encryption was enabled, and that values encrypted with an unknown key are refused.
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	plain, old := ds.NewKey("/plain"), ds.NewKey("/old")
+	if err := d.Put(ctx, plain, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	conf.Encryption, conf.EncryptionKeyEnv = AESGCMEncryption, "MOTRDS_TEST_KEYS"
+	t.Setenv("MOTRDS_TEST_KEYS", testKey1)
+	d = openTestDatastore(t, conf)
+	if err := d.Put(ctx, old, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	t.Setenv("MOTRDS_TEST_KEYS", testKey1+","+testKey2)
+	d = openTestDatastore(t, conf)
+	if v, err := d.Get(ctx, old); err != nil || string(v) != "old" {
+		t.Fatalf("Get = %q, %v after adding a key", v, err)
+	}
+	if err := d.Reencrypt(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []ds.Key{plain, old} {
+		if _, id := storedKeyID(t, d, key); id != "k2" {
+			t.Fatalf("%s encrypted with key %q after Reencrypt", key, id)
+		}
+	}
+	d.Close()
+
+	t.Setenv("MOTRDS_TEST_KEYS", testKey2)
+	d = openTestDatastore(t, conf)
+	if v, err := d.Get(ctx, old); err != nil || string(v) != "old" {
+		t.Fatalf("Get = %q, %v after removing the old key", v, err)
+	}
+	d.Close()
+
+	t.Setenv("MOTRDS_TEST_KEYS", testKey1)
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	if _, err := d.Get(ctx, old); err == nil || !strings.Contains(err.Error(), "unknown key k2") {
+		t.Fatalf("Get returned %v for a value encrypted with a key that isn't configured", err)
+	}
+}
+
+// TestLoadKeyring checks the parsing of encryption key files and variables.
+func TestLoadKeyring(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(file, []byte("# keys\n"+testKey1+"\n\n"+testKey2+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if kr, err := loadKeyring(Config{Encryption: XChaCha20Poly1305Encryption, EncryptionKeyFile: file}); err != nil || kr.active != "k2" || kr.cipher != cipherXChaCha20 {
+		t.Fatalf("loadKeyring = %+v, %v", kr, err)
+	}
+	if kr, err := loadKeyring(Config{}); err != nil || kr != nil {
+		t.Fatalf("loadKeyring = %+v, %v without encryption", kr, err)
+	}
+	for _, c := range []struct {
+		conf Config
+		keys string
+		err  string
+	}{
+		{Config{Encryption: AESGCMEncryption}, "", "needs an encryption key file"},
+		{Config{Encryption: "rot13", EncryptionKeyEnv: "MOTRDS_TEST_KEYS"}, testKey1, "unknown encryption"},
+		{Config{Encryption: AESGCMEncryption, EncryptionKeyFile: file + ".missing"}, "", "could not read encryption key file"},
+		{Config{Encryption: AESGCMEncryption, EncryptionKeyEnv: "MOTRDS_TEST_UNSET"}, "", "is not set"},
+		{Config{Encryption: AESGCMEncryption, EncryptionKeyEnv: "MOTRDS_TEST_KEYS"}, "# none", "no encryption keys found"},
+		{Config{Encryption: AESGCMEncryption, EncryptionKeyEnv: "MOTRDS_TEST_KEYS"}, "000102", "must be written as"},
+		{Config{Encryption: AESGCMEncryption, EncryptionKeyEnv: "MOTRDS_TEST_KEYS"}, strings.Repeat("k", maxKeyIDLen+1) + ":00", "must be written as"},
+		{Config{Encryption: AESGCMEncryption, EncryptionKeyEnv: "MOTRDS_TEST_KEYS"}, "k1:0001", "is not 32 bytes of hex"},
+		{Config{Encryption: AESGCMEncryption, EncryptionKeyEnv: "MOTRDS_TEST_KEYS"}, "k1:" + strings.Repeat("zz", 32), "is not 32 bytes of hex"},
+	} {
+		t.Setenv("MOTRDS_TEST_KEYS", c.keys)
+		if _, err := loadKeyring(c.conf); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("loadKeyring(%+v) with keys %q returned %v, want %q", c.conf, c.keys, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package motrds
+
+import (
+	query "github.com/ipfs/go-datastore/query"
+)
+
+// splitFilters separates the filters of a query that only look at entry keys from
+// those that need the object value.
+func splitFilters(filters []query.Filter) (keyFilters []query.Filter, valueFilters []query.Filter) {
+	for _, f := range filters {
+		switch f.(type) {
+		case query.FilterKeyPrefix, *query.FilterKeyPrefix, query.FilterKeyCompare, *query.FilterKeyCompare:
+			keyFilters = append(keyFilters, f)
+		default:
+			valueFilters = append(valueFilters, f)
+		}
+	}
+	return keyFilters, valueFilters
+}
+
+// matchKey reports whether a catalogue key passes all the key filters.
+func matchKey(keyFilters []query.Filter, key []byte) bool {
+	e := query.Entry{Key: string(key)}
+	for _, f := range keyFilters {
+		if !f.Filter(e) {
+			return false
+		}
+	}
+	return true
+}
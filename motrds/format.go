@@ -0,0 +1,58 @@
+package motrds
+
+import (
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Format of the records go-ds-motr writes to a Motr index. Indexes written with a
+// different format are refused.
+const IndexFormat byte = 1
+
+// Key of the Motr index record holding the index format.
+var indexFormatKey = []byte("\x00motrds/format")
+
+// checkIndexFormat reads the format recorded in the Motr index, recording it in
+// indexes that have none yet unless the datastore is read-only. New indexes must start with an empty catalogue, so a
+// catalogue left over from another index isn't used with a new one.
+func (d *MotrDatastore) checkIndexFormat() error {
+	has, ehas := d.Index.Has(indexFormatKey)
+	if ehas != nil {
+		if !d.CreateIndex {
+			return fmt.Errorf("motrds: could not read Motr index %s, set createIndex to create it if it doesn't exist: %v", d.Idx, ehas)
+		}
+		return ehas
+	}
+	if has {
+		v, eget := d.Index.Get(indexFormatKey)
+		if eget != nil {
+			return eget
+		} else if len(v) != 1 || v[0] != IndexFormat {
+			return fmt.Errorf("motrds: Motr index %s has format %x, this version of go-ds-motr only supports format %d", d.Idx, v, IndexFormat)
+		}
+		return nil
+	}
+	keys, _, enext := d.Index.Next(nil, 1)
+	if enext != nil {
+		return enext
+	}
+	if len(keys) == 0 {
+		i := d.Catalogue.NewIterator(util.BytesPrefix([]byte("/")), nil)
+		catalogued := i.First()
+		i.Release()
+		if catalogued {
+			return fmt.Errorf("motrds: Motr index %s is new but the catalogue already has keys, remove the catalogue or use the index it was created for", d.Idx)
+		}
+		log.Infof("Initializing new Motr index %s.", d.Idx)
+	}
+	if d.ReadOnly {
+		return nil
+	}
+	if eput := d.Index.Put(indexFormatKey, []byte{IndexFormat}, true); eput != nil {
+		log.Errorf("Error recording format of Motr index %s: %v.", d.Idx, eput)
+		return eput
+	}
+	log.Infof("Recorded format %d in Motr index %s.", IndexFormat, d.Idx)
+	return nil
+}
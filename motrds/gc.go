@@ -0,0 +1,135 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var _ ds.GCDatastore = (*MotrDatastore)(nil)
+
+// Number of Motr keys read from the index at a time when collecting orphans.
+const gcBatchSize = 1000
+
+// Prefix of Motr keys go-ds-motr uses for its own records, which never belong to a
+// datastore key.
+var reservedMotrPrefix = []byte("\x00motrds/")
+
+// liveSet records the Motr keys written while garbage is being collected, so records
+// put after the catalogue snapshot was taken aren't mistaken for orphans.
+type liveSet struct {
+	mu     sync.Mutex
+	scheme string
+	oids   map[string]struct{}
+}
+
+func (s *liveSet) add(oid []byte) {
+	s.mu.Lock()
+	s.oids[string(oid)] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *liveSet) has(oid []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.oids[string(oid)]
+	return ok
+}
+
+// CollectGarbage compacts the catalogue and deletes Motr records that no
+// catalogue entry maps to, such as records left behind by a put or delete that
+// failed halfway or by an interrupted key scheme migration.
+func (d *MotrDatastore) CollectGarbage(ctx context.Context) error {
+	log.Infof("Collecting garbage in Motr datastore for index %s...", d.Idx)
+	if ecompact := d.Catalogue.CompactRange(util.Range{}); ecompact != nil {
+		log.Errorf("Error compacting catalogue: %v.", ecompact)
+		return ecompact
+	}
+	d.locks.LockAll()
+	live := &liveSet{scheme: d.keys.Scheme(), oids: make(map[string]struct{})}
+	d.live = live
+	snap, esnap := d.Catalogue.GetSnapshot()
+	d.locks.UnlockAll()
+	defer func() {
+		d.locks.LockAll()
+		d.live = nil
+		d.locks.UnlockAll()
+	}()
+	if esnap != nil {
+		return esnap
+	}
+	catalogued := make(map[string]struct{})
+	i := snap.NewIterator(util.BytesPrefix([]byte("/")), nil)
+	for i.Next() {
+		catalogued[string(d.getOID(ds.RawKey(string(i.Key()))))] = struct{}{}
+	}
+	eit := i.Error()
+	i.Release()
+	snap.Release()
+	if eit != nil {
+		log.Errorf("Error iterating catalogue: %v.", eit)
+		return eit
+	}
+	log.Infof("Catalogue maps to %v Motr keys. Looking for orphaned records in Motr index %s...", len(catalogued), d.Idx)
+
+	var total, removed int
+	var last []byte
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		keys, _, enext := d.Index.Next(last, gcBatchSize)
+		if enext != nil {
+			log.Errorf("Error iterating Motr index %s: %v.", d.Idx, enext)
+			return enext
+		}
+		var orphans [][]byte
+		for _, k := range keys {
+			if _, ok := catalogued[string(k)]; !ok && !bytes.HasPrefix(k, reservedMotrPrefix) {
+				orphans = append(orphans, k)
+			}
+		}
+		if len(orphans) > 0 {
+			n, edel := d.deleteOrphans(live, orphans)
+			removed += n
+			if edel != nil {
+				return edel
+			}
+		}
+		total += len(keys)
+		if len(keys) < gcBatchSize {
+			break
+		}
+		last = keys[len(keys)-1]
+		log.Infof("Checked %v Motr records, removed %v orphans...", total, removed)
+	}
+	log.Infof("Checked %v Motr records, removed %v orphans.", total, removed)
+	return nil
+}
+
+// deleteOrphans deletes Motr records that weren't put since garbage collection
+// started. Puts are excluded while it runs.
+func (d *MotrDatastore) deleteOrphans(live *liveSet, oids [][]byte) (int, error) {
+	d.locks.LockAll()
+	defer d.locks.UnlockAll()
+	if d.keys.Scheme() != live.scheme {
+		return 0, fmt.Errorf("motrds: key scheme of index %s changed to %s while collecting garbage", d.Idx, d.keys.Scheme())
+	}
+	n := 0
+	for _, oid := range oids {
+		if live.has(oid) {
+			continue
+		}
+		log.Debugf("Deleting orphaned record with OID %s from Motr index %s.", getOIDstr(oid), d.Idx)
+		if edel := d.Index.Delete(oid); edel != nil {
+			log.Errorf("Error deleting orphaned record with OID %s from Motr index %s: %v.", getOIDstr(oid), d.Idx, edel)
+			return n, edel
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,78 @@
+package motrds
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Number of locks datastore keys are spread over.
+const lockStripes = 256
+
+// keyLocks serialises operations on the same datastore key without a global lock:
+// each key hashes to one of a fixed set of read-write locks, so reads of a key run
+// concurrently, writes of a key exclude everything else on that key, and operations
+// on keys in different stripes never wait for each other. Operations on the whole
+// datastore take every stripe.
+type keyLocks struct {
+	stripes [lockStripes]sync.RWMutex
+}
+
+func stripeOf(key ds.Key) int {
+	h := fnv.New32a()
+	h.Write(key.Bytes())
+	return int(h.Sum32() % lockStripes)
+}
+
+func (l *keyLocks) RLock(key ds.Key) {
+	l.stripes[stripeOf(key)].RLock()
+}
+
+func (l *keyLocks) RUnlock(key ds.Key) {
+	l.stripes[stripeOf(key)].RUnlock()
+}
+
+func (l *keyLocks) Lock(key ds.Key) {
+	l.stripes[stripeOf(key)].Lock()
+}
+
+func (l *keyLocks) Unlock(key ds.Key) {
+	l.stripes[stripeOf(key)].Unlock()
+}
+
+// LockKeys takes the write locks of several keys, in stripe order so concurrent
+// callers can't deadlock, and returns the function releasing them.
+func (l *keyLocks) LockKeys(keys []ds.Key) func() {
+	seen := make(map[int]bool, len(keys))
+	var stripes []int
+	for _, k := range keys {
+		if s := stripeOf(k); !seen[s] {
+			seen[s] = true
+			stripes = append(stripes, s)
+		}
+	}
+	sort.Ints(stripes)
+	for _, s := range stripes {
+		l.stripes[s].Lock()
+	}
+	return func() {
+		for _, s := range stripes {
+			l.stripes[s].Unlock()
+		}
+	}
+}
+
+// LockAll takes the write lock of every stripe, excluding all other operations.
+func (l *keyLocks) LockAll() {
+	for s := range l.stripes {
+		l.stripes[s].Lock()
+	}
+}
+
+func (l *keyLocks) UnlockAll() {
+	for s := range l.stripes {
+		l.stripes[s].Unlock()
+	}
+}
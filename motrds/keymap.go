@@ -0,0 +1,277 @@
+package motrds
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Schemes for deriving the key of the Motr index record holding the value of a
+// datastore key.
+const (
+	// Datastore key followed by the FNV-1 128-bit hash of an empty input, which is
+	// how Motr keys were derived before key schemes could be selected.
+	LegacyKeyScheme = "legacy"
+	// Datastore key bytes unchanged.
+	RawKeyScheme = "raw"
+	// FNV-1a 128-bit hash of the datastore key.
+	FNV1a128KeyScheme = "fnv1a-128"
+	// First 128 bits of the SHA-256 hash of the datastore key.
+	SHA256KeyScheme = "sha256-128"
+	// Multihash digest of the block for keys in the blocks namespace, FNV-1a 128-bit
+	// hash of the datastore key for everything else, including blocks with identity
+	// multihashes or digests shorter than minDigestKeyLen. The blocks namespace is
+	// /blocks unless the scheme is written as multihash:<namespace>, e.g. multihash:/
+	// for a datastore mounted at /blocks.
+	MultihashKeyScheme = "multihash"
+)
+
+// Namespace of IPFS blocks in a datastore that isn't mounted at /blocks.
+var DefaultBlocksNamespace = ds.NewKey("/blocks")
+
+// Key scheme used for new indexes when none is configured.
+const DefaultKeyScheme = FNV1a128KeyScheme
+
+// Supported key schemes.
+var KeySchemes = []string{LegacyKeyScheme, RawKeyScheme, FNV1a128KeyScheme, SHA256KeyScheme, MultihashKeyScheme}
+
+// Key of the Motr index record holding the key scheme the index was written with.
+var keySchemeKey = []byte("\x00motrds/key-scheme")
+
+// KeyMapper derives Motr index keys from datastore keys. Implementations must be safe
+// for concurrent use.
+type KeyMapper interface {
+	Scheme() string
+	MotrKey(key ds.Key) []byte
+}
+
+type legacyKeys struct{}
+type rawKeys struct{}
+type fnvKeys struct{}
+type sha256Keys struct{}
+type multihashKeys struct {
+	blocks ds.Key
+}
+
+func NewKeyMapper(scheme string) (KeyMapper, error) {
+	if strings.HasPrefix(scheme, MultihashKeyScheme+":") {
+		return NewMultihashKeyMapper(ds.NewKey(strings.TrimPrefix(scheme, MultihashKeyScheme+":"))), nil
+	}
+	switch scheme {
+	case LegacyKeyScheme:
+		return legacyKeys{}, nil
+	case RawKeyScheme:
+		return rawKeys{}, nil
+	case FNV1a128KeyScheme:
+		return fnvKeys{}, nil
+	case SHA256KeyScheme:
+		return sha256Keys{}, nil
+	case MultihashKeyScheme:
+		return NewMultihashKeyMapper(DefaultBlocksNamespace), nil
+	default:
+		return nil, fmt.Errorf("motrds: unknown key scheme %q", scheme)
+	}
+}
+
+func (legacyKeys) Scheme() string { return LegacyKeyScheme }
+
+func (legacyKeys) MotrKey(key ds.Key) []byte {
+	return fnv.New128().Sum(key.Bytes())
+}
+
+func (rawKeys) Scheme() string { return RawKeyScheme }
+
+func (rawKeys) MotrKey(key ds.Key) []byte {
+	return key.Bytes()
+}
+
+func (fnvKeys) Scheme() string { return FNV1a128KeyScheme }
+
+func (fnvKeys) MotrKey(key ds.Key) []byte {
+	h := fnv.New128a()
+	h.Write(key.Bytes())
+	return h.Sum(nil)
+}
+
+func (sha256Keys) Scheme() string { return SHA256KeyScheme }
+
+func (sha256Keys) MotrKey(key ds.Key) []byte {
+	h := sha256.Sum256(key.Bytes())
+	return h[:16]
+}
+
+// NewMultihashKeyMapper returns a multihash key mapper for blocks stored under the
+// given datastore namespace.
+func NewMultihashKeyMapper(blocks ds.Key) KeyMapper {
+	return multihashKeys{blocks}
+}
+
+func (m multihashKeys) Scheme() string {
+	if m.blocks.Equal(DefaultBlocksNamespace) {
+		return MultihashKeyScheme
+	}
+	return MultihashKeyScheme + ":" + m.blocks.String()
+}
+
+// Shortest digest used as a Motr key by the multihash key scheme. Shorter digests
+// could collide with the 128-bit keys of the other schemes, and identity digests,
+// which are the block itself, with the index's own records under \x00motrds/.
+const minDigestKeyLen = 20
+
+func (m multihashKeys) MotrKey(key ds.Key) []byte {
+	if dh, err := BlockMultihash(m.blocks, key); err == nil && dh.Code != mh.IDENTITY && len(dh.Digest) >= minDigestKeyLen {
+		return dh.Digest
+	}
+	return fnvKeys{}.MotrKey(key)
+}
+
+// BlockMultihash decodes the multihash of the block stored at a datastore key in the
+// blocks namespace.
+func BlockMultihash(blocks ds.Key, key ds.Key) (*mh.DecodedMultihash, error) {
+	if !key.Parent().Equal(blocks) {
+		return nil, fmt.Errorf("motrds: key %s is not in blocks namespace %s", key, blocks)
+	}
+	h, err := dshelp.DsKeyToMultihash(ds.NewKey(key.BaseNamespace()))
+	if err != nil {
+		return nil, err
+	}
+	return mh.Decode(h)
+}
+
+// BlockKey returns the datastore key of a block in the blocks namespace.
+func BlockKey(blocks ds.Key, h mh.Multihash) ds.Key {
+	return blocks.Child(dshelp.MultihashToDsKey(h))
+}
+
+func (d *MotrDatastore) readKeyScheme() (string, error) {
+	if has, ehas := d.Index.Has(keySchemeKey); ehas != nil {
+		return "", ehas
+	} else if !has {
+		return "", nil
+	}
+	v, eget := d.Index.Get(keySchemeKey)
+	return string(v), eget
+}
+
+func (d *MotrDatastore) writeKeyScheme(scheme string) error {
+	return d.Index.Put(keySchemeKey, []byte(scheme), true)
+}
+
+// selectKeyScheme chooses the key scheme from the one recorded in the index and the
+// configured one, recording it in the index if the index has none yet and the
+// datastore isn't read-only. Indexes with
+// catalogued objects but no recorded scheme were written with the legacy scheme.
+func (d *MotrDatastore) selectKeyScheme() error {
+	if d.KeyScheme == MultihashKeyScheme && d.BlocksNamespace != "" {
+		d.KeyScheme = NewMultihashKeyMapper(ds.NewKey(d.BlocksNamespace)).Scheme()
+	}
+	recorded, erec := d.readKeyScheme()
+	if erec != nil {
+		log.Errorf("Error reading key scheme of Motr index %s: %v.", d.Idx, erec)
+		return erec
+	}
+	scheme := recorded
+	if scheme == "" {
+		i := d.Catalogue.NewIterator(util.BytesPrefix([]byte("/")), nil)
+		empty := !i.First()
+		i.Release()
+		switch {
+		case !empty:
+			scheme = LegacyKeyScheme
+		case d.KeyScheme != "":
+			scheme = d.KeyScheme
+		default:
+			scheme = DefaultKeyScheme
+		}
+	}
+	if d.KeyScheme != "" && d.KeyScheme != scheme {
+		return fmt.Errorf("motrds: index %s uses the %s key scheme but the %s key scheme was configured, migrate the index with the CLI scheme command", d.Idx, scheme, d.KeyScheme)
+	}
+	keys, ekeys := NewKeyMapper(scheme)
+	if ekeys != nil {
+		return ekeys
+	}
+	if recorded == "" && !d.ReadOnly {
+		if ew := d.writeKeyScheme(scheme); ew != nil {
+			log.Errorf("Error recording key scheme %s in Motr index %s: %v.", scheme, d.Idx, ew)
+			return ew
+		}
+		log.Infof("Recorded key scheme %s in Motr index %s.", scheme, d.Idx)
+	}
+	d.keys = keys
+	d.KeyScheme = scheme
+	log.Infof("Using key scheme %s for Motr index %s.", scheme, d.Idx)
+	return nil
+}
+
+// MigrateKeyScheme copies every catalogued object to the Motr key derived by the new
+// scheme, records the new scheme in the index and then deletes the old records. An
+// interrupted migration leaves the index on the old scheme and can be run again.
+func (d *MotrDatastore) MigrateKeyScheme(scheme string) error {
+	to, eto := NewKeyMapper(scheme)
+	if eto != nil {
+		return eto
+	}
+	d.locks.LockAll()
+	defer d.locks.UnlockAll()
+	from := d.keys
+	if from.Scheme() == to.Scheme() {
+		log.Infof("Motr index %s already uses key scheme %s.", d.Idx, scheme)
+		return nil
+	}
+	log.Infof("Migrating Motr index %s from key scheme %s to %s...", d.Idx, from.Scheme(), to.Scheme())
+	i := d.Catalogue.NewIterator(util.BytesPrefix([]byte("/")), nil)
+	copied := 0
+	for i.Next() {
+		key := ds.RawKey(string(i.Key()))
+		oldKey, newKey := from.MotrKey(key), to.MotrKey(key)
+		if bytes.Equal(oldKey, newKey) {
+			continue
+		}
+		v, eget := d.Index.Get(oldKey)
+		if eget != nil {
+			i.Release()
+			log.Errorf("Error retrieving object OID %s for key %s from Motr: %v.", getOIDstr(oldKey), key, eget)
+			return eget
+		}
+		if eput := d.Index.Put(newKey, v, true); eput != nil {
+			i.Release()
+			log.Errorf("Error putting object OID %s for key %s to Motr: %v.", getOIDstr(newKey), key, eput)
+			return eput
+		}
+		copied++
+		if copied%1000 == 0 {
+			log.Infof("Copied %v objects to key scheme %s...", copied, to.Scheme())
+		}
+	}
+	eit := i.Error()
+	i.Release()
+	if eit != nil {
+		return eit
+	}
+	if ew := d.writeKeyScheme(to.Scheme()); ew != nil {
+		return ew
+	}
+	d.keys = to
+	d.KeyScheme = to.Scheme()
+	log.Infof("Copied %v objects and recorded key scheme %s in Motr index %s, deleting old records...", copied, to.Scheme(), d.Idx)
+	i = d.Catalogue.NewIterator(util.BytesPrefix([]byte("/")), nil)
+	defer i.Release()
+	for i.Next() {
+		key := ds.RawKey(string(i.Key()))
+		if oldKey := from.MotrKey(key); !bytes.Equal(oldKey, to.MotrKey(key)) {
+			if edel := d.Index.Delete(oldKey); edel != nil {
+				log.Warnf("Error deleting old record OID %s for key %s from Motr: %v.", getOIDstr(oldKey), key, edel)
+			}
+		}
+	}
+	log.Infof("Migrated Motr index %s to key scheme %s.", d.Idx, to.Scheme())
+	return i.Error()
+}
@@ -0,0 +1,192 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/allisterb/go-ds-motr/mio"
+)
+
+// TestKeyMappers checks the Motr keys each scheme derives, and that the multihash
+// scheme uses the digest of block keys and falls back to FNV-1a for other keys and
+// for blocks with identity or short digests.
+func TestKeyMappers(t *testing.T) {
+	h, err := mh.Sum([]byte("block"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh, _ := mh.Decode(h)
+	block, rootBlock := BlockKey(DefaultBlocksNamespace, h), BlockKey(ds.NewKey("/"), h)
+	// Identity CIDs hold the block itself, which can be empty or look like the
+	// index's own keys.
+	identity, _ := mh.Sum([]byte("\x00motrds/format"), mh.IDENTITY, -1)
+	empty, _ := mh.Sum(nil, mh.IDENTITY, -1)
+	short, _ := mh.Sum([]byte("block"), mh.SHA2_256, 16)
+	identityBlock, emptyBlock, shortBlock := BlockKey(DefaultBlocksNamespace, identity), BlockKey(DefaultBlocksNamespace, empty), BlockKey(DefaultBlocksNamespace, short)
+	fnv1a := func(key ds.Key) []byte {
+		f := fnv.New128a()
+		f.Write(key.Bytes())
+		return f.Sum(nil)
+	}
+	sum := sha256.Sum256(block.Bytes())
+	for _, c := range []struct {
+		scheme string
+		key    ds.Key
+		want   []byte
+	}{
+		{LegacyKeyScheme, block, fnv.New128().Sum(block.Bytes())},
+		{RawKeyScheme, block, block.Bytes()},
+		{FNV1a128KeyScheme, block, fnv1a(block)},
+		{SHA256KeyScheme, block, sum[:16]},
+		{MultihashKeyScheme, block, dh.Digest},
+		{MultihashKeyScheme, ds.NewKey("/pins/key"), fnv1a(ds.NewKey("/pins/key"))},
+		{MultihashKeyScheme, rootBlock, fnv1a(rootBlock)},
+		{MultihashKeyScheme, block.ChildString("child"), fnv1a(block.ChildString("child"))},
+		{MultihashKeyScheme, ds.NewKey("/blocks/not-a-multihash"), fnv1a(ds.NewKey("/blocks/not-a-multihash"))},
+		{MultihashKeyScheme + ":/", rootBlock, dh.Digest},
+		{MultihashKeyScheme + ":/", block, fnv1a(block)},
+		{MultihashKeyScheme, identityBlock, fnv1a(identityBlock)},
+		{MultihashKeyScheme, emptyBlock, fnv1a(emptyBlock)},
+		{MultihashKeyScheme, shortBlock, fnv1a(shortBlock)},
+	} {
+		km, err := NewKeyMapper(c.scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := km.MotrKey(c.key); !bytes.Equal(got, c.want) {
+			t.Errorf("%s Motr key of %s is %x, want %x", c.scheme, c.key, got, c.want)
+		}
+		if km.Scheme() != c.scheme {
+			t.Errorf("%s key mapper has scheme %s", c.scheme, km.Scheme())
+		}
+	}
+	if _, err := NewKeyMapper("md5"); err == nil {
+		t.Error("created a key mapper for an unknown scheme")
+	}
+}
+
+// TestIdentityBlocks checks that blocks with identity CIDs stored with the multihash
+// key scheme don't overwrite each other or the index's own records.
+func TestIdentityBlocks(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	conf.KeyScheme = MultihashKeyScheme
+	d := openTestDatastore(t, conf)
+	values := map[ds.Key][]byte{}
+	for _, data := range []string{"", "\x00motrds/format", "\x00motrds/key-scheme"} {
+		h, _ := mh.Sum([]byte(data), mh.IDENTITY, -1)
+		key := BlockKey(DefaultBlocksNamespace, h)
+		if err := d.Put(ctx, key, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		values[key] = []byte(data)
+	}
+	d.Close()
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	for key, want := range values {
+		if v, err := d.Get(ctx, key); err != nil || !bytes.Equal(v, want) {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+}
+
+// TestSelectKeyScheme checks that the key scheme is recorded when an index is first
+// opened, that a different configured scheme is refused, and that indexes written
+// before schemes were recorded use the legacy scheme.
+func TestSelectKeyScheme(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	if scheme, err := d.readKeyScheme(); err != nil || scheme != DefaultKeyScheme || d.KeyScheme != DefaultKeyScheme {
+		t.Fatalf("recorded key scheme %q, %v, using %q", scheme, err, d.KeyScheme)
+	}
+	d.Close()
+	conf.KeyScheme = SHA256KeyScheme
+	if d, err := NewMotrDatastore(conf); err == nil {
+		d.Close()
+		t.Fatal("opened an index with a different key scheme than the recorded one")
+	}
+
+	conf = testConfig(t)
+	conf.KeyScheme = SHA256KeyScheme
+	d = openTestDatastore(t, conf)
+	if err := d.Put(ctx, ds.NewKey("/key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	conf.KeyScheme = ""
+	d = openTestDatastore(t, conf)
+	if d.KeyScheme != SHA256KeyScheme {
+		t.Fatalf("using key scheme %q, recorded %q", d.KeyScheme, SHA256KeyScheme)
+	}
+	// An index with values and no recorded scheme predates key schemes.
+	if err := d.Index.Delete(keySchemeKey); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	if scheme, err := d.readKeyScheme(); err != nil || scheme != LegacyKeyScheme || d.KeyScheme != LegacyKeyScheme {
+		t.Fatalf("recorded key scheme %q, %v, using %q for an index without a scheme", scheme, err, d.KeyScheme)
+	}
+}
+
+// TestMigrateKeyScheme checks that migrating an index to another key scheme moves
+// every value to its new Motr key, and that a migration that fails midway leaves the
+// index on the old scheme and can be run again.
+func TestMigrateKeyScheme(t *testing.T) {
+	ctx := context.Background()
+	d, fi := testDatastoreWithFaults(t, nil)
+	var keys []ds.Key
+	for i := 0; i < 20; i++ {
+		key := ds.NewKey(fmt.Sprintf("/scheme/%d", i))
+		if err := d.Put(ctx, key, []byte(key.String())); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	check := func(scheme string) {
+		t.Helper()
+		if recorded, err := d.readKeyScheme(); err != nil || recorded != scheme || d.KeyScheme != scheme {
+			t.Fatalf("recorded key scheme %q, %v, using %q, want %q", recorded, err, d.KeyScheme, scheme)
+		}
+		for _, key := range keys {
+			if v, err := d.Get(ctx, key); err != nil || string(v) != key.String() {
+				t.Fatalf("Get(%s) = %q, %v", key, v, err)
+			}
+		}
+	}
+
+	fi.SetFaults([]mio.Fault{{Ops: []string{mio.OpPut}, After: 10, Count: 1, Error: "no space"}})
+	if err := d.MigrateKeyScheme(SHA256KeyScheme); !errors.Is(err, mio.ErrInjected) {
+		t.Fatalf("MigrateKeyScheme returned %v", err)
+	}
+	check(DefaultKeyScheme)
+
+	fi.SetFaults(nil)
+	if err := d.MigrateKeyScheme(SHA256KeyScheme); err != nil {
+		t.Fatal(err)
+	}
+	check(SHA256KeyScheme)
+	fnv, _ := NewKeyMapper(FNV1a128KeyScheme)
+	for _, key := range keys {
+		if has, err := d.Index.Has(fnv.MotrKey(key)); err != nil || has {
+			t.Fatalf("old Motr record of %s left after the migration: %v, %v", key, has, err)
+		}
+	}
+	if err := d.MigrateKeyScheme(SHA256KeyScheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MigrateKeyScheme("md5"); err == nil {
+		t.Fatal("migrated to an unknown key scheme")
+	}
+}
@@ -0,0 +1,241 @@
+package motrds
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Catalogue key of the checkpoint of a migration into the datastore.
+var migrateCheckpointKey = []byte("\x00motrds/migrate-checkpoint")
+
+// MigrateOptions controls how Migrate copies a datastore.
+type MigrateOptions struct {
+	// Identifies the source datastore, so a migration is only resumed from the same
+	// source.
+	Source string
+	// Number of goroutines writing to the datastore. Defaults to 8.
+	Workers int
+	// Number of entries each goroutine writes in a batch. Defaults to 1000.
+	BatchSize int
+	// Called with the progress after every batch.
+	Progress func(MigrateStats)
+}
+
+// MigrateStats counts the entries of a migration. Digest is the XOR of the SHA-256
+// hashes of each key and value, so it doesn't depend on the order entries are read.
+type MigrateStats struct {
+	Entries int
+	Bytes   int64
+	Copied  int
+	Skipped int
+	Digest  [sha256.Size]byte
+}
+
+func (s *MigrateStats) add(e query.Entry) {
+	h := sha256.New()
+	h.Write([]byte(e.Key))
+	h.Write([]byte{0})
+	h.Write(e.Value)
+	for i, b := range h.Sum(nil) {
+		s.Digest[i] ^= b
+	}
+	s.Entries++
+	s.Bytes += int64(len(e.Value))
+}
+
+// migrateCheckpoint records a migration in progress in the catalogue.
+type migrateCheckpoint struct {
+	Source  string
+	Started time.Time
+	Copied  int
+	Done    bool
+}
+
+func (d *MotrDatastore) readMigrateCheckpoint() (*migrateCheckpoint, error) {
+	v, eget := d.Catalogue.Get(migrateCheckpointKey, nil)
+	if eget == leveldb.ErrNotFound {
+		return nil, nil
+	} else if eget != nil {
+		return nil, eget
+	}
+	var cp migrateCheckpoint
+	if ejson := json.Unmarshal(v, &cp); ejson != nil {
+		return nil, fmt.Errorf("motrds: malformed migration checkpoint: %v", ejson)
+	}
+	return &cp, nil
+}
+
+func (d *MotrDatastore) writeMigrateCheckpoint(cp *migrateCheckpoint) error {
+	v, _ := json.Marshal(cp)
+	return d.Catalogue.Put(migrateCheckpointKey, v, nil)
+}
+
+// Migrate copies every entry of src into the datastore in parallel batches and then
+// verifies the datastore holds the same number of entries with the same digest.
+// The datastore must be empty unless it holds an interrupted migration from the
+// same source, which is resumed by reading the source again and skipping the entries
+// already copied: datastores don't return entries in a stable order, so there is no
+// position in the source to resume from.
+func (d *MotrDatastore) Migrate(ctx context.Context, src ds.Datastore, opts MigrateOptions) (MigrateStats, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = 8
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	var stats MigrateStats
+	cp, ecp := d.readMigrateCheckpoint()
+	if ecp != nil {
+		return stats, ecp
+	}
+	switch {
+	case cp == nil:
+		i := d.Catalogue.NewIterator(util.BytesPrefix([]byte("/")), nil)
+		empty := !i.First()
+		i.Release()
+		if !empty {
+			return stats, fmt.Errorf("motrds: can't migrate into Motr index %s, it already has keys", d.Idx)
+		}
+		cp = &migrateCheckpoint{Source: opts.Source, Started: time.Now()}
+		if ew := d.writeMigrateCheckpoint(cp); ew != nil {
+			return stats, ew
+		}
+		log.Infof("Migrating %s into Motr index %s...", opts.Source, d.Idx)
+	case cp.Source != opts.Source:
+		return stats, fmt.Errorf("motrds: Motr index %s holds a migration from %s, not %s", d.Idx, cp.Source, opts.Source)
+	default:
+		log.Infof("Resuming migration of %s into Motr index %s started %v, %d entries already copied...", opts.Source, d.Idx, cp.Started, cp.Copied)
+	}
+
+	r, eq := src.Query(ctx, query.Query{})
+	if eq != nil {
+		return stats, eq
+	}
+	defer r.Close()
+	entries := make(chan query.Entry, opts.Workers*opts.BatchSize)
+	var mu sync.Mutex
+	var emig error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if emig == nil {
+			emig = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return emig != nil
+	}
+	commit := func(b ds.Batch, copied, skipped int) {
+		if err := b.Commit(ctx); err != nil {
+			fail(err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		stats.Copied += copied
+		stats.Skipped += skipped
+		cp.Copied += copied
+		if err := d.writeMigrateCheckpoint(cp); err != nil && emig == nil {
+			emig = err
+		}
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, _ := d.Batch(ctx)
+			copied, skipped := 0, 0
+			for e := range entries {
+				if failed() {
+					continue
+				}
+				key := ds.RawKey(e.Key)
+				if has, err := d.Has(ctx, key); err != nil {
+					fail(err)
+					continue
+				} else if has {
+					skipped++
+				} else if err := b.Put(ctx, key, e.Value); err != nil {
+					fail(err)
+					continue
+				} else {
+					copied++
+				}
+				if copied+skipped >= opts.BatchSize {
+					commit(b, copied, skipped)
+					b, _ = d.Batch(ctx)
+					copied, skipped = 0, 0
+				}
+			}
+			if copied+skipped > 0 {
+				commit(b, copied, skipped)
+			}
+		}()
+	}
+	var source MigrateStats
+	for res := range r.Next() {
+		if res.Error != nil {
+			fail(res.Error)
+			break
+		}
+		if failed() {
+			break
+		}
+		source.add(res.Entry)
+		entries <- res.Entry
+	}
+	close(entries)
+	wg.Wait()
+	if emig != nil {
+		log.Errorf("Migration of %s into Motr index %s failed after copying %d entries, run it again to resume: %v.", opts.Source, d.Idx, stats.Copied, emig)
+		return stats, emig
+	}
+	stats.Entries, stats.Bytes, stats.Digest = source.Entries, source.Bytes, source.Digest
+
+	log.Infof("Copied %d entries and skipped %d already copied, verifying...", stats.Copied, stats.Skipped)
+	migrated, ever := d.migrateDigest(ctx)
+	if ever != nil {
+		return stats, ever
+	}
+	if migrated.Entries != source.Entries || migrated.Digest != source.Digest {
+		return stats, fmt.Errorf("motrds: migration verification failed, %s has %d entries with digest %x but Motr index %s has %d entries with digest %x", opts.Source, source.Entries, source.Digest, d.Idx, migrated.Entries, migrated.Digest)
+	}
+	cp.Done = true
+	if ew := d.writeMigrateCheckpoint(cp); ew != nil {
+		return stats, ew
+	}
+	log.Infof("Migrated %d entries (%d bytes) of %s into Motr index %s, digest %x.", stats.Entries, stats.Bytes, opts.Source, d.Idx, stats.Digest)
+	return stats, nil
+}
+
+// migrateDigest counts and hashes every entry in the datastore.
+func (d *MotrDatastore) migrateDigest(ctx context.Context) (MigrateStats, error) {
+	var stats MigrateStats
+	r, eq := d.Query(ctx, query.Query{})
+	if eq != nil {
+		return stats, eq
+	}
+	defer r.Close()
+	for res := range r.Next() {
+		if res.Error != nil {
+			return stats, res.Error
+		}
+		stats.add(res.Entry)
+	}
+	return stats, nil
+}
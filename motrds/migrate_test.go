@@ -0,0 +1,73 @@
+package motrds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// failingSource fails queries after returning limit entries.
+type failingSource struct {
+	ds.Datastore
+	limit int
+}
+
+func (s failingSource) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	r, err := s.Datastore.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	return query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			if n++; n > s.limit {
+				return query.Result{Error: errors.New("source went away")}, true
+			}
+			return r.NextSync()
+		},
+		Close: r.Close,
+	}), nil
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	src := ds.NewMapDatastore()
+	for i := 0; i < 2500; i++ {
+		if err := src.Put(ctx, ds.NewKey(fmt.Sprintf("/blocks/%d", i)), []byte(fmt.Sprintf("block %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.Put(ctx, ds.NewKey("/local/filesroot"), []byte("root"))
+
+	d := testDatastore(t)
+	opts := MigrateOptions{Source: "test", Workers: 4, BatchSize: 100}
+	if _, err := d.Migrate(ctx, failingSource{src, 1000}, opts); err == nil {
+		t.Fatal("migration from a failing source succeeded")
+	}
+	if _, err := d.Migrate(ctx, src, MigrateOptions{Source: "other"}); err == nil {
+		t.Fatal("resumed a migration from another source")
+	}
+	stats, err := d.Migrate(ctx, src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 2501 || stats.Copied+stats.Skipped != 2501 || stats.Skipped == 0 {
+		t.Fatalf("resumed migration stats %+v", stats)
+	}
+	for _, k := range []string{"/blocks/0", "/blocks/2499", "/local/filesroot"} {
+		want, _ := src.Get(ctx, ds.NewKey(k))
+		if v, err := d.Get(ctx, ds.NewKey(k)); err != nil || string(v) != string(want) {
+			t.Fatalf("Get(%s) = %q, %v", k, v, err)
+		}
+	}
+
+	other := testDatastore(t)
+	other.Put(ctx, ds.NewKey("/existing"), []byte("v"))
+	if _, err := other.Migrate(ctx, src, opts); err == nil {
+		t.Fatal("migrated into a datastore that already has keys")
+	}
+}
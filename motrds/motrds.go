@@ -3,8 +3,7 @@ package motrds
 import (
 	"context"
 	"fmt"
-	"hash/fnv"
-	"sync"
+	"time"
 
 	ds "github.com/ipfs/go-datastore"
 	query "github.com/ipfs/go-datastore/query"
@@ -23,9 +22,19 @@ var _ ds.PersistentDatastore = (*MotrDatastore)(nil)
 
 type MotrDatastore struct {
 	Config
-	mio.Mkv
-	Ldb  leveldb.DB
-	Lock *sync.RWMutex
+	mio.Index
+	Catalogue Catalogue
+	locks     *keyLocks
+	keys      KeyMapper
+	cache     *valueCache
+	codec     byte
+	keyring   *keyring
+	faults    *mio.FaultInjector
+	// Motr keys put while garbage is being collected, nil otherwise.
+	live *liveSet
+	// Closed to stop the sweeper, which closes sweepDone when it returns.
+	stopSweep chan struct{}
+	sweepDone chan struct{}
 }
 
 type Config struct {
@@ -34,86 +43,307 @@ type Config struct {
 	ProfileFid      string
 	LocalProcessFid string
 	Idx             string
-	LevelDBPath     string
-	Threads         int
-	Trace           bool
+	// Backend implementing the Motr APIs, one of mio.Backends. Defaults to
+	// mio.DefaultBackend, which is the Motr client unless built with the nomotr tag.
+	Backend string
+	// Path of the catalogue database for the leveldb and badger catalogue backends.
+	LevelDBPath string
+	// Number of threads reading and writing the blocks of an object in parallel.
+	// Defaults to 1.
+	Threads int
+	// Enable Motr client tracing.
+	Trace bool
+	// Create the Motr index, and the catalogue index for the motr catalogue backend,
+	// if they don't exist.
+	CreateIndex bool
+	// Motr client tunables, see mio.ClientConfig.
+	RecvQueueMinLen int
+	MaxRPCMsgSize   int
+	NoOostore       bool
+	ReadVerify      bool
+	CreateIndexMeta bool
+	// Store for the catalogue of datastore keys, one of CatalogueBackends. Defaults to
+	// LevelDB.
+	CatalogueBackend string
+	// Motr key-value index holding the catalogue for the motr catalogue backend.
+	CatalogueIdx string
+	// Number of objects a query reads ahead and fetches concurrently from Motr.
+	// Values of 1 or less fetch objects one at a time.
+	QueryPrefetch int
+	// Scheme for deriving Motr keys from datastore keys, one of KeySchemes. When empty
+	// the scheme recorded in the index is used.
+	KeyScheme string
+	// Datastore namespace holding IPFS blocks for the multihash key scheme, "/" when
+	// the datastore is mounted at /blocks. Defaults to /blocks.
+	BlocksNamespace string
+	// Size in bytes of the cache of object values read from Motr, 0 to disable it.
+	CacheSize int
+	// Check values read from Motr against the multihash in their block key or the
+	// checksum in their catalogue record, returning ErrCorrupt when they differ.
+	VerifyValues bool
+	// Compression of values stored in Motr, one of NoCompression, ZstdCompression or
+	// SnappyCompression. Values stored with any compression can always be read.
+	Compression string
+	// Values smaller than this many bytes are stored uncompressed.
+	CompressionMinSize int
+	// Authenticated encryption of values stored in Motr, one of NoEncryption,
+	// AESGCMEncryption or XChaCha20Poly1305Encryption. Keys are read from
+	// EncryptionKeyFile or the environment variable named by EncryptionKeyEnv.
+	Encryption        string
+	EncryptionKeyFile string
+	EncryptionKeyEnv  string
+	// Number of randomly chosen values Check reads from Motr and verifies.
+	CheckSamples int
+	// Interval between sweeps deleting entries whose TTL has expired.
+	TTLSweepInterval time.Duration
+	// Faults injected into operations on the Motr index, for rehearsing failures.
+	Faults []mio.Fault
+	// Open the index and catalogue without writing to them, for inspecting a
+	// datastore. The index format and key scheme aren't recorded, legacy catalogue
+	// records aren't migrated, interrupted transactions aren't rolled back, expired
+	// entries aren't swept and writes return ErrReadOnly.
+	ReadOnly bool
 }
 
+// Validate checks the syntax of the Motr endpoint addresses and fids in conf, and the
+// Motr client tunables.
+func (conf Config) Validate() error {
+	if err := conf.ValidateConnection(); err != nil {
+		return err
+	}
+	if err := mio.ValidateFid(conf.Idx, mio.IndexFidType); err != nil {
+		return fmt.Errorf("invalid index: %v", err)
+	}
+	if conf.CatalogueBackend == MotrCatalogue {
+		if err := mio.ValidateFid(conf.CatalogueIdx, mio.IndexFidType); err != nil {
+			return fmt.Errorf("invalid catalogue index: %v", err)
+		}
+		c1, k1, _ := mio.ParseFid(conf.Idx)
+		c2, k2, _ := mio.ParseFid(conf.CatalogueIdx)
+		if c1 == c2 && k1 == k2 {
+			return fmt.Errorf("catalogue index %s is the datastore index", conf.CatalogueIdx)
+		}
+	}
+	return conf.clientConfig().Validate()
+}
+
+// ValidateConnection checks the syntax of the Motr endpoint addresses and the profile
+// and process fids in conf. They aren't used by the memory backend and are only
+// checked for the motr backend.
+func (conf Config) ValidateConnection() error {
+	backend := conf.Backend
+	if backend == "" {
+		backend = mio.DefaultBackend
+	}
+	if backend != mio.MotrBackend {
+		return nil
+	}
+	if err := mio.ValidateEndpoint(conf.LocalAddr); err != nil {
+		return fmt.Errorf("invalid local address: %v", err)
+	}
+	if err := mio.ValidateEndpoint(conf.HaxAddr); err != nil {
+		return fmt.Errorf("invalid hax address: %v", err)
+	}
+	if err := mio.ValidateFid(conf.ProfileFid, mio.ProfileFidType); err != nil {
+		return fmt.Errorf("invalid cluster profile fid: %v", err)
+	}
+	if err := mio.ValidateFid(conf.LocalProcessFid, mio.ProcessFidType); err != nil {
+		return fmt.Errorf("invalid local process fid: %v", err)
+	}
+	return nil
+}
+
+func (conf Config) clientConfig() mio.ClientConfig {
+	return mio.ClientConfig{
+		Threads:         conf.Threads,
+		Trace:           conf.Trace,
+		RecvQueueMinLen: conf.RecvQueueMinLen,
+		MaxRPCMsgSize:   conf.MaxRPCMsgSize,
+		NoOostore:       conf.NoOostore,
+		ReadVerify:      conf.ReadVerify,
+		CreateIndexMeta: conf.CreateIndexMeta,
+	}
+}
+
+// Query read-ahead window used when Config.QueryPrefetch is not set.
+const DefaultQueryPrefetch = 16
+
 var log = logging.Logger("motrds")
-var hash128 = fnv.New128()
-var mkv mio.Mkv
 
 func NewMotrDatastore(conf Config) (*MotrDatastore, error) {
-	if rinit, einit := mio.Init(&conf.LocalAddr, &conf.HaxAddr, &conf.ProfileFid, &conf.LocalProcessFid, conf.Threads, conf.Trace); !rinit {
+	if conf.Backend == "" {
+		conf.Backend = mio.DefaultBackend
+	}
+	if err := conf.Validate(); err != nil {
+		log.Errorf("Invalid configuration: %v.", err)
+		return nil, err
+	}
+	if conf.QueryPrefetch == 0 {
+		conf.QueryPrefetch = DefaultQueryPrefetch
+	}
+	if conf.CompressionMinSize == 0 {
+		conf.CompressionMinSize = DefaultCompressionMinSize
+	}
+	if conf.CheckSamples == 0 {
+		conf.CheckSamples = DefaultCheckSamples
+	}
+	if conf.TTLSweepInterval == 0 {
+		conf.TTLSweepInterval = DefaultTTLSweepInterval
+	}
+	codec, ecodec := compressionCodec(conf.Compression)
+	if ecodec != nil {
+		return nil, ecodec
+	}
+	keyring, ekeys := loadKeyring(conf)
+	if ekeys != nil {
+		log.Errorf("Failed to load encryption keys: %v.", ekeys)
+		return nil, ekeys
+	} else if keyring != nil {
+		log.Infof("Loaded encryption keys, encrypting values with key %s using %s.", keyring.active, conf.Encryption)
+	}
+	if rinit, einit := mio.InitBackend(conf.Backend, &conf.LocalAddr, &conf.HaxAddr, &conf.ProfileFid, &conf.LocalProcessFid, conf.clientConfig()); !rinit {
 		log.Errorf("Failed to initialize Motr client: %s.", einit)
 		return nil, einit
+	} else if conf.Backend == mio.MemoryBackend {
+		log.Warnf("Using in-memory Motr backend, all values will be lost when the process exits.")
 	} else {
 		log.Infof("Initialized Motr client for local endpoint address: %v, HA address: %v, cluster profile FID: %v, local process FID: %v.", &conf.LocalAddr, &conf.HaxAddr, &conf.ProfileFid, &conf.LocalProcessFid)
 	}
 
-	if eidx := mkv.Open(conf.Idx, false); eidx != nil {
+	var faults *mio.FaultInjector
+	mkv, eidx := mio.NewIndex(conf.Backend)
+	if eidx != nil {
+		return nil, eidx
+	} else if len(conf.Faults) > 0 {
+		if fi, efi := mio.NewFaultInjector(conf.Faults); efi != nil {
+			log.Errorf("Invalid faults: %v.", efi)
+			return nil, efi
+		} else {
+			log.Warnf("Injecting %v faults into operations on Motr index %v.", len(conf.Faults), conf.Idx)
+			faults, mkv = fi, fi.Index(mkv)
+		}
+	}
+	if conf.ReadOnly {
+		mkv = readOnlyIndex{mkv}
+	}
+	if eidx := mkv.Open(conf.Idx, conf.CreateIndex && !conf.ReadOnly); eidx != nil {
 		log.Errorf("Failed to open Motr key-value index %v: %v", conf.Idx, eidx)
 		return nil, eidx
 	} else {
 		log.Infof("Initialized Motr key-value index %v.", conf.Idx)
 
 	}
-	ldbopt := &opt.Options{}
-	var ldb leveldb.DB
-	if _ldb, eldb := leveldb.OpenFile(conf.LevelDBPath, ldbopt); eldb != nil {
-		log.Errorf("Failed to open LevelDB database at %s.", conf.LevelDBPath)
-		return nil, eldb
-	} else {
-		ldb = *_ldb
-		log.Infof("Opened LevelDB database at %v.", conf.LevelDBPath)
+	cat, ecat := OpenCatalogue(conf)
+	if ecat != nil {
+		log.Errorf("Failed to open %s catalogue: %v.", conf.CatalogueBackend, ecat)
+		return nil, ecat
+	}
+	d := &MotrDatastore{Config: conf, Index: mkv, Catalogue: cat, locks: &keyLocks{}, codec: codec, keyring: keyring, faults: faults}
+	if conf.CacheSize > 0 {
+		d.cache = newValueCache(conf.CacheSize)
+		log.Infof("Caching up to %v bytes of object values.", conf.CacheSize)
+	}
+	if eformat := d.checkIndexFormat(); eformat != nil {
+		log.Errorf("Failed to check format of Motr index %v: %v.", conf.Idx, eformat)
+		cat.Close()
+		return nil, eformat
+	}
+	if escheme := d.selectKeyScheme(); escheme != nil {
+		log.Errorf("Failed to select key scheme for Motr index %v: %v.", conf.Idx, escheme)
+		cat.Close()
+		return nil, escheme
 	}
-	return &MotrDatastore{conf, mkv, ldb, &sync.RWMutex{}}, nil
+	if conf.ReadOnly {
+		i := cat.NewIterator(util.BytesPrefix(undoPrefix), nil)
+		if i.First() {
+			log.Warnf("Motr index %v has an uncommitted transaction, which will be rolled back when it is opened for writing.", conf.Idx)
+		}
+		i.Release()
+		log.Infof("Opened Motr datastore for index %v read-only.", conf.Idx)
+		return d, nil
+	}
+	if emig := d.MigrateCatalogue(); emig != nil {
+		log.Errorf("Failed to migrate catalogue: %v.", emig)
+		cat.Close()
+		return nil, emig
+	}
+	if eroll := d.rollbackTransaction(); eroll != nil {
+		log.Errorf("Failed to roll back uncommitted transaction: %v.", eroll)
+		cat.Close()
+		return nil, eroll
+	}
+	d.stopSweep, d.sweepDone = make(chan struct{}), make(chan struct{})
+	go d.sweep(conf.TTLSweepInterval)
+	return d, nil
 }
 
 func (d *MotrDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
-	d.Lock.RLock()
-	defer d.Lock.RUnlock()
-	has, ehas := d.Ldb.Has(key.Bytes(), nil)
-	log.Debugf("Check for existence of key %s (OID %s) in LevelDB: (%v, %v).", string(key.Bytes()), getOIDstr(getOID(key)), has, ehas)
-	if ehas == leveldb.ErrNotFound {
+	d.locks.RLock(key)
+	defer d.locks.RUnlock(key)
+	_, ehas := d.getRecord(key)
+	log.Debugf("Check for existence of key %s (OID %s) in catalogue: (%v, %v).", string(key.Bytes()), getOIDstr(d.getOID(key)), ehas == nil, ehas)
+	if ehas == ds.ErrNotFound {
 		return false, nil
 	} else {
-		return has, ehas
+		return ehas == nil, ehas
 	}
 }
 
 func (d *MotrDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
-	d.Lock.RLock()
-	defer d.Lock.RUnlock()
-	hasldb, eldb := d.Ldb.Has(key.Bytes(), nil)
-	log.Debugf("Check for existence of key %s (OID %s) in LevelDB: (%v, %v).", string(key.Bytes()), getOIDstr(getOID(key)), hasldb, eldb)
+	d.locks.RLock(key)
+	defer d.locks.RUnlock(key)
+	rec, eldb := d.getRecord(key)
+	log.Debugf("Get catalogue record for key %s (OID %s) from catalogue: (%v, %v).", string(key.Bytes()), getOIDstr(d.getOID(key)), rec, eldb)
 	if eldb != nil {
-		if eldb == leveldb.ErrNotFound {
-			return nil, ds.ErrNotFound
-		} else {
-			return nil, eldb
+		return nil, eldb
+	}
+	var generation uint64
+	if d.cache != nil {
+		v, gen, cached := d.cache.Get(key.String())
+		if cached {
+			log.Debugf("Get object at key %s from cache.", key)
+			return v, nil
 		}
-	} else {
-		if !hasldb {
-			return nil, ds.ErrNotFound
-		} else {
-			return d.Mkv.Get(getOID(key))
+		generation = gen
+	}
+	stored, eget := d.Index.Get(d.getOID(key))
+	if eget != nil {
+		return nil, eget
+	}
+	v, edec := d.decodeValue(key, rec, stored)
+	if edec != nil {
+		log.Errorf("Error decoding object at key %s (OID %s): %v.", key, getOIDstr(d.getOID(key)), edec)
+		return nil, edec
+	}
+	if d.VerifyValues {
+		if ever := d.verifyValue(key, rec, v); ever != nil {
+			return nil, ever
 		}
 	}
+	if d.cache != nil {
+		d.cache.Add(key.String(), v, generation)
+	}
+	return v, nil
 }
 
+// GetSize returns the value size recorded in the catalogue, only asking Motr for
+// records that predate the catalogue storing sizes.
 func (d *MotrDatastore) GetSize(ctx context.Context, key ds.Key) (size int, err error) {
-	d.Lock.RLock()
-	defer d.Lock.RUnlock()
-	//log.Debugf("Get size of object at key %s in Motr...", key)
-	//return d.getSize(key.Bytes())
-	return mkv.GetSize(getOID(key))
+	d.locks.RLock(key)
+	defer d.locks.RUnlock(key)
+	rec, eldb := d.getRecord(key)
+	if eldb != nil {
+		return -1, eldb
+	} else if rec.Legacy {
+		log.Debugf("Get size of object at key %s (OID %s) with legacy catalogue record from Motr...", key, getOIDstr(d.getOID(key)))
+		return d.Index.GetSize(d.getOID(key))
+	} else {
+		return rec.Size, nil
+	}
 }
 
-// Query the LevelDB metadata store for Motr keys and retrieve objects from Motr when data is requested
+// Query the catalogue for Motr keys and retrieve objects from Motr when data is requested
 func (d *MotrDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
-	d.Lock.RLock()
-	defer d.Lock.RUnlock()
 	log.Debugf("Executing query %s...", q.String())
 	var rnge *util.Range
 	// make a copy of the query for the fallback naive query implementation.
@@ -123,90 +353,221 @@ func (d *MotrDatastore) Query(ctx context.Context, q query.Query) (query.Results
 	if prefix != "/" {
 		rnge = util.BytesPrefix([]byte(prefix + "/"))
 		qNaive.Prefix = ""
+	} else {
+		rnge = util.BytesPrefix([]byte(prefix))
 	}
-	i := d.Ldb.NewIterator(rnge, nil)
+	i := d.Catalogue.NewIterator(rnge, nil)
 	next := i.Next
 	if len(q.Orders) > 0 {
 		switch q.Orders[0].(type) {
 		case query.OrderByKey, *query.OrderByKey:
 			qNaive.Orders = nil
 		case query.OrderByKeyDescending, *query.OrderByKeyDescending:
+			first := true
 			next = func() bool {
-				next = i.Prev
-				return i.Last()
+				if first {
+					first = false
+					return i.Last()
+				}
+				return i.Prev()
 			}
 			qNaive.Orders = nil
 		default:
 		}
 	}
-	r := query.ResultsFromIterator(q, query.Iterator{
-		Next: func() (query.Result, bool) {
-			d.Lock.RLock()
-			defer d.Lock.RUnlock()
-			if !next() || i.Key() == nil {
-				return query.Result{}, false
+	// Key filters and expirations are checked while iterating so objects are only
+	// fetched from Motr for entries that survive them. Offset and limit can then be
+	// applied too, provided nothing is left for the naive implementation to filter or
+	// sort.
+	keyFilters, valueFilters := splitFilters(q.Filters)
+	qNaive.Filters = valueFilters
+	skip, remaining := 0, -1
+	if len(valueFilters) == 0 && qNaive.Orders == nil {
+		skip = q.Offset
+		if q.Limit > 0 {
+			remaining = q.Limit
+		}
+		qNaive.Offset = 0
+		qNaive.Limit = 0
+	}
+	iterNext := next
+	next = func() bool {
+		if remaining == 0 {
+			return false
+		}
+		for iterNext() && i.Key() != nil {
+			if !matchKey(keyFilters, i.Key()) {
+				continue
 			}
-			oid := hash128.Sum(i.Key())
-			k := string(i.Key())
-			log.Debugf("Begin yield object with key %s (OID %s) from query.", k, getOIDstr(oid))
-			var size int
-			if _size, serr := mkv.GetSize(oid); serr != nil {
-				log.Errorf("Error getting size of object OID %s from Motr: %v.", getOIDstr(oid), serr)
-				return query.Result{Error: serr}, true
-			} else {
-				size = _size
+			// Expired entries the sweeper hasn't deleted yet are skipped.
+			if rec, erec := decodeRecord(i.Value()); erec == nil && rec.expired(time.Now()) {
+				continue
 			}
-			e := query.Entry{Key: k, Size: size}
-			if !q.KeysOnly {
-				log.Debugf("Results iterator get object OID %s from Motr.", getOIDstr(oid))
-				if v, eval := mkv.Get(oid); eval == nil {
-					e.Value = v
-				} else {
-					log.Errorf("Error retrieving object OID %s from Motr: %v", getOIDstr(oid), eval)
-					return query.Result{Error: eval}, true
-				}
+			if skip > 0 {
+				skip--
+				continue
 			}
-			log.Debugf("End (success) yield object with key %s (OID %s) from query.", k, getOIDstr(oid))
-			return query.Result{Entry: e}, true
-		},
-		Close: func() error {
-			d.Lock.RLock()
-			defer d.Lock.RUnlock()
-			i.Release()
-			return nil
-		},
-	})
+			if remaining > 0 {
+				remaining--
+			}
+			return true
+		}
+		return false
+	}
+	var r query.Results
+	if q.KeysOnly || d.QueryPrefetch <= 1 {
+		done := false
+		r = query.ResultsFromIterator(q, query.Iterator{
+			Next: func() (query.Result, bool) {
+				for !done {
+					if !next() || i.Key() == nil {
+						done = true
+						if eit := i.Error(); eit != nil {
+							log.Errorf("Error iterating catalogue: %v.", eit)
+							return query.Result{Error: eit}, true
+						}
+						break
+					}
+					if res, ok := d.queryResult(q, i.Key(), i.Value()); ok {
+						return res, true
+					}
+				}
+				return query.Result{}, false
+			},
+			Close: func() error {
+				i.Release()
+				return nil
+			},
+		})
+	} else {
+		r = d.prefetchResults(q, i, next)
+	}
 	return query.NaiveQueryApply(qNaive, r), nil
 }
 
+// queryResult builds the query result for a catalogue entry under the key's read
+// lock, retrieving the object from Motr when the query asks for values. The record
+// of an object is read again under the lock so it matches the object, and false is
+// returned if the key was deleted or expired since the iterator read it.
+func (d *MotrDatastore) queryResult(q query.Query, key []byte, value []byte) (query.Result, bool) {
+	k := string(key)
+	dk := ds.RawKey(k)
+	d.locks.RLock(dk)
+	defer d.locks.RUnlock(dk)
+	oid := d.getOID(dk)
+	log.Debugf("Begin yield object with key %s (OID %s) from query.", k, getOIDstr(oid))
+	rec, erec := decodeRecord(value)
+	if !q.KeysOnly {
+		rec, erec = d.getRecord(dk)
+	}
+	if erec == ds.ErrNotFound || erec == nil && rec.expired(time.Now()) {
+		return query.Result{}, false
+	} else if erec != nil {
+		log.Errorf("Error reading catalogue record for key %s: %v.", k, erec)
+		return query.Result{Error: erec}, true
+	}
+	e := query.Entry{Key: k, Size: rec.Size}
+	if q.ReturnExpirations && rec.Expires != 0 {
+		e.Expiration = time.Unix(0, rec.Expires)
+	}
+	if !q.KeysOnly {
+		log.Debugf("Results iterator get object OID %s from Motr.", getOIDstr(oid))
+		if stored, eval := d.Index.Get(oid); eval == nil {
+			v, edec := d.decodeValue(dk, rec, stored)
+			if edec != nil {
+				log.Errorf("Error decoding object OID %s: %v.", getOIDstr(oid), edec)
+				return query.Result{Error: edec}, true
+			}
+			if d.VerifyValues {
+				if ever := d.verifyValue(dk, rec, v); ever != nil {
+					return query.Result{Error: ever}, true
+				}
+			}
+			e.Value = v
+			e.Size = len(v)
+		} else {
+			log.Errorf("Error retrieving object OID %s from Motr: %v", getOIDstr(oid), eval)
+			return query.Result{Error: eval}, true
+		}
+	} else if rec.Legacy && q.ReturnsSizes {
+		if size, serr := d.Index.GetSize(oid); serr != nil {
+			log.Errorf("Error getting size of object OID %s from Motr: %v.", getOIDstr(oid), serr)
+			return query.Result{Error: serr}, true
+		} else {
+			e.Size = size
+		}
+	}
+	log.Debugf("End (success) yield object with key %s (OID %s) from query.", k, getOIDstr(oid))
+	return query.Result{Entry: e}, true
+}
+
 func (d *MotrDatastore) Put(ctx context.Context, key ds.Key, value []byte) (err error) {
-	d.Lock.RLock()
-	defer d.Lock.RUnlock()
-	oid := getOID(key)
-	log.Debugf("Begin put key %v (OID %s) to LevelDB and Motr index %s.", key, getOIDstr(getOID(key)), d.Idx)
-	if emotr := mkv.Put(oid, value, true); emotr != nil {
+	return d.put(key, value, 0)
+}
+
+// put stores a value and its catalogue record with an expiration time in Unix
+// nanoseconds, 0 for values that don't expire.
+func (d *MotrDatastore) put(key ds.Key, value []byte, expires int64) error {
+	d.locks.Lock(key)
+	defer d.locks.Unlock(key)
+	oid := d.getOID(key)
+	log.Debugf("Begin put key %v (OID %s) to catalogue and Motr index %s.", key, getOIDstr(oid), d.Idx)
+	stored, flags := d.encodeValue(key, value)
+	if d.live != nil {
+		d.live.add(oid)
+	}
+	if emotr := d.Index.Put(oid, stored, true); emotr != nil {
 		log.Errorf("Error putting key %v (OID) %s to Motr index %s: %s.", key, getOIDstr(oid), d.Idx, emotr)
 		return emotr
 	}
-	if eldb := d.Ldb.Put(key.Bytes(), []byte{1}, &opt.WriteOptions{}); eldb != nil {
-		log.Errorf("Error putting key %v to LevelDB: %s", key, eldb)
+	if d.cache != nil {
+		d.cache.Remove(key.String())
+	}
+	rec := newRecord(value)
+	rec.Flags = flags
+	rec.Expires = expires
+	batch := new(leveldb.Batch)
+	batch.Put(key.Bytes(), rec.encode())
+	batch.Delete(corruptKey(key))
+	if expires != 0 {
+		batch.Put(expiryKey(expires, key.Bytes()), nil)
+	}
+	if eldb := d.Catalogue.Write(batch, &opt.WriteOptions{}); eldb != nil {
+		log.Errorf("Error putting key %v to catalogue: %s", key, eldb)
 		return eldb
 	} else {
-		log.Debugf("End (success) put key %v (OID %s) to LevelDB and Motr index %s.", key, getOIDstr(getOID(key)), d.Idx)
+		log.Debugf("End (success) put key %v (OID %s) to catalogue and Motr index %s.", key, getOIDstr(d.getOID(key)), d.Idx)
 		return nil
 	}
 }
 
 func (d *MotrDatastore) Delete(ctx context.Context, key ds.Key) (err error) {
-	d.Lock.Lock()
-	defer d.Lock.Unlock()
-	if eldb := d.Ldb.Delete(key.Bytes(), &opt.WriteOptions{}); eldb != nil {
-		log.Errorf("Error deleting key %v (OID %s) from LevelDB: %s", key, getOIDstr(getOID(key)), eldb)
+	d.locks.Lock(key)
+	defer d.locks.Unlock(key)
+	return d.delete(key)
+}
+
+func (d *MotrDatastore) delete(key ds.Key) error {
+	if d.cache != nil {
+		d.cache.Remove(key.String())
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(key.Bytes())
+	batch.Delete(corruptKey(key))
+	if eldb := d.Catalogue.Write(batch, &opt.WriteOptions{}); eldb != nil {
+		log.Errorf("Error deleting key %v (OID %s) from catalogue: %s", key, getOIDstr(d.getOID(key)), eldb)
 		return eldb
 	} else {
-		log.Debugf("Deleted key %v (OID %s) from LevelDB.", key, getOIDstr(getOID(key)))
+		log.Debugf("Deleted key %v (OID %s) from catalogue.", key, getOIDstr(d.getOID(key)))
+	}
+	if edel := d.Index.Delete(d.getOID(key)); edel != nil {
+		// Motr fails to delete keys that don't exist.
+		if has, ehas := d.Index.Has(d.getOID(key)); ehas == nil && !has {
+			return nil
+		}
+		return edel
 	}
-	return mkv.Delete(getOID(key))
+	return nil
 }
 
 func (d *MotrDatastore) Sync(ctx context.Context, prefix ds.Key) error {
@@ -240,24 +601,126 @@ func (d *MotrDatastore) DiskUsage(ctx context.Context) (uint64, error) {
 }
 
 func (d *MotrDatastore) Close() error {
-	d.Lock.Lock()
-	defer d.Lock.Unlock()
-	eclose := mkv.Close()
+	if d.stopSweep != nil {
+		close(d.stopSweep)
+		<-d.sweepDone
+	}
+	d.locks.LockAll()
+	defer d.locks.UnlockAll()
+	if d.cache != nil {
+		stats := d.cache.Stats()
+		log.Infof("Value cache hits: %v, misses: %v, entries: %v, size: %v bytes.", stats.Hits, stats.Misses, stats.Entries, stats.Size)
+	}
+	eclose := d.Index.Close()
 	log.Infof("Close Motr key-value index %v: %s.", d.Idx, eclose)
-	eclose = d.Ldb.Close()
-	log.Infof("Close LevelDB database: %s.", eclose)
+	eclose = d.Catalogue.Close()
+	log.Infof("Close catalogue: %s.", eclose)
 	return eclose
 }
 
+// FaultInjector returns the injector of the faults configured in Config.Faults, which
+// can be used to change them while the datastore is running, or nil if none were.
+func (d *MotrDatastore) FaultInjector() *mio.FaultInjector {
+	return d.faults
+}
+
+// CacheStats returns the hit and miss counts and size of the value cache.
+func (d *MotrDatastore) CacheStats() CacheStats {
+	if d.cache == nil {
+		return CacheStats{}
+	}
+	return d.cache.Stats()
+}
+
 func (d *MotrDatastore) Batch(ctx context.Context) (ds.Batch, error) {
 	return ds.NewBasicBatch(d), nil
 }
 
-func getOID(key ds.Key) []byte {
-	return hash128.Sum(key.Bytes())
+func (d *MotrDatastore) getRecord(key ds.Key) (record, error) {
+	v, eldb := d.Catalogue.Get(key.Bytes(), nil)
+	if eldb == leveldb.ErrNotFound {
+		return record{}, ds.ErrNotFound
+	} else if eldb != nil {
+		return record{}, eldb
+	}
+	rec, erec := decodeRecord(v)
+	if erec == nil && rec.expired(time.Now()) {
+		return record{}, ds.ErrNotFound
+	}
+	return rec, erec
+}
+
+// MigrateCatalogue rewrites catalogue records written before the catalogue stored
+// value sizes and checksums, reading each such value once from Motr. Keys whose value
+// is missing from Motr are recorded as corrupt and keep their legacy record.
+func (d *MotrDatastore) MigrateCatalogue() error {
+	d.locks.LockAll()
+	defer d.locks.UnlockAll()
+	if v, ever := d.Catalogue.Get(catalogueVersionKey, nil); ever == nil && len(v) == 1 && v[0] == recordVersion {
+		return nil
+	} else if ever != nil && ever != leveldb.ErrNotFound {
+		return ever
+	}
+	log.Infof("Migrating catalogue to record version %v...", recordVersion)
+	i := d.Catalogue.NewIterator(util.BytesPrefix([]byte("/")), nil)
+	defer i.Release()
+	batch := new(leveldb.Batch)
+	migrated, missing := 0, 0
+	for i.Next() {
+		rec, erec := decodeRecord(i.Value())
+		if erec == nil && !rec.Legacy {
+			continue
+		}
+		key := ds.RawKey(string(i.Key()))
+		oid := d.getOID(key)
+		v, eget := d.Index.Get(oid)
+		if eget != nil {
+			if has, ehas := d.Index.Has(oid); ehas == nil && !has {
+				// The record stays legacy for Scrub to remove.
+				d.corrupt(key, "value is missing from Motr")
+				missing++
+				continue
+			}
+			log.Errorf("Error retrieving object OID %s for key %s from Motr during catalogue migration: %v.", getOIDstr(oid), key, eget)
+			return eget
+		}
+		batch.Put(append([]byte{}, i.Key()...), newRecord(v).encode())
+		migrated++
+		if batch.Len() >= 1000 {
+			if ew := d.Catalogue.Write(batch, nil); ew != nil {
+				return ew
+			}
+			batch.Reset()
+			log.Infof("Migrated %v catalogue records...", migrated)
+		}
+	}
+	if eit := i.Error(); eit != nil {
+		return eit
+	}
+	batch.Put(catalogueVersionKey, []byte{recordVersion})
+	if ew := d.Catalogue.Write(batch, nil); ew != nil {
+		return ew
+	}
+	log.Infof("Migrated %v catalogue records to record version %v.", migrated, recordVersion)
+	if missing > 0 {
+		log.Warnf("%v catalogue records have no value in Motr and were recorded as corrupt, scrub the datastore to remove them.", missing)
+	}
+	return nil
+}
+
+func (d *MotrDatastore) getOID(key ds.Key) []byte {
+	return d.keys.MotrKey(key)
+}
+
+// MotrKey returns the key of the Motr index record holding the value of key.
+func (d *MotrDatastore) MotrKey(key ds.Key) []byte {
+	return d.getOID(key)
 }
 
 func getOIDstr(oid []byte) string {
+	if len(oid) != 16 {
+		return fmt.Sprintf("0x%x", oid)
+	}
 	u := uint128.FromBytes(oid)
 	return fmt.Sprintf("0x%x:0x%x", u.Hi, u.Lo)
 }
@@ -0,0 +1,158 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// TestConcurrentKeyOperations races puts, deletes and reads of a small set of keys and
+// checks that every read sees a whole value written to that key, and that afterwards
+// the catalogue and Motr agree on every key.
+func TestConcurrentKeyOperations(t *testing.T) {
+	d := testDatastore(t)
+	ctx := context.Background()
+	const nkeys, workers, ops = 16, 32, 500
+	keys := make([]ds.Key, nkeys)
+	for k := range keys {
+		keys[k] = ds.NewKey(fmt.Sprintf("/stress/%d", k))
+	}
+	// Values are the key followed by a writer-specific suffix so a read can be checked
+	// against the key it was read from.
+	valueOf := func(key ds.Key, w, i int) []byte {
+		return []byte(fmt.Sprintf("%s|%d|%d|%s", key, w, i, bytes.Repeat([]byte{'x'}, rand.Intn(256))))
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < ops; i++ {
+				key := keys[r.Intn(nkeys)]
+				var err error
+				switch r.Intn(4) {
+				case 0:
+					err = d.Put(ctx, key, valueOf(key, w, i))
+				case 1:
+					err = d.Delete(ctx, key)
+				default:
+					var v []byte
+					if v, err = d.Get(ctx, key); err == ds.ErrNotFound {
+						err = nil
+					} else if err == nil && !bytes.HasPrefix(v, []byte(key.String()+"|")) {
+						err = fmt.Errorf("read value %q at key %s", v, key)
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		has, ehas := d.Has(ctx, key)
+		if ehas != nil {
+			t.Fatal(ehas)
+		}
+		v, eget := d.Get(ctx, key)
+		if has != (eget == nil) {
+			t.Fatalf("Has(%s) = %v but Get returned %v", key, has, eget)
+		} else if eget != nil && eget != ds.ErrNotFound {
+			t.Fatal(eget)
+		}
+		onMotr, emotr := d.Index.Has(d.getOID(key))
+		if emotr != nil {
+			t.Fatal(emotr)
+		}
+		if onMotr != has {
+			t.Fatalf("key %s is catalogued: %v but stored in Motr: %v", key, has, onMotr)
+		}
+		if !has {
+			continue
+		}
+		if size, esize := d.GetSize(ctx, key); esize != nil || size != len(v) {
+			t.Fatalf("GetSize(%s) = %d, %v for a value of %d bytes", key, size, esize, len(v))
+		}
+	}
+}
+
+// TestConcurrentTransactions increments counters in concurrent read-modify-write
+// transactions, retrying on conflicts, and checks that no increment is lost.
+func TestConcurrentTransactions(t *testing.T) {
+	d := testDatastore(t)
+	ctx := context.Background()
+	const counters, workers, ops = 4, 16, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < ops; i++ {
+				key := ds.NewKey(fmt.Sprintf("/counter/%d", r.Intn(counters)))
+				for {
+					err := increment(ctx, d, key)
+					if err == nil {
+						break
+					} else if err != ErrTxnConflict {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	total := 0
+	for c := 0; c < counters; c++ {
+		v, err := d.Get(ctx, ds.NewKey(fmt.Sprintf("/counter/%d", c)))
+		if err == ds.ErrNotFound {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		fmt.Sscan(string(v), &n)
+		total += n
+	}
+	if total != workers*ops {
+		t.Fatalf("counters add up to %d after %d increments", total, workers*ops)
+	}
+}
+
+func increment(ctx context.Context, d *MotrDatastore, key ds.Key) error {
+	txn, err := d.NewTransaction(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard(ctx)
+	n := 0
+	if v, err := txn.Get(ctx, key); err == nil {
+		fmt.Sscan(string(v), &n)
+	} else if err != ds.ErrNotFound {
+		return err
+	}
+	if err := txn.Put(ctx, key, []byte(fmt.Sprint(n+1))); err != nil {
+		return err
+	}
+	return txn.Commit(ctx)
+}
@@ -0,0 +1,654 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dstest "github.com/ipfs/go-datastore/test"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/allisterb/go-ds-motr/mio"
+)
+
+// Number of Motr indexes created by tests, used to give each its own.
+var testIndexes uint32
+
+// newTestIndex returns an index no other test uses. Indexes follow the one given by
+// MOTRDS_TEST_INDEX when tests run on a Motr cluster.
+func newTestIndex() string {
+	var hi, lo uint64 = 0x7800000000000000, 0
+	if base := os.Getenv("MOTRDS_TEST_INDEX"); base != "" && testCluster() {
+		if _, err := fmt.Sscanf(base, "0x%x:0x%x", &hi, &lo); err != nil {
+			panic(fmt.Sprintf("MOTRDS_TEST_INDEX %s is not an index fid", base))
+		}
+	}
+	return fmt.Sprintf("0x%x:0x%x", hi, lo+uint64(atomic.AddUint32(&testIndexes, 1)))
+}
+
+// testCluster returns true when the MOTRDS_TEST_* environment variables opt in to
+// running tests on a Motr cluster.
+func testCluster() bool {
+	for _, v := range []string{"MOTRDS_TEST_LOCAL_ADDR", "MOTRDS_TEST_HAX_ADDR", "MOTRDS_TEST_PROFILE_FID", "MOTRDS_TEST_PROCESS_FID", "MOTRDS_TEST_INDEX"} {
+		if os.Getenv(v) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// testConfig returns the configuration of a datastore with a LevelDB catalogue in a
+// temporary directory on a new index, of the Motr cluster given by the MOTRDS_TEST_*
+// environment variables or of the in-memory Motr backend when they are not set. The
+// index is created if it doesn't exist.
+func testConfig(t testing.TB) Config {
+	conf := Config{
+		Idx:         newTestIndex(),
+		LevelDBPath: t.TempDir(),
+		CreateIndex: true,
+	}
+	if testCluster() {
+		conf.LocalAddr = os.Getenv("MOTRDS_TEST_LOCAL_ADDR")
+		conf.HaxAddr = os.Getenv("MOTRDS_TEST_HAX_ADDR")
+		conf.ProfileFid = os.Getenv("MOTRDS_TEST_PROFILE_FID")
+		conf.LocalProcessFid = os.Getenv("MOTRDS_TEST_PROCESS_FID")
+	} else {
+		conf.Backend = mio.MemoryBackend
+	}
+	return conf
+}
+
+func openTestDatastore(t testing.TB, conf Config) *MotrDatastore {
+	d, err := NewMotrDatastore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// testDatastore opens a datastore with testConfig that is closed when the test ends.
+func testDatastore(t testing.TB) *MotrDatastore {
+	d := openTestDatastore(t, testConfig(t))
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// TestSuite runs the go-datastore conformance tests against the datastore with each
+// catalogue backend. The slow combinations test is skipped for the Badger catalogue
+// in short mode unless the tests run on a Motr cluster.
+func TestSuite(t *testing.T) {
+	for _, backend := range CatalogueBackends {
+		t.Run(backend, func(t *testing.T) {
+			conf := testConfig(t)
+			conf.CatalogueBackend = backend
+			if backend == MotrCatalogue {
+				if conf.Backend != mio.MemoryBackend {
+					t.Skip("the Motr catalogue is only tested on the in-memory Motr backend")
+				}
+				conf.CatalogueIdx = newTestIndex()
+			}
+			d := openTestDatastore(t, conf)
+			defer d.Close()
+			run := func(name string, f func(t *testing.T)) {
+				t.Run(name, func(t *testing.T) {
+					f(t)
+					clearTestDatastore(t, d)
+				})
+			}
+			combinations := reflect.ValueOf(dstest.SubtestCombinations).Pointer()
+			for _, f := range dstest.BasicSubtests {
+				f := f
+				fp := reflect.ValueOf(f).Pointer()
+				if fp == combinations && backend == BadgerCatalogue && testing.Short() && !testCluster() {
+					continue
+				}
+				run(runtime.FuncForPC(fp).Name(), func(t *testing.T) { f(t, d) })
+			}
+			for _, f := range dstest.BatchSubtests {
+				f := f
+				run(runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name(), func(t *testing.T) { f(t, d) })
+			}
+		})
+	}
+}
+
+// clearTestDatastore deletes every key of the datastore between conformance tests.
+func clearTestDatastore(t *testing.T, d *MotrDatastore) {
+	ctx := context.Background()
+	q, err := d.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := q.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range res {
+		if err := d.Delete(ctx, ds.RawKey(r.Key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestReopen checks that values and deletes survive closing and opening the
+// datastore again.
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/reopen/%d", i)), []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Delete(ctx, ds.NewKey("/reopen/0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	if has, err := d.Has(ctx, ds.NewKey("/reopen/0")); err != nil || has {
+		t.Fatalf("deleted key: Has = %v, %v", has, err)
+	}
+	for i := 1; i < 100; i++ {
+		key := ds.NewKey(fmt.Sprintf("/reopen/%d", i))
+		if v, err := d.Get(ctx, key); err != nil || string(v) != fmt.Sprintf("value %d", i) {
+			t.Fatalf("Get(%s) = %q, %v", key, v, err)
+		}
+	}
+}
+
+// TestTwoDatastores checks that datastores open at the same time on different
+// indexes each read and write their own index.
+func TestTwoDatastores(t *testing.T) {
+	ctx := context.Background()
+	confA, confB := testConfig(t), testConfig(t)
+	if confA.Idx == confB.Idx {
+		t.Skip("needs two Motr indexes")
+	}
+	a, b := openTestDatastore(t, confA), openTestDatastore(t, confB)
+	defer b.Close()
+	key := ds.NewKey("/two/key")
+	if err := a.Put(ctx, key, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, key, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Put(ctx, ds.NewKey("/two/a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	for d, want := range map[*MotrDatastore]string{a: "a", b: "b"} {
+		if v, err := d.Get(ctx, key); err != nil || string(v) != want {
+			t.Fatalf("Get(%s) on index %s = %q, %v, want %q", key, d.Idx, v, err, want)
+		}
+		if v, err := d.Index.Get(d.getOID(key)); err != nil || !bytes.Contains(v, []byte(want)) {
+			t.Fatalf("index %s holds %q, %v for %s, want %q", d.Idx, v, err, key, want)
+		}
+	}
+	if has, err := b.Index.Has(b.getOID(ds.NewKey("/two/a"))); err != nil || has {
+		t.Fatalf("index %s holds a value put in index %s: %v, %v", b.Idx, a.Idx, has, err)
+	}
+	if err := b.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Get(ctx, key); err != nil || string(v) != "a" {
+		t.Fatalf("Get(%s) on index %s = %q, %v after deleting it from index %s", key, a.Idx, v, err, b.Idx)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.GetSize(ctx, ds.NewKey("/two/b")); err != ds.ErrNotFound {
+		t.Fatalf("GetSize on index %s = %d, %v after closing index %s", b.Idx, v, err, a.Idx)
+	}
+	if err := b.Put(ctx, key, []byte("b")); err != nil {
+		t.Fatalf("Put on index %s failed after closing index %s: %v", b.Idx, a.Idx, err)
+	}
+}
+
+// TestMigrateCatalogue checks that records of a catalogue written before records
+// held value sizes and checksums are rebuilt from their values when the datastore
+// is opened, and that opening the migrated catalogue again changes nothing.
+func TestMigrateCatalogue(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	values := map[ds.Key][]byte{}
+	for i := 0; i < 20; i++ {
+		key := ds.NewKey(fmt.Sprintf("/legacy/%d", i))
+		values[key] = []byte(fmt.Sprintf("legacy value %d", i))
+		if err := d.Put(ctx, key, values[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A legacy key whose value is missing from Motr doesn't stop the migration.
+	missing := ds.NewKey("/legacy/missing")
+	if err := d.Put(ctx, missing, []byte("missing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Index.Delete(d.getOID(missing)); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	db, err := leveldb.OpenFile(conf.LevelDBPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := new(leveldb.Batch)
+	for key := range values {
+		batch.Put(key.Bytes(), []byte{legacyRecordVersion})
+	}
+	batch.Put(missing.Bytes(), []byte{legacyRecordVersion})
+	batch.Delete(catalogueVersionKey)
+	if err := db.Write(batch, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	d = openTestDatastore(t, conf)
+	if v, err := d.Catalogue.Get(catalogueVersionKey, nil); err != nil || len(v) != 1 || v[0] != recordVersion {
+		t.Fatalf("catalogue version is %x, %v", v, err)
+	}
+	records := map[ds.Key][]byte{}
+	for key, value := range values {
+		v, err := d.Catalogue.Get(key.Bytes(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec, err := decodeRecord(v); err != nil || rec != newRecord(value) {
+			t.Fatalf("record of %s is %+v, %v, want %+v", key, rec, err, newRecord(value))
+		}
+		records[key] = v
+	}
+	if corrupt, err := d.CorruptKeys(); err != nil || len(corrupt) != 1 || corrupt[missing].IsZero() {
+		t.Fatalf("CorruptKeys = %v, %v after migrating a key whose value is missing", corrupt, err)
+	}
+	if v, err := d.Catalogue.Get(missing.Bytes(), nil); err != nil || len(v) != 1 || v[0] != legacyRecordVersion {
+		t.Fatalf("record of %s is %x, %v after migration", missing, v, err)
+	}
+	d.Close()
+
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	for key, want := range records {
+		if v, err := d.Catalogue.Get(key.Bytes(), nil); err != nil || !bytes.Equal(v, want) {
+			t.Fatalf("record of %s changed from %x to %x, %v on reopening", key, want, v, err)
+		}
+		if v, err := d.Get(ctx, key); err != nil || !bytes.Equal(v, values[key]) {
+			t.Fatalf("Get(%s) = %q, %v", key, v, err)
+		}
+	}
+}
+
+// TestIndexFormat checks that the index format is recorded and that indexes with
+// another format, new indexes used with an existing catalogue, or indexes that
+// don't exist when createIndex isn't set, are refused.
+func TestIndexFormat(t *testing.T) {
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	if v, err := d.Index.Get(indexFormatKey); err != nil || string(v) != string([]byte{IndexFormat}) {
+		t.Fatalf("recorded index format %x, %v", v, err)
+	}
+	if err := d.Put(context.Background(), ds.NewKey("/format"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Index.Put(indexFormatKey, []byte{IndexFormat + 1}, true); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if d, err := NewMotrDatastore(conf); err == nil {
+		d.Close()
+		t.Fatal("opened an index with an unsupported format")
+	}
+
+	if conf.Backend != mio.MemoryBackend {
+		t.Skip("new indexes are only tested on the in-memory Motr backend")
+	}
+	conf.Idx = newTestIndex()
+	if d, err := NewMotrDatastore(conf); err == nil {
+		d.Close()
+		t.Fatal("opened a new index with the catalogue of another index")
+	}
+	conf.Idx, conf.CreateIndex, conf.LevelDBPath = newTestIndex(), false, t.TempDir()
+	if d, err := NewMotrDatastore(conf); err == nil {
+		d.Close()
+		t.Fatal("opened an index that doesn't exist without createIndex")
+	}
+}
+
+// TestReadOnly checks that a datastore opened read-only can be read but refuses
+// writes, and leaves legacy records, undo log entries and expired entries alone.
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	key, expired := ds.NewKey("/ro/key"), ds.NewKey("/ro/expired")
+	if err := d.Put(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutWithTTL(ctx, expired, []byte("value"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	db, err := leveldb.OpenFile(conf.LevelDBPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undo := append(append([]byte{}, undoPrefix...), "/ro/undone"...)
+	batch := new(leveldb.Batch)
+	batch.Put(key.Bytes(), []byte{legacyRecordVersion})
+	batch.Delete(catalogueVersionKey)
+	batch.Put(undo, []byte{0})
+	if err := db.Write(batch, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	conf.ReadOnly = true
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	if d.stopSweep != nil {
+		t.Fatal("started the TTL sweeper")
+	}
+	if v, err := d.Get(ctx, key); err != nil || string(v) != "value" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+	if r, err := d.Query(ctx, query.Query{Prefix: "/ro"}); err != nil {
+		t.Fatal(err)
+	} else if es, err := r.Rest(); err != nil || len(es) != 1 {
+		t.Fatalf("query returned %v, %v", es, err)
+	}
+	if err := d.Put(ctx, ds.NewKey("/ro/new"), []byte("value")); err != ErrReadOnly {
+		t.Fatalf("Put returned %v", err)
+	}
+	if err := d.Delete(ctx, key); err != ErrReadOnly {
+		t.Fatalf("Delete returned %v", err)
+	}
+	txn, _ := d.NewTransaction(ctx, false)
+	txn.Put(ctx, key, []byte("txn"))
+	if err := txn.Commit(ctx); err != ErrReadOnly {
+		t.Fatalf("Commit returned %v", err)
+	}
+	if v, err := d.Catalogue.Get(key.Bytes(), nil); err != nil || len(v) != 1 || v[0] != legacyRecordVersion {
+		t.Fatalf("legacy record of %s is %x, %v", key, v, err)
+	}
+	for _, k := range [][]byte{undo, expired.Bytes()} {
+		if has, err := d.Catalogue.Has(k, nil); err != nil || !has {
+			t.Fatalf("catalogue entry %q removed: %v, %v", k, has, err)
+		}
+	}
+}
+
+// TestCrashDuringPut simulates a crash between writing a value to Motr and its
+// catalogue record: the key must not exist after reopening, and garbage collection
+// must remove the value from Motr.
+func TestCrashDuringPut(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	key := ds.NewKey("/crash/put")
+	stored, _ := d.encodeValue(key, []byte("half-written"))
+	if err := d.Index.Put(d.getOID(key), stored, true); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	if has, err := d.Has(ctx, key); err != nil || has {
+		t.Fatalf("Has = %v, %v after a crashed put", has, err)
+	}
+	if _, err := d.Get(ctx, key); err != ds.ErrNotFound {
+		t.Fatalf("Get returned %v after a crashed put", err)
+	}
+	if err := d.CollectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := d.Index.Has(d.getOID(key)); err != nil || has {
+		t.Fatalf("orphaned value still in Motr after garbage collection: %v, %v", has, err)
+	}
+}
+
+// TestCrashDuringDelete simulates a crash between deleting a catalogue record and its
+// Motr value.
+func TestCrashDuringDelete(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	key := ds.NewKey("/crash/delete")
+	if err := d.Put(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Catalogue.Delete(key.Bytes(), nil); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	if has, err := d.Has(ctx, key); err != nil || has {
+		t.Fatalf("Has = %v, %v after a crashed delete", has, err)
+	}
+	if err := d.Put(ctx, key, []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get(ctx, key); err != nil || string(v) != "new value" {
+		t.Fatalf("Get = %q, %v after putting a key again", v, err)
+	}
+}
+
+// TestCrashDuringCommit simulates a crash after a transaction wrote its values to
+// Motr but before it committed its catalogue records: reopening must restore the
+// values the transaction overwrote and remove the ones it added.
+func TestCrashDuringCommit(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	existing, added := ds.NewKey("/crash/txn/existing"), ds.NewKey("/crash/txn/added")
+	if err := d.Put(ctx, existing, []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	old, err := d.Index.Get(d.getOID(existing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What Commit writes before its catalogue batch.
+	if err := d.Catalogue.Put(append(append([]byte{}, undoPrefix...), existing.Bytes()...), append([]byte{1}, old...), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Catalogue.Put(append(append([]byte{}, undoPrefix...), added.Bytes()...), []byte{0}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []ds.Key{existing, added} {
+		stored, _ := d.encodeValue(key, []byte("uncommitted"))
+		if err := d.Index.Put(d.getOID(key), stored, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Close()
+
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	if v, err := d.Get(ctx, existing); err != nil || string(v) != "before" {
+		t.Fatalf("Get = %q, %v after a crashed commit", v, err)
+	}
+	if has, err := d.Index.Has(d.getOID(added)); err != nil || has {
+		t.Fatalf("value added by a crashed commit still in Motr: %v, %v", has, err)
+	}
+	if has, err := d.Has(ctx, added); err != nil || has {
+		t.Fatalf("Has = %v, %v for a key added by a crashed commit", has, err)
+	}
+}
+
+// testDatastoreWithFaults opens a test datastore and injects faults into its Motr
+// operations once it's open.
+func testDatastoreWithFaults(t *testing.T, faults []mio.Fault) (*MotrDatastore, *mio.FaultInjector) {
+	conf := testConfig(t)
+	// A fault without effects enables injection.
+	conf.Faults = []mio.Fault{{}}
+	d := openTestDatastore(t, conf)
+	fi := d.FaultInjector()
+	t.Cleanup(func() {
+		fi.SetFaults(nil)
+		d.Close()
+	})
+	if err := fi.SetFaults(faults); err != nil {
+		t.Fatal(err)
+	}
+	return d, fi
+}
+
+func oidPattern(d *MotrDatastore, key ds.Key) string {
+	return "^" + regexp.QuoteMeta(getOIDstr(d.getOID(key))) + "$"
+}
+
+// TestFailedPuts checks that puts whose Motr write fails, alone or midway through a
+// batch, leave no trace of their keys.
+func TestFailedPuts(t *testing.T) {
+	ctx := context.Background()
+	d, fi := testDatastoreWithFaults(t, []mio.Fault{{Ops: []string{mio.OpPut}, Error: "no space"}})
+	key := ds.NewKey("/fault/put")
+	if err := d.Put(ctx, key, []byte("value")); !errors.Is(err, mio.ErrInjected) {
+		t.Fatalf("Put returned %v", err)
+	}
+	if has, err := d.Has(ctx, key); err != nil || has {
+		t.Fatalf("Has = %v, %v after a failed put", has, err)
+	}
+
+	fi.SetFaults([]mio.Fault{{Ops: []string{mio.OpPut}, After: 5, Count: 1, Error: "no space"}})
+	b, _ := d.Batch(ctx)
+	for i := 0; i < 10; i++ {
+		b.Put(ctx, ds.NewKey(fmt.Sprintf("/fault/batch/%d", i)), []byte(fmt.Sprintf("value %d", i)))
+	}
+	if err := b.Commit(ctx); !errors.Is(err, mio.ErrInjected) {
+		t.Fatalf("Commit returned %v", err)
+	}
+	stored := 0
+	for i := 0; i < 10; i++ {
+		if v, err := d.Get(ctx, ds.NewKey(fmt.Sprintf("/fault/batch/%d", i))); err == nil {
+			if string(v) != fmt.Sprintf("value %d", i) {
+				t.Fatalf("Get = %q", v)
+			}
+			stored++
+		} else if err != ds.ErrNotFound {
+			t.Fatal(err)
+		}
+	}
+	if stored != 5 {
+		t.Fatalf("%d values of a batch failing on its 6th put were stored", stored)
+	}
+}
+
+// TestFailedDelete checks that a key whose Motr record can't be deleted is gone from
+// the datastore, and that garbage collection removes the record later.
+func TestFailedDelete(t *testing.T) {
+	ctx := context.Background()
+	d, fi := testDatastoreWithFaults(t, []mio.Fault{{Ops: []string{mio.OpDelete}, Error: "timeout"}})
+	key := ds.NewKey("/fault/delete")
+	if err := d.Put(ctx, key, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, key); !errors.Is(err, mio.ErrInjected) {
+		t.Fatalf("Delete returned %v", err)
+	}
+	if has, err := d.Has(ctx, key); err != nil || has {
+		t.Fatalf("Has = %v, %v after a failed delete", has, err)
+	}
+	fi.SetFaults(nil)
+	if err := d.CollectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := d.Index.Has(d.getOID(key)); err != nil || has {
+		t.Fatalf("record of deleted key still in Motr after garbage collection: %v, %v", has, err)
+	}
+}
+
+// TestHangingKey checks that an operation hanging in Motr only blocks its own key.
+func TestHangingKey(t *testing.T) {
+	ctx := context.Background()
+	d, fi := testDatastoreWithFaults(t, nil)
+	stuck, other := ds.NewKey("/fault/stuck"), ds.NewKey("/fault/other")
+	for _, key := range []ds.Key{stuck, other} {
+		if err := d.Put(ctx, key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi.SetFaults([]mio.Fault{{Ops: []string{mio.OpGet}, Keys: oidPattern(d, stuck), Hang: true}})
+	done := make(chan error)
+	go func() {
+		_, err := d.Get(ctx, stuck)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if v, err := d.Get(ctx, other); err != nil || string(v) != "value" {
+		t.Fatalf("Get of another key = %q, %v while a get hangs", v, err)
+	}
+	if err := d.Put(ctx, other, []byte("new value")); err != nil {
+		t.Fatalf("Put of another key failed while a get hangs: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("hanging get returned %v", err)
+	default:
+	}
+	fi.SetFaults(nil)
+	if err := <-done; err != nil {
+		t.Fatalf("released get returned %v", err)
+	}
+}
+
+// TestFailedConcurrentCommit checks that a transaction whose commit fails only rolls
+// back its own values, and not those of a transaction committing at the same time.
+func TestFailedConcurrentCommit(t *testing.T) {
+	ctx := context.Background()
+	d, fi := testDatastoreWithFaults(t, nil)
+	ka1, ka2 := ds.NewKey("/fault/txn/a1"), ds.NewKey("/fault/txn/a2")
+	kb1, kb2 := ds.NewKey("/fault/txn/b1"), ds.NewKey("/fault/txn/b2")
+	for _, key := range []ds.Key{ka1, ka2, kb1, kb2} {
+		if err := d.Put(ctx, key, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// B hangs after putting one of its values in Motr, while A fails putting ka2.
+	fi.SetFaults([]mio.Fault{
+		{Ops: []string{mio.OpPut}, Keys: oidPattern(d, kb1) + "|" + oidPattern(d, kb2), After: 1, Count: 1, Hang: true},
+		{Ops: []string{mio.OpPut}, Keys: oidPattern(d, ka2), Count: 1, Error: "no space"},
+	})
+	b, _ := d.NewTransaction(ctx, false)
+	b.Put(ctx, kb1, []byte("new"))
+	b.Put(ctx, kb2, []byte("new"))
+	done := make(chan error)
+	go func() {
+		done <- b.Commit(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	a, _ := d.NewTransaction(ctx, false)
+	a.Put(ctx, ka1, []byte("new"))
+	a.Put(ctx, ka2, []byte("new"))
+	if err := a.Commit(ctx); !errors.Is(err, mio.ErrInjected) {
+		t.Fatalf("Commit of failing transaction returned %v", err)
+	}
+	fi.SetFaults(nil)
+	if err := <-done; err != nil {
+		t.Fatalf("Commit of concurrent transaction returned %v", err)
+	}
+	for key, want := range map[ds.Key]string{ka1: "old", ka2: "old", kb1: "new", kb2: "new"} {
+		if v, err := d.Get(ctx, key); err != nil || string(v) != want {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+}
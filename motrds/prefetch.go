@@ -0,0 +1,83 @@
+package motrds
+
+import (
+	"sync"
+
+	query "github.com/ipfs/go-datastore/query"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+)
+
+// prefetched is the result of a catalogue entry, skipped when not ok.
+type prefetched struct {
+	query.Result
+	ok bool
+}
+
+// prefetchResults returns the results of a query whose objects are fetched from Motr
+// by up to QueryPrefetch concurrent workers reading ahead of the consumer. Results
+// are returned in catalogue iteration order.
+func (d *MotrDatastore) prefetchResults(q query.Query, i iterator.Iterator, next func() bool) query.Results {
+	pending := make(chan chan prefetched, d.QueryPrefetch)
+	slots := make(chan struct{}, d.QueryPrefetch)
+	done := make(chan struct{})
+	var closeOnce sync.Once
+	var workers sync.WaitGroup
+
+	// The iterator is only used by this goroutine, which also releases it.
+	go func() {
+		defer close(pending)
+		defer i.Release()
+		for next() && i.Key() != nil {
+			key := append([]byte{}, i.Key()...)
+			value := append([]byte{}, i.Value()...)
+			res := make(chan prefetched, 1)
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case pending <- res:
+			case <-done:
+				<-slots
+				return
+			}
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				defer func() { <-slots }()
+				r, ok := d.queryResult(q, key, value)
+				res <- prefetched{r, ok}
+			}()
+		}
+		if eit := i.Error(); eit != nil {
+			log.Errorf("Error iterating catalogue: %v.", eit)
+			res := make(chan prefetched, 1)
+			res <- prefetched{query.Result{Error: eit}, true}
+			select {
+			case pending <- res:
+			case <-done:
+			}
+		}
+	}()
+
+	return query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			for res := range pending {
+				if p := <-res; p.ok {
+					return p.Result, true
+				}
+			}
+			return query.Result{}, false
+		},
+		Close: func() error {
+			closeOnce.Do(func() {
+				close(done)
+				for range pending {
+				}
+				workers.Wait()
+			})
+			return nil
+		},
+	})
+}
@@ -0,0 +1,299 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/allisterb/go-ds-motr/mio"
+)
+
+// TestQueryPushdown checks that queries whose filters, orders, offsets and limits are
+// applied while iterating the catalogue, and queries left to the naive
+// implementation, return what query.NaiveQueryApply returns for all entries.
+func TestQueryPushdown(t *testing.T) {
+	ctx := context.Background()
+	for _, prefetch := range []int{1, 4} {
+		conf := testConfig(t)
+		conf.QueryPrefetch = prefetch
+		d := openTestDatastore(t, conf)
+		defer d.Close()
+		var entries []query.Entry
+		for i, ns := range []string{"/q/a", "/q/ab", "/q/b", "/r"} {
+			for j := 0; j < 8; j++ {
+				key := ds.NewKey(fmt.Sprintf("%s/%d", ns, j))
+				value := []byte(fmt.Sprintf("%02d", (i*8+j)*7%32))
+				if err := d.Put(ctx, key, value); err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, query.Entry{Key: key.String(), Value: value, Size: len(value)})
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+		byValueDescending := query.OrderByFunction(func(a, b query.Entry) int { return strings.Compare(string(b.Value), string(a.Value)) })
+		for _, q := range []query.Query{
+			{},
+			{Prefix: "/q/a"},
+			{Prefix: "/q", Offset: 3, Limit: 5},
+			{Prefix: "/q", Limit: 4, Orders: []query.Order{query.OrderByKeyDescending{}}},
+			{Prefix: "/q", Offset: 2, Orders: []query.Order{&query.OrderByKey{}}},
+			{Filters: []query.Filter{query.FilterKeyPrefix{Prefix: "/q/b"}}, Limit: 3},
+			{Filters: []query.Filter{query.FilterKeyCompare{Op: query.GreaterThan, Key: "/q/ab/3"}}, Offset: 1, Limit: 6},
+			{Prefix: "/q", Filters: []query.Filter{query.FilterValueCompare{Op: query.LessThan, Value: []byte("16")}}, Offset: 1, Limit: 4},
+			{Filters: []query.Filter{query.FilterKeyPrefix{Prefix: "/q"}, query.FilterValueCompare{Op: query.GreaterThanOrEqual, Value: []byte("08")}}, Limit: 5, Orders: []query.Order{query.OrderByKeyDescending{}}},
+			{Prefix: "/q", Offset: 2, Limit: 5, Orders: []query.Order{query.OrderByValue{}}},
+			{Limit: 7, Orders: []query.Order{query.OrderByValueDescending{}, query.OrderByKey{}}},
+			{Prefix: "/q", Offset: 3, Orders: []query.Order{byValueDescending}},
+			{Prefix: "/q", Limit: 5, Orders: []query.Order{query.OrderByKey{}, query.OrderByValue{}}},
+			{Prefix: "/r", KeysOnly: true, ReturnsSizes: true, Offset: 2, Limit: 3},
+			{Prefix: "/q", Offset: 100},
+		} {
+			r, err := d.Query(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := query.NaiveQueryApply(q, query.ResultsWithEntries(q, entries)).Rest()
+			if fmt.Sprint(queryEntries(q, got)) != fmt.Sprint(queryEntries(q, want)) {
+				t.Errorf("%s with prefetch %d returned %v, want %v", q, prefetch, queryEntries(q, got), queryEntries(q, want))
+			}
+		}
+	}
+}
+
+// queryEntries describes the entries of a query result that the query asks for.
+func queryEntries(q query.Query, es []query.Entry) []string {
+	var out []string
+	for _, e := range es {
+		switch {
+		case !q.KeysOnly:
+			out = append(out, e.Key+"="+string(e.Value))
+		case q.ReturnsSizes:
+			out = append(out, fmt.Sprintf("%s:%d", e.Key, e.Size))
+		default:
+			out = append(out, e.Key)
+		}
+	}
+	return out
+}
+
+// TestQueryPrefetch checks that prefetched results are returned in catalogue order
+// when their Motr reads complete out of order, that a failed read is returned in
+// its place in the window, and that closing a query early stops its goroutines.
+func TestQueryPrefetch(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	conf.QueryPrefetch = 8
+	// A fault without effects enables injection.
+	conf.Faults = []mio.Fault{{}}
+	d := openTestDatastore(t, conf)
+	fi := d.FaultInjector()
+	defer func() {
+		fi.SetFaults(nil)
+		d.Close()
+	}()
+	var keys []ds.Key
+	for i := 0; i < 24; i++ {
+		key := ds.NewKey(fmt.Sprintf("/prefetch/%02d", i))
+		if err := d.Put(ctx, key, []byte(key.String())); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// The first reads of each window complete last.
+	var faults []mio.Fault
+	for i := 0; i < len(keys); i += 8 {
+		for j, latency := range []time.Duration{60, 40, 20} {
+			faults = append(faults, mio.Fault{Ops: []string{mio.OpGet}, Keys: oidPattern(d, keys[i+j]), Latency: latency * time.Millisecond})
+		}
+	}
+	if err := fi.SetFaults(faults); err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+	r, err := d.Query(ctx, query.Query{Prefix: "/prefetch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := r.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != len(keys) {
+		t.Fatalf("query returned %d entries, want %d", len(es), len(keys))
+	}
+	for i, e := range es {
+		if e.Key != keys[i].String() || string(e.Value) != e.Key {
+			t.Fatalf("entry %d is %s=%s, want %s", i, e.Key, e.Value, keys[i])
+		}
+	}
+
+	if err := fi.SetFaults(append(faults, mio.Fault{Ops: []string{mio.OpGet}, Keys: oidPattern(d, keys[5]), Error: "read failed"})); err != nil {
+		t.Fatal(err)
+	}
+	r, err = d.Query(ctx, query.Query{Prefix: "/prefetch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 5; i++ {
+		res, ok := r.NextSync()
+		switch {
+		case !ok:
+			t.Fatalf("query ended after %d results", i)
+		case i < 5 && (res.Error != nil || res.Key != keys[i].String()):
+			t.Fatalf("result %d is %s, %v, want %s", i, res.Key, res.Error, keys[i])
+		case i == 5 && res.Error == nil:
+			t.Fatalf("result %d is %s, want the read error", i, res.Key)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fi.SetFaults(faults); err != nil {
+		t.Fatal(err)
+	}
+	r, err = d.Query(ctx, query.Query{Prefix: "/prefetch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if res, ok := r.NextSync(); !ok || res.Error != nil {
+			t.Fatalf("result %d is %v, %v", i, res, ok)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running after closing the query", runtime.NumGoroutine()-before)
+		}
+	}
+}
+
+// failingCatalogue returns iterators that fail after limit entries.
+type failingCatalogue struct {
+	Catalogue
+	limit int
+}
+
+func (c failingCatalogue) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return &failingIterator{Iterator: c.Catalogue.NewIterator(slice, ro), limit: c.limit}
+}
+
+type failingIterator struct {
+	iterator.Iterator
+	limit int
+}
+
+func (i *failingIterator) Next() bool {
+	if i.limit == 0 {
+		return false
+	}
+	i.limit--
+	return i.Iterator.Next()
+}
+
+func (i *failingIterator) Error() error {
+	if i.limit == 0 {
+		return errors.New("catalogue went away")
+	}
+	return i.Iterator.Error()
+}
+
+// TestQueryIteratorError checks that an error iterating the catalogue is returned as
+// the last result of a query instead of ending it early.
+func TestQueryIteratorError(t *testing.T) {
+	ctx := context.Background()
+	for _, prefetch := range []int{1, 4} {
+		conf := testConfig(t)
+		conf.QueryPrefetch = prefetch
+		d := openTestDatastore(t, conf)
+		defer d.Close()
+		for i := 0; i < 8; i++ {
+			if err := d.Put(ctx, ds.NewKey(fmt.Sprintf("/failing/%d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d.Catalogue = failingCatalogue{d.Catalogue, 3}
+		for _, q := range []query.Query{{Prefix: "/failing"}, {Prefix: "/failing", KeysOnly: true}} {
+			r, err := d.Query(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var results []query.Result
+			for res := range r.Next() {
+				results = append(results, res)
+			}
+			if len(results) != 4 || results[2].Error != nil || results[3].Error == nil {
+				t.Fatalf("%s with prefetch %d returned %v, want 3 entries and the iterator error", q, prefetch, results)
+			}
+		}
+	}
+}
+
+// TestQueryConcurrentPut checks that values returned by queries match the records
+// they are verified against while the key is put concurrently.
+func TestQueryConcurrentPut(t *testing.T) {
+	ctx := context.Background()
+	for _, prefetch := range []int{1, 4} {
+		conf := testConfig(t)
+		conf.QueryPrefetch = prefetch
+		conf.VerifyValues = true
+		d := openTestDatastore(t, conf)
+		defer d.Close()
+		key := ds.NewKey("/concurrent/key")
+		values := [][]byte{[]byte("short"), []byte("a longer value")}
+		if err := d.Put(ctx, key, values[0]); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error)
+		go func() {
+			for i := 0; i < 2000; i++ {
+				if err := d.Put(ctx, key, values[i%2]); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+		for running := true; running; {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+				running = false
+			default:
+			}
+			r, err := d.Query(ctx, query.Query{Prefix: "/concurrent"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			es, err := r.Rest()
+			if err != nil {
+				t.Fatalf("query with prefetch %d failed while %s was put: %v", prefetch, key, err)
+			}
+			if len(es) != 1 || !bytes.Equal(es[0].Value, values[0]) && !bytes.Equal(es[0].Value, values[1]) {
+				t.Fatalf("query with prefetch %d returned %v", prefetch, es)
+			}
+		}
+	}
+}
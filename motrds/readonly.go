@@ -0,0 +1,48 @@
+package motrds
+
+import (
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/allisterb/go-ds-motr/mio"
+)
+
+// ErrReadOnly is returned by writes to a datastore opened with Config.ReadOnly.
+var ErrReadOnly = errors.New("motrds: datastore is read-only")
+
+// readOnlyIndex refuses writes to the Motr index of a read-only datastore.
+type readOnlyIndex struct {
+	mio.Index
+}
+
+func (i readOnlyIndex) Put(key []byte, value []byte, update bool) error {
+	return ErrReadOnly
+}
+
+func (i readOnlyIndex) Delete(key []byte) error {
+	return ErrReadOnly
+}
+
+// readOnlyCatalogue refuses writes to the catalogue of a read-only datastore.
+type readOnlyCatalogue struct {
+	Catalogue
+}
+
+func (c readOnlyCatalogue) Put(key []byte, value []byte, wo *opt.WriteOptions) error {
+	return ErrReadOnly
+}
+
+func (c readOnlyCatalogue) Delete(key []byte, wo *opt.WriteOptions) error {
+	return ErrReadOnly
+}
+
+func (c readOnlyCatalogue) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	return ErrReadOnly
+}
+
+func (c readOnlyCatalogue) CompactRange(r util.Range) error {
+	return ErrReadOnly
+}
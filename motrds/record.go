@@ -0,0 +1,87 @@
+package motrds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Catalogue records are stored as the catalogue value for each datastore key:
+//
+//	version (1 byte) | flags (1 byte) | value size (uvarint) | CRC-32C of value (4 bytes)
+//
+// followed by the expiration time in Unix nanoseconds (8 bytes) for records with
+// the recordExpires flag.
+//
+// Repos written before records carried any metadata store the single byte 0x01.
+const (
+	legacyRecordVersion = 1
+	recordVersion       = 2
+)
+
+// Catalogue key holding the catalogue format version. Datastore keys always
+// start with '/' so this can never collide with a datastore key.
+var catalogueVersionKey = []byte("\x00motrds/catalogue-version")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var errBadRecord = errors.New("motrds: malformed catalogue record")
+
+type record struct {
+	Legacy   bool
+	Flags    byte
+	Size     int
+	Checksum uint32
+	// Expiration time in Unix nanoseconds, 0 for values that don't expire.
+	Expires int64
+}
+
+func newRecord(value []byte) record {
+	return record{Size: len(value), Checksum: crc32.Checksum(value, crc32c)}
+}
+
+func (r record) encode() []byte {
+	buf := make([]byte, 2+binary.MaxVarintLen64+4+8)
+	buf[0] = recordVersion
+	buf[1] = r.Flags &^ recordExpires
+	n := 2 + binary.PutUvarint(buf[2:], uint64(r.Size))
+	binary.BigEndian.PutUint32(buf[n:], r.Checksum)
+	n += 4
+	if r.Expires != 0 {
+		buf[1] |= recordExpires
+		binary.BigEndian.PutUint64(buf[n:], uint64(r.Expires))
+		n += 8
+	}
+	return buf[:n]
+}
+
+func decodeRecord(b []byte) (record, error) {
+	if len(b) == 1 && b[0] == legacyRecordVersion {
+		return record{Legacy: true, Size: -1}, nil
+	}
+	if len(b) < 2 || b[0] != recordVersion {
+		return record{}, errBadRecord
+	}
+	size, n := binary.Uvarint(b[2:])
+	expires := b[1]&recordExpires != 0
+	if n <= 0 || (!expires && len(b) != 2+n+4) || (expires && len(b) != 2+n+4+8) {
+		return record{}, errBadRecord
+	}
+	r := record{Flags: b[1], Size: int(size), Checksum: binary.BigEndian.Uint32(b[2+n:])}
+	if expires {
+		r.Expires = int64(binary.BigEndian.Uint64(b[2+n+4:]))
+	}
+	return r, nil
+}
+
+func (r record) String() string {
+	if r.Legacy {
+		return "legacy"
+	}
+	if r.Expires != 0 {
+		return fmt.Sprintf("size=%d crc32c=0x%08x expires=%s", r.Size, r.Checksum, time.Unix(0, r.Expires).Format(time.RFC3339))
+	}
+	return fmt.Sprintf("size=%d crc32c=0x%08x", r.Size, r.Checksum)
+}
@@ -0,0 +1,224 @@
+package motrds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var _ ds.CheckedDatastore = (*MotrDatastore)(nil)
+var _ ds.ScrubbedDatastore = (*MotrDatastore)(nil)
+
+// Number of values Check reads from Motr when Config.CheckSamples is not set.
+const DefaultCheckSamples = 100
+
+var errMissingValue = errors.New("motrds: catalogued value is missing from Motr")
+
+// Check verifies that every catalogue record can be decoded, that the Motr index is
+// reachable and uses the expected key scheme, and that a random sample of values can
+// be read from Motr and match their block multihash or catalogue checksum.
+func (d *MotrDatastore) Check(ctx context.Context) error {
+	log.Infof("Checking Motr datastore for index %s...", d.Idx)
+	if scheme, escheme := d.readKeyScheme(); escheme != nil {
+		log.Errorf("Motr index %s is not reachable: %v.", d.Idx, escheme)
+		return escheme
+	} else if scheme == "" && d.ReadOnly {
+		log.Infof("Motr index %s has no recorded key scheme, using %s.", d.Idx, d.KeyScheme)
+	} else if scheme != d.KeyScheme {
+		return fmt.Errorf("motrds: index %s records key scheme %q but the datastore uses %s", d.Idx, scheme, d.KeyScheme)
+	}
+	samples := make([]ds.Key, 0, d.CheckSamples)
+	malformed, total := 0, 0
+	i := d.Catalogue.NewIterator(util.BytesPrefix([]byte("/")), nil)
+	for i.Next() {
+		if ctx.Err() != nil {
+			i.Release()
+			return ctx.Err()
+		}
+		total++
+		key := ds.RawKey(string(i.Key()))
+		if _, erec := decodeRecord(i.Value()); erec != nil {
+			log.Errorf("Malformed catalogue record for key %s: %v.", key, erec)
+			malformed++
+			continue
+		}
+		// Reservoir sampling of keys with decodable records.
+		if len(samples) < cap(samples) {
+			samples = append(samples, key)
+		} else if r := rand.Intn(total); r < cap(samples) {
+			samples[r] = key
+		}
+		if total%10000 == 0 {
+			log.Infof("Checked %v catalogue records...", total)
+		}
+	}
+	eit := i.Error()
+	i.Release()
+	if eit != nil {
+		log.Errorf("Error iterating catalogue: %v.", eit)
+		return eit
+	}
+	log.Infof("Checked %v catalogue records, %v malformed. Reading %v sampled values from Motr...", total, malformed, len(samples))
+	unreadable := 0
+	for _, key := range samples {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		d.locks.RLock(key)
+		rec, erec := d.getRecord(key)
+		if erec == nil {
+			_, erec = d.readValue(key, rec)
+		}
+		d.locks.RUnlock(key)
+		if erec != nil && erec != ds.ErrNotFound {
+			log.Errorf("Error reading value at key %s: %v.", key, erec)
+			unreadable++
+		}
+	}
+	if malformed > 0 || unreadable > 0 {
+		return fmt.Errorf("motrds: check of index %s found %d malformed catalogue records and %d of %d sampled values unreadable or corrupt", d.Idx, malformed, unreadable, len(samples))
+	}
+	log.Infof("Check of Motr datastore for index %s passed.", d.Idx)
+	return nil
+}
+
+// Scrub reads every catalogued value from Motr and verifies it, repairing what it can:
+// records that can't be decoded or predate sizes and checksums are rebuilt from the
+// value, entries whose value is missing from Motr are removed, and corrupt blocks are
+// deleted so IPFS fetches them again. Corrupt values of other keys are recorded and
+// left in place. Keys recorded as corrupt that now verify are cleared.
+func (d *MotrDatastore) Scrub(ctx context.Context) error {
+	log.Infof("Scrubbing Motr datastore for index %s...", d.Idx)
+	var total, rebuilt, removed, corrupt, failed int
+	i := d.Catalogue.NewIterator(util.BytesPrefix([]byte("/")), nil)
+	defer i.Release()
+	for i.Next() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		total++
+		key := ds.RawKey(string(i.Key()))
+		switch escrub := d.scrubKey(key); {
+		case escrub == nil:
+		case escrub == errMissingValue:
+			removed++
+		case errors.Is(escrub, ErrCorrupt):
+			corrupt++
+		case escrub == errRebuilt:
+			rebuilt++
+		default:
+			log.Errorf("Error scrubbing key %s: %v.", key, escrub)
+			failed++
+		}
+		if total%1000 == 0 {
+			log.Infof("Scrubbed %v values: %v records rebuilt, %v missing values removed, %v corrupt, %v failed...", total, rebuilt, removed, corrupt, failed)
+		}
+	}
+	if eit := i.Error(); eit != nil {
+		return eit
+	}
+	corruptKeys, ecorrupt := d.CorruptKeys()
+	if ecorrupt != nil {
+		return ecorrupt
+	}
+	for key := range corruptKeys {
+		if has, _ := d.Catalogue.Has(key.Bytes(), nil); !has {
+			d.ClearCorrupt(key)
+		}
+	}
+	log.Infof("Scrubbed %v values: %v records rebuilt, %v missing values removed, %v corrupt, %v failed.", total, rebuilt, removed, corrupt, failed)
+	if failed > 0 {
+		return fmt.Errorf("motrds: scrub of index %s could not check %d values", d.Idx, failed)
+	}
+	return nil
+}
+
+var errRebuilt = errors.New("motrds: catalogue record rebuilt")
+
+func (d *MotrDatastore) scrubKey(key ds.Key) error {
+	d.locks.Lock(key)
+	defer d.locks.Unlock(key)
+	oid := d.getOID(key)
+	v, erec := d.Catalogue.Get(key.Bytes(), nil)
+	if erec != nil {
+		// Deleted since the iterator was created.
+		return nil
+	}
+	rec, erec := decodeRecord(v)
+	stored, eget := d.Index.Get(oid)
+	if eget != nil {
+		if has, ehas := d.Index.Has(oid); ehas != nil || has {
+			return eget
+		}
+		log.Warnf("Value at key %s (OID %s) is missing from Motr, removing it from the catalogue.", key, getOIDstr(oid))
+		if edel := d.Catalogue.Delete(key.Bytes(), nil); edel != nil {
+			return edel
+		}
+		d.ClearCorrupt(key)
+		return errMissingValue
+	}
+	if erec != nil || rec.Legacy {
+		expires := rec.Expires
+		if erec != nil {
+			if expires, erec = d.lastExpiry(key); erec != nil {
+				return erec
+			}
+		}
+		// Work out whether the value is enveloped from the value itself.
+		rec = record{Legacy: true}
+		if _, eh := parseEnvelope(stored); eh == nil {
+			if value, edec := d.decodeValue(key, record{Flags: recordEnveloped}, stored); edec == nil {
+				rec = newRecord(value)
+				rec.Flags = recordEnveloped
+			}
+		}
+		if rec.Legacy {
+			rec = newRecord(stored)
+		}
+		rec.Expires = expires
+		log.Infof("Rebuilding catalogue record for key %s: %v.", key, rec)
+		if eput := d.Catalogue.Put(key.Bytes(), rec.encode(), nil); eput != nil {
+			return eput
+		}
+		erec = errRebuilt
+	}
+	value, edec := d.decodeValue(key, rec, stored)
+	if edec != nil {
+		return edec
+	}
+	if ever := d.verifyValue(key, rec, value); ever != nil {
+		if _, emh := BlockMultihash(d.blocksNamespace(), key); emh == nil {
+			log.Warnf("Deleting corrupt block at key %s so it can be fetched again.", key)
+			if d.cache != nil {
+				d.cache.Remove(key.String())
+			}
+			if edel := d.Catalogue.Delete(key.Bytes(), nil); edel != nil {
+				return edel
+			}
+			if edel := d.Index.Delete(oid); edel != nil {
+				return edel
+			}
+		}
+		return ever
+	}
+	d.ClearCorrupt(key)
+	return erec
+}
+
+// readValue reads and decodes the value of a catalogued key from Motr and verifies it,
+// bypassing the value cache.
+func (d *MotrDatastore) readValue(key ds.Key, rec record) ([]byte, error) {
+	stored, eget := d.Index.Get(d.getOID(key))
+	if eget != nil {
+		return nil, eget
+	}
+	value, edec := d.decodeValue(key, rec, stored)
+	if edec != nil {
+		return nil, edec
+	}
+	return value, d.verifyValue(key, rec, value)
+}
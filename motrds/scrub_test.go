@@ -0,0 +1,171 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// TestCheck checks that Check passes on a healthy datastore and finds malformed
+// records and corrupt values among the sampled values.
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	conf.CheckSamples = 5
+	d := openTestDatastore(t, conf)
+	defer d.Close()
+	var keys []ds.Key
+	for i := 0; i < 50; i++ {
+		key := ds.NewKey(fmt.Sprintf("/check/%02d", i))
+		if err := d.Put(ctx, key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if err := d.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every value is corrupt so whichever are sampled are found.
+	for _, key := range keys {
+		if err := d.Index.Put(d.getOID(key), []byte("xxxxx"), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Check(ctx); err == nil || !strings.Contains(err.Error(), "5 of 5 sampled values") {
+		t.Fatalf("Check returned %v for corrupt values", err)
+	}
+	if corrupt, err := d.CorruptKeys(); err != nil || len(corrupt) != 5 {
+		t.Fatalf("Check recorded %d corrupt keys, %v", len(corrupt), err)
+	}
+	for _, key := range keys {
+		if err := d.Put(ctx, key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Catalogue.Put([]byte("/check/malformed"), []byte{0x7f}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Check(ctx); err == nil || !strings.Contains(err.Error(), "1 malformed catalogue records") {
+		t.Fatalf("Check returned %v for a malformed record", err)
+	}
+
+	// A read-only datastore can check an index whose key scheme isn't recorded.
+	conf = testConfig(t)
+	conf.KeyScheme = LegacyKeyScheme
+	d = openTestDatastore(t, conf)
+	if err := d.Put(ctx, ds.NewKey("/check/legacy"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Index.Delete(keySchemeKey); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	conf.KeyScheme, conf.ReadOnly = "", true
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	if err := d.Check(ctx); err != nil {
+		t.Fatalf("read-only Check of an index without a recorded key scheme returned %v", err)
+	}
+	if scheme, err := d.readKeyScheme(); err != nil || scheme != "" {
+		t.Fatalf("read-only Check recorded key scheme %q, %v", scheme, err)
+	}
+}
+
+// TestScrub checks that Scrub rebuilds legacy and malformed records from their
+// values, removes entries whose value is missing from Motr, deletes corrupt blocks,
+// and records other corrupt values while leaving them in place.
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	conf.Compression = ZstdCompression
+	d := openTestDatastore(t, conf)
+	defer d.Close()
+	h, _ := mh.Sum([]byte("block"), mh.SHA2_256, -1)
+	legacy, compressed, malformed := ds.NewKey("/scrub/legacy"), ds.NewKey("/scrub/compressed"), ds.NewKey("/scrub/malformed")
+	missing, corrupt, block, healthy := ds.NewKey("/scrub/missing"), ds.NewKey("/scrub/corrupt"), BlockKey(DefaultBlocksNamespace, h), ds.NewKey("/scrub/healthy")
+	large := bytes.Repeat([]byte("compressible "), 100)
+	values := map[ds.Key][]byte{
+		legacy:     []byte("legacy"),
+		compressed: large,
+		malformed:  []byte("malformed"),
+		missing:    []byte("missing"),
+		corrupt:    []byte("corrupt"),
+		block:      []byte("block"),
+		healthy:    []byte("healthy"),
+	}
+	for key, v := range values {
+		if err := d.Put(ctx, key, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, rec := range map[ds.Key][]byte{legacy: {legacyRecordVersion}, compressed: {legacyRecordVersion}, malformed: {recordVersion}} {
+		if err := d.Catalogue.Put(key.Bytes(), rec, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Index.Delete(d.getOID(missing)); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []ds.Key{corrupt, block} {
+		if err := d.Index.Put(d.getOID(key), bytes.Repeat([]byte("x"), len(values[key])), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Catalogue.Put(corruptKey(healthy), make([]byte, 8), nil); err != nil {
+		t.Fatal(err)
+	}
+	expiring := ds.NewKey("/scrub/expiring")
+	if err := d.PutWithTTL(ctx, expiring, []byte("expiring"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expiration, _ := d.GetExpiration(ctx, expiring)
+	if err := d.Catalogue.Put(expiring.Bytes(), []byte{recordVersion}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Scrub(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []ds.Key{legacy, compressed, malformed} {
+		rec, err := d.getRecord(key)
+		if err != nil || rec.Legacy || rec != newRecordWithFlags(values[key], rec.Flags) {
+			t.Fatalf("record of %s is %v, %v after Scrub", key, rec, err)
+		}
+		if v, err := d.Get(ctx, key); err != nil || !bytes.Equal(v, values[key]) {
+			t.Fatalf("Get(%s) returned %d bytes, %v after Scrub", key, len(v), err)
+		}
+	}
+	if rec, _ := d.getRecord(compressed); rec.Flags&recordEnveloped == 0 {
+		t.Fatal("rebuilt record of a compressed value is not flagged as enveloped")
+	}
+	for _, key := range []ds.Key{missing, block} {
+		if has, err := d.Has(ctx, key); err != nil || has {
+			t.Fatalf("Has(%s) = %v, %v after Scrub", key, has, err)
+		}
+	}
+	if has, err := d.Index.Has(d.getOID(block)); err != nil || has {
+		t.Fatalf("corrupt block left in Motr: %v, %v", has, err)
+	}
+	if has, err := d.Has(ctx, corrupt); err != nil || !has {
+		t.Fatalf("Has(%s) = %v, %v after Scrub", corrupt, has, err)
+	}
+	if exp, err := d.GetExpiration(ctx, expiring); err != nil || !exp.Equal(expiration) {
+		t.Fatalf("expiration of %s is %v, %v after Scrub, want %v", expiring, exp, err, expiration)
+	}
+	if keys, err := d.CorruptKeys(); err != nil || len(keys) != 1 || keys[corrupt].IsZero() {
+		t.Fatalf("CorruptKeys = %v, %v after Scrub", keys, err)
+	}
+}
+
+func newRecordWithFlags(value []byte, flags byte) record {
+	rec := newRecord(value)
+	rec.Flags = flags
+	return rec
+}
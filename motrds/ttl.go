@@ -0,0 +1,170 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var _ ds.TTLDatastore = (*MotrDatastore)(nil)
+
+// Catalogue record flag set when the record carries an expiration time.
+const recordExpires byte = 1 << 1
+
+// Interval between sweeps for expired entries when Config.TTLSweepInterval is not set.
+const DefaultTTLSweepInterval = time.Minute
+
+// Number of expired entries deleted at a time by the sweeper.
+const sweepBatchSize = 1000
+
+// Prefix of catalogue keys of the expiration index, which orders datastore keys with
+// an expiration time by that time so the sweeper only visits expired entries:
+//
+//	prefix | expiration time in Unix nanoseconds (8 bytes) | datastore key
+//
+// Index entries are not removed when a key is put again or deleted; the sweeper
+// ignores entries whose time doesn't match the catalogue record.
+var expiryPrefix = []byte("\x00motrds/expires/")
+
+func expiryKey(expires int64, key []byte) []byte {
+	k := make([]byte, len(expiryPrefix)+8+len(key))
+	n := copy(k, expiryPrefix)
+	binary.BigEndian.PutUint64(k[n:], uint64(expires))
+	copy(k[n+8:], key)
+	return k
+}
+
+// lastExpiry returns the latest expiration time of key in the expiration index, or 0
+// if it has none, to rebuild the expiration time of a malformed catalogue record.
+func (d *MotrDatastore) lastExpiry(key ds.Key) (int64, error) {
+	i := d.Catalogue.NewIterator(util.BytesPrefix(expiryPrefix), nil)
+	defer i.Release()
+	var expires int64
+	for i.Next() {
+		// Entries are ordered by time so the last match is the latest.
+		if entry := i.Key(); len(entry) >= len(expiryPrefix)+8 && bytes.Equal(entry[len(expiryPrefix)+8:], key.Bytes()) {
+			expires = int64(binary.BigEndian.Uint64(entry[len(expiryPrefix):]))
+		}
+	}
+	return expires, i.Error()
+}
+
+func (r record) expired(now time.Time) bool {
+	return r.Expires != 0 && r.Expires <= now.UnixNano()
+}
+
+// PutWithTTL stores a value that expires after ttl.
+func (d *MotrDatastore) PutWithTTL(ctx context.Context, key ds.Key, value []byte, ttl time.Duration) error {
+	return d.put(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// SetTTL changes the expiration time of an existing key to ttl from now.
+func (d *MotrDatastore) SetTTL(ctx context.Context, key ds.Key, ttl time.Duration) error {
+	d.locks.Lock(key)
+	defer d.locks.Unlock(key)
+	rec, erec := d.getRecord(key)
+	if erec != nil {
+		return erec
+	}
+	rec.Expires = time.Now().Add(ttl).UnixNano()
+	batch := new(leveldb.Batch)
+	batch.Put(key.Bytes(), rec.encode())
+	batch.Put(expiryKey(rec.Expires, key.Bytes()), nil)
+	log.Debugf("Set expiration of key %s to %s.", key, time.Unix(0, rec.Expires))
+	return d.Catalogue.Write(batch, nil)
+}
+
+// GetExpiration returns the expiration time of a key, or the zero time if it
+// doesn't expire.
+func (d *MotrDatastore) GetExpiration(ctx context.Context, key ds.Key) (time.Time, error) {
+	d.locks.RLock(key)
+	defer d.locks.RUnlock(key)
+	rec, erec := d.getRecord(key)
+	if erec != nil {
+		return time.Time{}, erec
+	} else if rec.Expires == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, rec.Expires), nil
+}
+
+// sweep periodically deletes expired entries until the datastore is closed.
+func (d *MotrDatastore) sweep(interval time.Duration) {
+	defer close(d.sweepDone)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.stopSweep:
+			return
+		case now := <-t.C:
+			if n, err := d.sweepExpired(now); err != nil {
+				log.Errorf("Error sweeping expired entries: %v.", err)
+			} else if n > 0 {
+				log.Infof("Deleted %v expired entries.", n)
+			}
+		}
+	}
+}
+
+// sweepExpired deletes the entries that expired by now and returns how many it
+// deleted.
+func (d *MotrDatastore) sweepExpired(now time.Time) (int, error) {
+	deleted := 0
+	for {
+		i := d.Catalogue.NewIterator(&util.Range{Start: expiryPrefix, Limit: expiryKey(now.UnixNano()+1, nil)}, nil)
+		var entries [][]byte
+		for len(entries) < sweepBatchSize && i.Next() {
+			entries = append(entries, append([]byte{}, i.Key()...))
+		}
+		eit := i.Error()
+		i.Release()
+		if eit != nil {
+			return deleted, eit
+		}
+		n, edel := d.deleteExpired(entries)
+		deleted += n
+		if edel != nil || len(entries) < sweepBatchSize {
+			return deleted, edel
+		}
+	}
+}
+
+func (d *MotrDatastore) deleteExpired(entries [][]byte) (int, error) {
+	deleted := 0
+	for _, entry := range entries {
+		if expired, err := d.deleteIfExpired(entry); err != nil {
+			return deleted, err
+		} else if expired {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// deleteIfExpired deletes the key of an expiration index entry if it still expires
+// at the time of the entry, and then the entry.
+func (d *MotrDatastore) deleteIfExpired(entry []byte) (bool, error) {
+	expires := int64(binary.BigEndian.Uint64(entry[len(expiryPrefix):]))
+	key := ds.RawKey(string(entry[len(expiryPrefix)+8:]))
+	d.locks.Lock(key)
+	defer d.locks.Unlock(key)
+	expired := false
+	if v, eget := d.Catalogue.Get(key.Bytes(), nil); eget == nil {
+		if rec, erec := decodeRecord(v); erec == nil && rec.Expires == expires {
+			log.Debugf("Deleting key %s which expired at %s.", key, time.Unix(0, expires))
+			if edel := d.delete(key); edel != nil {
+				return false, edel
+			}
+			expired = true
+		}
+	} else if eget != leveldb.ErrNotFound {
+		return false, eget
+	}
+	return expired, d.Catalogue.Delete(entry, nil)
+}
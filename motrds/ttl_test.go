@@ -0,0 +1,171 @@
+package motrds
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// TestTTL checks that values put with a TTL expire, and that SetTTL and
+// GetExpiration change and report expiration times.
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	d := testDatastore(t)
+	short, long, plain := ds.NewKey("/ttl/short"), ds.NewKey("/ttl/long"), ds.NewKey("/ttl/plain")
+	if err := d.PutWithTTL(ctx, short, []byte("short"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	if err := d.PutWithTTL(ctx, long, []byte("long"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, plain, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if exp, err := d.GetExpiration(ctx, long); err != nil || exp.Before(before.Add(time.Hour)) || exp.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("GetExpiration = %v, %v for a key put with a TTL of an hour", exp, err)
+	}
+	if exp, err := d.GetExpiration(ctx, plain); err != nil || !exp.IsZero() {
+		t.Fatalf("GetExpiration = %v, %v for a key without TTL", exp, err)
+	}
+	if v, err := d.Get(ctx, short); err != nil || string(v) != "short" {
+		t.Fatalf("Get = %q, %v before the TTL expired", v, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := d.Get(ctx, short); err != ds.ErrNotFound {
+		t.Fatalf("Get returned %v after the TTL expired", err)
+	}
+	if has, err := d.Has(ctx, short); err != nil || has {
+		t.Fatalf("Has = %v, %v after the TTL expired", has, err)
+	}
+	if _, err := d.GetExpiration(ctx, short); err != ds.ErrNotFound {
+		t.Fatalf("GetExpiration returned %v after the TTL expired", err)
+	}
+	if err := d.SetTTL(ctx, short, time.Hour); err != ds.ErrNotFound {
+		t.Fatalf("SetTTL returned %v for an expired key", err)
+	}
+
+	if err := d.SetTTL(ctx, plain, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if exp, err := d.GetExpiration(ctx, plain); err != nil || exp.IsZero() {
+		t.Fatalf("GetExpiration = %v, %v after SetTTL", exp, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := d.Get(ctx, plain); err != ds.ErrNotFound {
+		t.Fatalf("Get returned %v after the TTL set with SetTTL expired", err)
+	}
+	if v, err := d.Get(ctx, long); err != nil || string(v) != "long" {
+		t.Fatalf("Get = %q, %v before the TTL expired", v, err)
+	}
+}
+
+// TestTTLSweep checks that the sweeper deletes expired values from the catalogue and
+// Motr, and leaves keys that were put again without a TTL.
+func TestTTLSweep(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	conf.TTLSweepInterval = 20 * time.Millisecond
+	d := openTestDatastore(t, conf)
+	defer d.Close()
+	expired, renewed := ds.NewKey("/sweep/expired"), ds.NewKey("/sweep/renewed")
+	for _, key := range []ds.Key{expired, renewed} {
+		if err := d.PutWithTTL(ctx, key, []byte("value"), time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put(ctx, renewed, []byte("renewed")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if has, err := d.Catalogue.Has(expired.Bytes(), nil); err != nil || has {
+		t.Fatalf("expired key still in the catalogue after a sweep: %v, %v", has, err)
+	}
+	if has, err := d.Index.Has(d.getOID(expired)); err != nil || has {
+		t.Fatalf("expired value still in Motr after a sweep: %v, %v", has, err)
+	}
+	if v, err := d.Get(ctx, renewed); err != nil || string(v) != "renewed" {
+		t.Fatalf("Get = %q, %v for a key put again without a TTL", v, err)
+	}
+	if n, err := d.sweepExpired(time.Now().Add(time.Hour)); err != nil || n != 0 {
+		t.Fatalf("sweep deleted %v entries, %v, after the index was swept", n, err)
+	}
+}
+
+// TestTTLReopen checks that expiration times survive closing and opening the
+// datastore again.
+func TestTTLReopen(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	d := openTestDatastore(t, conf)
+	key := ds.NewKey("/ttl/reopen")
+	if err := d.PutWithTTL(ctx, key, []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	exp, err := d.GetExpiration(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = openTestDatastore(t, conf)
+	defer d.Close()
+	if reopened, err := d.GetExpiration(ctx, key); err != nil || !reopened.Equal(exp) {
+		t.Fatalf("GetExpiration = %v, %v after reopening, was %v", reopened, err, exp)
+	}
+	if r, err := d.Query(ctx, query.Query{Prefix: "/ttl", ReturnExpirations: true}); err != nil {
+		t.Fatal(err)
+	} else if es, err := r.Rest(); err != nil || len(es) != 1 || !es[0].Expiration.Equal(exp) {
+		t.Fatalf("query returned %v, %v after reopening", es, err)
+	}
+}
+
+// TestTTLQuery checks that expired entries are skipped before query offsets and
+// limits are applied.
+func TestTTLQuery(t *testing.T) {
+	ctx := context.Background()
+	d := testDatastore(t)
+	for i := 0; i < 10; i++ {
+		key := ds.NewKey(fmt.Sprintf("/e/%d", i))
+		var err error
+		if i%2 == 0 {
+			err = d.PutWithTTL(ctx, key, []byte("expired"), time.Millisecond)
+		} else {
+			err = d.Put(ctx, key, []byte("live"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, c := range []struct {
+		q    query.Query
+		want int
+	}{
+		{query.Query{Prefix: "/e"}, 5},
+		{query.Query{Prefix: "/e", Limit: 3}, 3},
+		{query.Query{Prefix: "/e", Offset: 2}, 3},
+		{query.Query{Prefix: "/e", Offset: 2, Limit: 2, KeysOnly: true}, 2},
+		{query.Query{Prefix: "/e", Offset: 4, Limit: 2}, 1},
+		{query.Query{Prefix: "/e", Limit: 3, Orders: []query.Order{query.OrderByKeyDescending{}}}, 3},
+	} {
+		r, err := d.Query(ctx, c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		es, err := r.Rest()
+		if err != nil || len(es) != c.want {
+			t.Fatalf("%s returned %d entries, %v, want %d", c.q, len(es), err, c.want)
+		}
+		for _, e := range es {
+			if !c.q.KeysOnly && string(e.Value) != "live" {
+				t.Fatalf("%s returned expired key %s", c.q, e.Key)
+			}
+		}
+	}
+}
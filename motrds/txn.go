@@ -0,0 +1,374 @@
+package motrds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var _ ds.TxnDatastore = (*MotrDatastore)(nil)
+
+// ErrTxnConflict is returned by Commit when a key read in the transaction was changed
+// by someone else before the transaction committed. Nothing is committed.
+var ErrTxnConflict = errors.New("motrds: transaction conflict")
+
+var errTxnReadOnly = errors.New("motrds: transaction is read-only")
+var errTxnDone = errors.New("motrds: transaction already committed or discarded")
+
+// Prefix of catalogue keys of the undo log of a committing transaction. Each entry
+// holds the Motr value a transaction put overwrote so it can be restored if the
+// transaction fails before its catalogue records are written:
+//
+//	prefix | datastore key -> 0x00 (no previous value) or 0x01 | stored value
+//
+// The undo log is deleted in the same catalogue batch that commits the catalogue, so
+// an undo log found when the datastore is opened belongs to a transaction that
+// never committed.
+var undoPrefix = []byte("\x00motrds/txn-undo")
+
+// txn buffers the writes of a transaction in memory until Commit, and remembers the
+// catalogue records of the keys it read so concurrent changes to them are detected.
+type txn struct {
+	d        *MotrDatastore
+	readOnly bool
+	mu       sync.Mutex
+	done     bool
+	// Pending writes by key, with nil values for deletes.
+	writes map[string][]byte
+	// Catalogue records of the keys read, nil for keys that didn't exist.
+	reads map[string][]byte
+}
+
+// NewTransaction starts a transaction. Values read in the transaction see its own
+// writes, and Commit fails with ErrTxnConflict if any key read was changed since.
+// Keys returned by queries are not checked for conflicts.
+func (d *MotrDatastore) NewTransaction(ctx context.Context, readOnly bool) (ds.Txn, error) {
+	return &txn{d: d, readOnly: readOnly, writes: make(map[string][]byte), reads: make(map[string][]byte)}, nil
+}
+
+// rawRecord returns the catalogue record of a key as stored, or nil if the key
+// doesn't exist or has expired.
+func (d *MotrDatastore) rawRecord(key ds.Key) ([]byte, error) {
+	v, eldb := d.Catalogue.Get(key.Bytes(), nil)
+	if eldb == leveldb.ErrNotFound {
+		return nil, nil
+	} else if eldb != nil {
+		return nil, eldb
+	}
+	if rec, erec := decodeRecord(v); erec == nil && rec.expired(time.Now()) {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// pending returns the buffered write of a key, recording a read of the key when
+// there is none.
+func (t *txn) pending(key ds.Key) (value []byte, written bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return nil, false, errTxnDone
+	}
+	if v, ok := t.writes[key.String()]; ok {
+		return v, true, nil
+	}
+	if _, ok := t.reads[key.String()]; !ok {
+		t.d.locks.RLock(key)
+		rec, erec := t.d.rawRecord(key)
+		t.d.locks.RUnlock(key)
+		if erec != nil {
+			return nil, false, erec
+		}
+		t.reads[key.String()] = rec
+	}
+	return nil, false, nil
+}
+
+func (t *txn) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	if v, written, err := t.pending(key); err != nil {
+		return nil, err
+	} else if written {
+		if v == nil {
+			return nil, ds.ErrNotFound
+		}
+		return v, nil
+	}
+	return t.d.Get(ctx, key)
+}
+
+func (t *txn) Has(ctx context.Context, key ds.Key) (bool, error) {
+	if v, written, err := t.pending(key); err != nil {
+		return false, err
+	} else if written {
+		return v != nil, nil
+	}
+	return t.d.Has(ctx, key)
+}
+
+func (t *txn) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	if v, written, err := t.pending(key); err != nil {
+		return -1, err
+	} else if written {
+		if v == nil {
+			return -1, ds.ErrNotFound
+		}
+		return len(v), nil
+	}
+	return t.d.GetSize(ctx, key)
+}
+
+// Query returns the results of the query over the datastore with the writes of the
+// transaction applied.
+func (t *txn) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return nil, errTxnDone
+	}
+	writes := make(map[string][]byte, len(t.writes))
+	for k, v := range t.writes {
+		writes[k] = v
+	}
+	t.mu.Unlock()
+	if len(writes) == 0 {
+		return t.d.Query(ctx, q)
+	}
+	base, err := t.d.Query(ctx, query.Query{Prefix: q.Prefix, KeysOnly: q.KeysOnly, ReturnExpirations: q.ReturnExpirations, ReturnsSizes: q.ReturnsSizes})
+	if err != nil {
+		return nil, err
+	}
+	prefix := ds.NewKey(q.Prefix)
+	var added []query.Entry
+	for k, v := range writes {
+		if key := ds.RawKey(k); v != nil && (prefix.String() == "/" || prefix.IsAncestorOf(key)) {
+			e := query.Entry{Key: k, Size: len(v)}
+			if !q.KeysOnly {
+				e.Value = v
+			}
+			added = append(added, e)
+		}
+	}
+	r := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			for {
+				if res, ok := base.NextSync(); ok {
+					if res.Error == nil {
+						if _, written := writes[res.Key]; written {
+							continue
+						}
+					}
+					return res, true
+				}
+				if len(added) == 0 {
+					return query.Result{}, false
+				}
+				e := added[0]
+				added = added[1:]
+				return query.Result{Entry: e}, true
+			}
+		},
+		Close: base.Close,
+	})
+	qNaive := q
+	qNaive.Prefix = ""
+	return query.NaiveQueryApply(qNaive, r), nil
+}
+
+func (t *txn) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return t.write(key, append([]byte{}, value...))
+}
+
+func (t *txn) Delete(ctx context.Context, key ds.Key) error {
+	return t.write(key, nil)
+}
+
+func (t *txn) write(key ds.Key, value []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return errTxnDone
+	} else if t.readOnly {
+		return errTxnReadOnly
+	}
+	t.writes[key.String()] = value
+	return nil
+}
+
+func (t *txn) Discard(ctx context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done = true
+	t.writes, t.reads = nil, nil
+}
+
+// Commit writes the values put in the transaction to Motr and then commits their
+// catalogue records and the deletes in a single catalogue batch. If the transaction
+// fails before that, the Motr values it overwrote are restored from the undo log.
+func (t *txn) Commit(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return errTxnDone
+	}
+	t.done = true
+	if len(t.writes) == 0 {
+		return nil
+	}
+	d := t.d
+	keys := make([]ds.Key, 0, len(t.reads)+len(t.writes))
+	for k := range t.reads {
+		keys = append(keys, ds.RawKey(k))
+	}
+	for k := range t.writes {
+		keys = append(keys, ds.RawKey(k))
+	}
+	defer d.locks.LockKeys(keys)()
+	for k, read := range t.reads {
+		if rec, erec := d.rawRecord(ds.RawKey(k)); erec != nil {
+			return erec
+		} else if !bytes.Equal(rec, read) {
+			log.Debugf("Transaction conflict on key %s.", k)
+			return ErrTxnConflict
+		}
+	}
+	log.Debugf("Begin commit of transaction with %v writes to catalogue and Motr index %s.", len(t.writes), d.Idx)
+
+	// Log the Motr values the puts will overwrite.
+	undo := new(leveldb.Batch)
+	var puts []ds.Key
+	for k, v := range t.writes {
+		if v == nil {
+			continue
+		}
+		key := ds.RawKey(k)
+		puts = append(puts, key)
+		entry := []byte{0}
+		if has, ehas := d.Catalogue.Has(key.Bytes(), nil); ehas != nil {
+			return ehas
+		} else if has {
+			stored, eget := d.Index.Get(d.getOID(key))
+			if eget != nil {
+				return eget
+			}
+			entry = append([]byte{1}, stored...)
+		}
+		undo.Put(append(append([]byte{}, undoPrefix...), key.Bytes()...), entry)
+	}
+	if eundo := d.Catalogue.Write(undo, nil); eundo != nil {
+		return eundo
+	}
+
+	commit := new(leveldb.Batch)
+	for k, v := range t.writes {
+		key := ds.RawKey(k)
+		if v == nil {
+			commit.Delete(key.Bytes())
+			commit.Delete(corruptKey(key))
+			continue
+		}
+		stored, flags := d.encodeValue(key, v)
+		if d.live != nil {
+			d.live.add(d.getOID(key))
+		}
+		if emotr := d.Index.Put(d.getOID(key), stored, true); emotr != nil {
+			log.Errorf("Error putting key %v (OID %s) to Motr index %s in transaction: %v.", key, getOIDstr(d.getOID(key)), d.Idx, emotr)
+			if eroll := d.rollbackKeys(puts); eroll != nil {
+				log.Errorf("Error rolling back transaction: %v.", eroll)
+			}
+			return emotr
+		}
+		rec := newRecord(v)
+		rec.Flags = flags
+		commit.Put(key.Bytes(), rec.encode())
+		commit.Delete(corruptKey(key))
+		commit.Delete(append(append([]byte{}, undoPrefix...), key.Bytes()...))
+	}
+	if eldb := d.Catalogue.Write(commit, nil); eldb != nil {
+		log.Errorf("Error committing transaction to catalogue: %v.", eldb)
+		if eroll := d.rollbackKeys(puts); eroll != nil {
+			log.Errorf("Error rolling back transaction: %v.", eroll)
+		}
+		return eldb
+	}
+	for k, v := range t.writes {
+		key := ds.RawKey(k)
+		if d.cache != nil {
+			d.cache.Remove(k)
+		}
+		if v == nil {
+			// The catalogue no longer refers to the record so a failure only leaves an
+			// orphan for CollectGarbage.
+			if edel := d.Index.Delete(d.getOID(key)); edel != nil {
+				log.Warnf("Error deleting key %v (OID %s) from Motr after transaction commit: %v.", key, getOIDstr(d.getOID(key)), edel)
+			}
+		}
+	}
+	log.Debugf("End (success) commit of transaction with %v writes to catalogue and Motr index %s.", len(t.writes), d.Idx)
+	return nil
+}
+
+// rollbackTransaction restores the Motr values recorded in the undo log of every
+// transaction that didn't commit, and deletes the undo log. It is only called when
+// the datastore is opened, before any transaction can be committing.
+func (d *MotrDatastore) rollbackTransaction() error {
+	i := d.Catalogue.NewIterator(util.BytesPrefix(undoPrefix), nil)
+	var keys []ds.Key
+	for i.Next() {
+		keys = append(keys, ds.RawKey(string(i.Key()[len(undoPrefix):])))
+	}
+	i.Release()
+	if eit := i.Error(); eit != nil {
+		return eit
+	}
+	if err := d.rollbackKeys(keys); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		log.Infof("Rolled back %v values of an uncommitted transaction.", len(keys))
+	}
+	return nil
+}
+
+// rollbackKeys restores the Motr values recorded in the undo log for keys, and
+// deletes their undo log entries. The caller must hold the locks of the keys, so
+// the undo log entries of transactions committing concurrently are left alone. Keys
+// that can't be restored keep their undo log entries, which are replayed when the
+// datastore is opened again, and the first error is returned.
+func (d *MotrDatastore) rollbackKeys(keys []ds.Key) error {
+	var first error
+	for _, key := range keys {
+		undoKey := append(append([]byte{}, undoPrefix...), key.Bytes()...)
+		v, eundo := d.Catalogue.Get(undoKey, nil)
+		if eundo == leveldb.ErrNotFound {
+			continue
+		}
+		err := eundo
+		if err == nil {
+			oid := d.getOID(key)
+			if len(v) > 0 && v[0] == 1 {
+				err = d.Index.Put(oid, v[1:], true)
+			} else if has, ehas := d.Index.Has(oid); ehas != nil {
+				err = ehas
+			} else if has {
+				err = d.Index.Delete(oid)
+			}
+			if err != nil {
+				err = fmt.Errorf("motrds: could not restore key %s from transaction undo log: %v", key, err)
+			} else {
+				err = d.Catalogue.Delete(undoKey, nil)
+			}
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
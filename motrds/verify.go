@@ -0,0 +1,85 @@
+package motrds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ErrCorrupt is returned, wrapped with the key, when VerifyValues is set and a value
+// read from Motr doesn't match the multihash in its block key or the checksum in its
+// catalogue record. It is also returned when a value stored in an envelope can't be
+// decoded.
+var ErrCorrupt = errors.New("motrds: corrupt value")
+
+// Prefix of catalogue keys recording datastore keys found to have corrupt values. The
+// value is the time the corruption was found.
+var corruptPrefix = []byte("\x00motrds/corrupt")
+
+// corruptKey returns the catalogue key recording that key has a corrupt value. Puts
+// and deletes of key remove it in the same batch as the key's record.
+func corruptKey(key ds.Key) []byte {
+	return append(append([]byte{}, corruptPrefix...), key.Bytes()...)
+}
+
+// verifyValue checks a value read from Motr against the multihash of a block key or
+// the CRC-32C checksum of the catalogue record, recording the key when they differ.
+func (d *MotrDatastore) verifyValue(key ds.Key, rec record, value []byte) error {
+	if dh, emh := BlockMultihash(d.blocksNamespace(), key); emh == nil {
+		h, esum := mh.Sum(value, dh.Code, dh.Length)
+		if esum != nil {
+			log.Debugf("Cannot verify block at key %s with multihash type %s: %v.", key, dh.Name, esum)
+		} else if !bytes.Equal(h[len(h)-dh.Length:], dh.Digest) {
+			return d.corrupt(key, fmt.Sprintf("block hashes to %s", h.B58String()))
+		} else {
+			return nil
+		}
+	}
+	if !rec.Legacy && crc32.Checksum(value, crc32c) != rec.Checksum {
+		return d.corrupt(key, fmt.Sprintf("value checksum 0x%08x does not match catalogue checksum 0x%08x", crc32.Checksum(value, crc32c), rec.Checksum))
+	}
+	return nil
+}
+
+func (d *MotrDatastore) corrupt(key ds.Key, reason string) error {
+	log.Errorf("Corrupt value at key %s (OID %s): %s.", key, getOIDstr(d.getOID(key)), reason)
+	if !d.ReadOnly {
+		t := make([]byte, 8)
+		binary.BigEndian.PutUint64(t, uint64(time.Now().Unix()))
+		if eldb := d.Catalogue.Put(corruptKey(key), t, nil); eldb != nil {
+			log.Errorf("Error recording corrupt key %s in catalogue: %v.", key, eldb)
+		}
+	}
+	return fmt.Errorf("%w at key %s: %s", ErrCorrupt, key, reason)
+}
+
+// CorruptKeys returns the keys found to have corrupt values and when they were found.
+func (d *MotrDatastore) CorruptKeys() (map[ds.Key]time.Time, error) {
+	keys := make(map[ds.Key]time.Time)
+	i := d.Catalogue.NewIterator(util.BytesPrefix(corruptPrefix), nil)
+	defer i.Release()
+	for i.Next() {
+		keys[ds.RawKey(string(i.Key()[len(corruptPrefix):]))] = time.Unix(int64(binary.BigEndian.Uint64(i.Value())), 0)
+	}
+	return keys, i.Error()
+}
+
+// ClearCorrupt removes the record of a key having a corrupt value, e.g. after the
+// value has been repaired in Motr. Putting or deleting the key also removes it.
+func (d *MotrDatastore) ClearCorrupt(key ds.Key) error {
+	return d.Catalogue.Delete(corruptKey(key), nil)
+}
+
+func (d *MotrDatastore) blocksNamespace() ds.Key {
+	if d.BlocksNamespace != "" {
+		return ds.NewKey(d.BlocksNamespace)
+	}
+	return DefaultBlocksNamespace
+}
@@ -0,0 +1,80 @@
+package motrds
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// TestVerifyValues checks that values that don't match the multihash in their block
+// key or the checksum in their catalogue record return ErrCorrupt and are recorded,
+// and that putting or deleting a key clears the record.
+func TestVerifyValues(t *testing.T) {
+	ctx := context.Background()
+	conf := testConfig(t)
+	conf.VerifyValues = true
+	d := openTestDatastore(t, conf)
+	defer d.Close()
+	h, err := mh.Sum([]byte("block"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, other := BlockKey(DefaultBlocksNamespace, h), ds.NewKey("/other/key")
+	for _, key := range []ds.Key{block, other} {
+		v := []byte("block")
+		if key == other {
+			v = []byte("other")
+		}
+		if err := d.Put(ctx, key, v); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := d.Get(ctx, key); err != nil || string(got) != string(v) {
+			t.Fatalf("Get(%s) = %q, %v before the value was changed", key, got, err)
+		}
+		// Same size, so only the multihash or checksum can tell.
+		if err := d.Index.Put(d.getOID(key), []byte("xxxxx"), true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Get(ctx, key); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("Get(%s) returned %v for a changed value", key, err)
+		}
+	}
+	if r, err := d.Query(ctx, query.Query{Prefix: "/other"}); err != nil {
+		t.Fatal(err)
+	} else if _, err := r.Rest(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("query returned %v for a changed value", err)
+	}
+	corrupt, err := d.CorruptKeys()
+	if err != nil || len(corrupt) != 2 || corrupt[block].IsZero() || corrupt[other].IsZero() {
+		t.Fatalf("CorruptKeys = %v, %v", corrupt, err)
+	}
+
+	if err := d.Put(ctx, block, []byte("block")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	if corrupt, err := d.CorruptKeys(); err != nil || len(corrupt) != 0 {
+		t.Fatalf("CorruptKeys = %v, %v after putting and deleting the keys", corrupt, err)
+	}
+	if err := d.Index.Put(d.getOID(block), []byte("xxxxx"), true); err != nil {
+		t.Fatal(err)
+	}
+	d.Get(ctx, block)
+	txn, _ := d.NewTransaction(ctx, false)
+	txn.Put(ctx, block, []byte("block"))
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if corrupt, err := d.CorruptKeys(); err != nil || len(corrupt) != 0 {
+		t.Fatalf("CorruptKeys = %v, %v after a transaction put the key", corrupt, err)
+	}
+	if v, err := d.Get(ctx, block); err != nil || string(v) != "block" {
+		t.Fatalf("Get = %q, %v after the value was put again", v, err)
+	}
+}
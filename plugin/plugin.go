@@ -1,12 +1,17 @@
 package plugin
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/ipfs/go-ipfs/plugin"
 	"github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-ipfs/repo/fsrepo"
 
+	"github.com/allisterb/go-ds-motr/mio"
 	"github.com/allisterb/go-ds-motr/motrds"
 )
 
@@ -59,25 +64,127 @@ func (mp MotrPlugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
 			return nil, fmt.Errorf("motrds: no index specified")
 		}
 
+		var backend string
+		if v, ok := m["backend"]; ok {
+			backend, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("motrds: backend not a string")
+			}
+			switch backend {
+			case mio.MotrBackend, mio.MemoryBackend:
+			default:
+				return nil, fmt.Errorf("motrds: unknown backend %q", backend)
+			}
+		}
+
+		var catalogue, catalogueIdx string
+		if v, ok := m["catalogue"]; ok {
+			catalogue, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("motrds: catalogue not a string")
+			}
+		}
+		switch catalogue {
+		case "", motrds.LevelDBCatalogue, motrds.BadgerCatalogue, motrds.MemoryCatalogue:
+		case motrds.MotrCatalogue:
+			if catalogueIdx, ok = m["catalogueIndex"].(string); !ok {
+				return nil, fmt.Errorf("motrds: no catalogue index specified")
+			}
+		default:
+			return nil, fmt.Errorf("motrds: unknown catalogue %q", catalogue)
+		}
+
 		ldbPath, ok := m["leveldbPath"].(string)
-		if !ok {
+		if !ok && (catalogue == "" || catalogue == motrds.LevelDBCatalogue || catalogue == motrds.BadgerCatalogue) {
 			return nil, fmt.Errorf("motrds: no LevelDB path specified")
 		}
 
 		// Optional
-		var threads int
-		if v, ok := m["threads"]; ok {
-			threadsf, ok := v.(float64)
-			threads = int(threadsf)
-			switch {
-			case !ok:
-				return nil, fmt.Errorf("motrds: threads not a number")
-			case threads <= 0:
-				return nil, fmt.Errorf("motrds: threads <= 0: %f", threadsf)
-			case float64(threads) != threadsf:
-				return nil, fmt.Errorf("motrds: threads is not an integer: %f", threadsf)
+		var threads, recvQueueMinLen, maxRPCMsgSize, queryPrefetch, cacheSize, checkSamples, compressionMinSize int
+		for _, p := range []struct {
+			name string
+			v    *int
+			min  int
+		}{
+			{"threads", &threads, 1},
+			{"recvQueueMinLen", &recvQueueMinLen, 1},
+			{"maxRPCMsgSize", &maxRPCMsgSize, 1},
+			{"queryPrefetch", &queryPrefetch, 1},
+			{"cacheSize", &cacheSize, 0},
+			{"checkSamples", &checkSamples, 1},
+			{"compressionMinSize", &compressionMinSize, 1},
+		} {
+			var err error
+			if *p.v, err = parseInt(m, p.name, p.min); err != nil {
+				return nil, err
+			}
+		}
+		var ttlSweepInterval time.Duration
+		if v, ok := m["ttlSweepInterval"]; ok {
+			intervals, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("motrds: ttlSweepInterval not a string")
+			}
+			var err error
+			if ttlSweepInterval, err = time.ParseDuration(intervals); err != nil {
+				return nil, fmt.Errorf("motrds: ttlSweepInterval is not a duration: %v", err)
+			} else if ttlSweepInterval <= 0 {
+				return nil, fmt.Errorf("motrds: ttlSweepInterval <= 0: %s", intervals)
+			}
+		}
+		var faults []mio.Fault
+		if v, ok := m["faults"]; ok {
+			var err error
+			if faults, err = parseFaults(v); err != nil {
+				return nil, fmt.Errorf("motrds: invalid faults: %v", err)
+			}
+		}
+		var keyScheme string
+		if v, ok := m["keyScheme"]; ok {
+			keyScheme, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("motrds: keyScheme not a string")
+			}
+			if _, err := motrds.NewKeyMapper(keyScheme); err != nil {
+				return nil, err
 			}
 		}
+		var blocksNamespace string
+		if v, ok := m["blocksNamespace"]; ok {
+			blocksNamespace, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("motrds: blocksNamespace not a string")
+			}
+		}
+		var compression string
+		if v, ok := m["compression"]; ok {
+			compression, ok = v.(string)
+			if !ok {
+				return nil, fmt.Errorf("motrds: compression not a string")
+			}
+			switch compression {
+			case motrds.NoCompression, motrds.ZstdCompression, motrds.SnappyCompression:
+			default:
+				return nil, fmt.Errorf("motrds: unknown compression %q", compression)
+			}
+		}
+		var encryption, encryptionKeyFile, encryptionKeyEnv string
+		for name, v := range map[string]*string{"encryption": &encryption, "encryptionKeyFile": &encryptionKeyFile, "encryptionKeyEnv": &encryptionKeyEnv} {
+			if sv, ok := m[name]; ok {
+				if *v, ok = sv.(string); !ok {
+					return nil, fmt.Errorf("motrds: %s not a string", name)
+				}
+			}
+		}
+		switch encryption {
+		case "", motrds.NoEncryption:
+		case motrds.AESGCMEncryption, motrds.XChaCha20Poly1305Encryption:
+			if encryptionKeyFile == "" && encryptionKeyEnv == "" {
+				return nil, fmt.Errorf("motrds: %s encryption needs encryptionKeyFile or encryptionKeyEnv", encryption)
+			}
+		default:
+			return nil, fmt.Errorf("motrds: unknown encryption %q", encryption)
+		}
 		var trace bool = false
 		if v, ok := m["trace"]; ok {
 			trace, ok = v.(bool)
@@ -85,34 +192,206 @@ func (mp MotrPlugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
 				return nil, fmt.Errorf("motrds: trace not a bool")
 			}
 		}
-		return &MotrConfig{
+		var oostore bool = true
+		if v, ok := m["oostore"]; ok {
+			oostore, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("motrds: oostore not a bool")
+			}
+		}
+		var readVerify, createIndexMeta, createIndex bool
+		for name, v := range map[string]*bool{"readVerify": &readVerify, "createIndexMeta": &createIndexMeta, "createIndex": &createIndex} {
+			if bv, ok := m[name]; ok {
+				if *v, ok = bv.(bool); !ok {
+					return nil, fmt.Errorf("motrds: %s not a bool", name)
+				}
+			}
+		}
+		var verifyValues bool = false
+		if v, ok := m["verifyValues"]; ok {
+			verifyValues, ok = v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("motrds: verifyValues not a bool")
+			}
+		}
+		mc := &MotrConfig{
 			cfg: motrds.Config{
-				LocalAddr:       localAddr,
-				HaxAddr:         haxAddr,
-				ProfileFid:      profileFid,
-				LocalProcessFid: processFid,
-				Idx:             idx,
-				LevelDBPath:     ldbPath,
-				Threads:         threads,
-				Trace:           trace,
+				LocalAddr:          localAddr,
+				HaxAddr:            haxAddr,
+				ProfileFid:         profileFid,
+				LocalProcessFid:    processFid,
+				Idx:                idx,
+				Backend:            backend,
+				LevelDBPath:        ldbPath,
+				Threads:            threads,
+				Trace:              trace,
+				RecvQueueMinLen:    recvQueueMinLen,
+				MaxRPCMsgSize:      maxRPCMsgSize,
+				NoOostore:          !oostore,
+				ReadVerify:         readVerify,
+				CreateIndexMeta:    createIndexMeta,
+				CreateIndex:        createIndex,
+				QueryPrefetch:      queryPrefetch,
+				KeyScheme:          keyScheme,
+				BlocksNamespace:    blocksNamespace,
+				CacheSize:          cacheSize,
+				VerifyValues:       verifyValues,
+				Compression:        compression,
+				CompressionMinSize: compressionMinSize,
+				Encryption:         encryption,
+				EncryptionKeyFile:  encryptionKeyFile,
+				EncryptionKeyEnv:   encryptionKeyEnv,
+				CheckSamples:       checkSamples,
+				Faults:             faults,
+				TTLSweepInterval:   ttlSweepInterval,
+				CatalogueBackend:   catalogue,
+				CatalogueIdx:       catalogueIdx,
 			},
-		}, nil
+		}
+		if err := mc.cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("motrds: %v", err)
+		}
+		return mc, nil
+	}
+}
+
+// parseInt reads an optional integer parameter, which JSON decodes as a float64,
+// returning 0 when it isn't set.
+func parseInt(params map[string]interface{}, key string, min int) (int, error) {
+	v, ok := params[key]
+	if !ok {
+		return 0, nil
+	}
+	f, ok := v.(float64)
+	switch {
+	case !ok:
+		return 0, fmt.Errorf("motrds: %s not a number", key)
+	case f != math.Trunc(f):
+		return 0, fmt.Errorf("motrds: %s is not an integer: %f", key, f)
+	case f < float64(min):
+		return 0, fmt.Errorf("motrds: %s < %d: %f", key, min, f)
+	}
+	return int(f), nil
+}
+
+// faultSpec is a fault injected into Motr operations as written in the datastore
+// configuration, with the latency as a duration string.
+type faultSpec struct {
+	Ops         []string `json:"ops,omitempty"`
+	Keys        string   `json:"keys,omitempty"`
+	Probability float64  `json:"probability,omitempty"`
+	After       int      `json:"after,omitempty"`
+	Count       int      `json:"count,omitempty"`
+	Latency     string   `json:"latency,omitempty"`
+	Hang        bool     `json:"hang,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Partial     bool     `json:"partial,omitempty"`
+}
+
+func parseFaults(v interface{}) ([]mio.Fault, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	var specs []faultSpec
+	if err := dec.Decode(&specs); err != nil {
+		return nil, err
+	}
+	faults := make([]mio.Fault, len(specs))
+	for i, s := range specs {
+		faults[i] = mio.Fault{Ops: s.Ops, Keys: s.Keys, Probability: s.Probability, After: s.After, Count: s.Count, Hang: s.Hang, Error: s.Error, Partial: s.Partial}
+		if s.Latency != "" {
+			if faults[i].Latency, err = time.ParseDuration(s.Latency); err != nil {
+				return nil, err
+			}
+		}
 	}
+	if _, err := mio.NewFaultInjector(faults); err != nil {
+		return nil, err
+	}
+	return faults, nil
 }
 
 type MotrConfig struct {
 	cfg motrds.Config
 }
 
+// DiskSpec holds every option of the datastore, which IPFS compares with
+// datastore_spec before opening it. Options left at their zero or default value are
+// omitted so existing datastore_spec files still match, and durations are written
+// the way time.Duration formats them, e.g. 1m0s for 1m.
 func (mc *MotrConfig) DiskSpec() fsrepo.DiskSpec {
-	return fsrepo.DiskSpec{
-		"localAddr":   mc.cfg.LocalAddr,
-		"haxAddr":     mc.cfg.HaxAddr,
-		"profileFid":  mc.cfg.ProfileFid,
-		"processFid":  mc.cfg.LocalProcessFid,
-		"index":       mc.cfg.Idx,
-		"leveldbPath": mc.cfg.LevelDBPath,
+	spec := fsrepo.DiskSpec{
+		"localAddr":  mc.cfg.LocalAddr,
+		"haxAddr":    mc.cfg.HaxAddr,
+		"profileFid": mc.cfg.ProfileFid,
+		"processFid": mc.cfg.LocalProcessFid,
+		"index":      mc.cfg.Idx,
+	}
+	// Only written when set so existing datastore_spec files still match.
+	for name, v := range map[string]string{
+		"leveldbPath":       mc.cfg.LevelDBPath,
+		"backend":           mc.cfg.Backend,
+		"catalogue":         mc.cfg.CatalogueBackend,
+		"catalogueIndex":    mc.cfg.CatalogueIdx,
+		"keyScheme":         mc.cfg.KeyScheme,
+		"blocksNamespace":   mc.cfg.BlocksNamespace,
+		"compression":       mc.cfg.Compression,
+		"encryption":        mc.cfg.Encryption,
+		"encryptionKeyFile": mc.cfg.EncryptionKeyFile,
+		"encryptionKeyEnv":  mc.cfg.EncryptionKeyEnv,
+	} {
+		if v != "" {
+			spec[name] = v
+		}
+	}
+	for name, v := range map[string]int{
+		"threads":            mc.cfg.Threads,
+		"recvQueueMinLen":    mc.cfg.RecvQueueMinLen,
+		"maxRPCMsgSize":      mc.cfg.MaxRPCMsgSize,
+		"queryPrefetch":      mc.cfg.QueryPrefetch,
+		"cacheSize":          mc.cfg.CacheSize,
+		"checkSamples":       mc.cfg.CheckSamples,
+		"compressionMinSize": mc.cfg.CompressionMinSize,
+	} {
+		if v != 0 {
+			spec[name] = v
+		}
+	}
+	for name, v := range map[string]bool{
+		"trace":           mc.cfg.Trace,
+		"readVerify":      mc.cfg.ReadVerify,
+		"createIndexMeta": mc.cfg.CreateIndexMeta,
+		"createIndex":     mc.cfg.CreateIndex,
+		"verifyValues":    mc.cfg.VerifyValues,
+	} {
+		if v {
+			spec[name] = v
+		}
+	}
+	if mc.cfg.NoOostore {
+		spec["oostore"] = false
+	}
+	if mc.cfg.TTLSweepInterval != 0 {
+		spec["ttlSweepInterval"] = mc.cfg.TTLSweepInterval.String()
+	}
+	if len(mc.cfg.Faults) > 0 {
+		// Faults are written as maps so their fields are sorted like the rest of
+		// the spec.
+		faults := make([]map[string]interface{}, len(mc.cfg.Faults))
+		for i, f := range mc.cfg.Faults {
+			s := faultSpec{Ops: f.Ops, Keys: f.Keys, Probability: f.Probability, After: f.After, Count: f.Count, Hang: f.Hang, Error: f.Error, Partial: f.Partial}
+			if f.Latency != 0 {
+				s.Latency = f.Latency.String()
+			}
+			j, _ := json.Marshal(s)
+			json.Unmarshal(j, &faults[i])
+		}
+		spec["faults"] = faults
 	}
+	return spec
 }
 
 func (mc *MotrConfig) Create(path string) (repo.Datastore, error) {
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testSpec = `"localAddr": "inet:tcp:192.168.1.161@22501", "haxAddr": "inet:tcp:192.168.1.161@22001",
+	"profileFid": "0x7000000000000001:0x0", "processFid": "0x7200000000000001:0x3",
+	"index": "0x7800000000000123:0x123456780", "leveldbPath": "/tmp/motrds"`
+
+func parseTestSpec(t *testing.T, params string) (*MotrConfig, error) {
+	t.Helper()
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte("{"+testSpec+params+"}"), &m); err != nil {
+		t.Fatal(err)
+	}
+	dsc, err := MotrPlugin{}.DatastoreConfigParser()(m)
+	if err != nil {
+		return nil, err
+	}
+	return dsc.(*MotrConfig), nil
+}
+
+// TestDatastoreConfigParser checks the parsing and validation of the datastore
+// configuration.
+func TestDatastoreConfigParser(t *testing.T) {
+	for _, c := range []struct {
+		params string
+		err    string
+	}{
+		{``, ""},
+		{`, "threads": 4, "recvQueueMinLen": 16, "maxRPCMsgSize": 65536, "queryPrefetch": 32, "checkSamples": 10, "compressionMinSize": 128`, ""},
+		{`, "cacheSize": 0`, ""},
+		{`, "cacheSize": 268435456`, ""},
+		{`, "threads": "4"`, "threads not a number"},
+		{`, "threads": 0`, "threads < 1"},
+		{`, "recvQueueMinLen": -1`, "recvQueueMinLen < 1"},
+		{`, "maxRPCMsgSize": 1.5`, "maxRPCMsgSize is not an integer"},
+		{`, "queryPrefetch": 0`, "queryPrefetch < 1"},
+		{`, "cacheSize": -1`, "cacheSize < 0"},
+		{`, "checkSamples": true`, "checkSamples not a number"},
+		{`, "compressionMinSize": 0.5`, "compressionMinSize is not an integer"},
+		{`, "ttlSweepInterval": "30s"`, ""},
+		{`, "ttlSweepInterval": "30"`, "ttlSweepInterval is not a duration"},
+		{`, "catalogue": "motr"`, "no catalogue index specified"},
+		{`, "catalogue": "sqlite"`, "unknown catalogue"},
+		{`, "keyScheme": "md5"`, "md5"},
+		{`, "encryption": "aes-gcm"`, "needs encryptionKeyFile or encryptionKeyEnv"},
+		{`, "faults": [{"ops": ["get"], "latency": "1s"}]`, ""},
+		{`, "faults": [{"ops": ["get"], "latency": 1}]`, "invalid faults"},
+		{`, "index": "0x7200000000000123:0x1"`, "invalid index"},
+	} {
+		_, err := parseTestSpec(t, c.params)
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("parsing %s returned %v, want %q", c.params, err, c.err)
+		}
+	}
+}
+
+// TestDiskSpec checks that the disk spec holds every option set in the configuration
+// as it was written, and none of the options left out.
+func TestDiskSpec(t *testing.T) {
+	for _, params := range []string{
+		``,
+		`, "backend": "memory", "catalogue": "motr", "catalogueIndex": "0x7800000000000123:0x1", "keyScheme": "multihash", "blocksNamespace": "/"`,
+		`, "threads": 4, "recvQueueMinLen": 16, "maxRPCMsgSize": 65536, "queryPrefetch": 8, "cacheSize": 1024, "checkSamples": 10,
+		"compression": "zstd", "compressionMinSize": 128, "ttlSweepInterval": "30s", "trace": true, "oostore": false,
+		"readVerify": true, "createIndexMeta": true, "createIndex": true, "verifyValues": true,
+		"encryption": "aes-gcm", "encryptionKeyFile": "/tmp/keys", "encryptionKeyEnv": "KEYS",
+		"faults": [{"ops": ["get"], "keys": "^0x", "probability": 0.5, "after": 1, "count": 2, "latency": "1s", "hang": true, "error": "timeout", "partial": true}]`,
+	} {
+		dsc, err := parseTestSpec(t, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte("{"+testSpec+params+"}"), &m); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.Marshal(m)
+		if got := dsc.DiskSpec().String(); got != string(want) {
+			t.Errorf("disk spec is %s, want %s", got, want)
+		}
+	}
+	// Options set to their defaults are left out.
+	dsc, err := parseTestSpec(t, `, "cacheSize": 0, "oostore": true, "trace": false`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base, _ := parseTestSpec(t, ``); dsc.DiskSpec().String() != base.DiskSpec().String() {
+		t.Errorf("disk spec with default options is %s, want %s", dsc.DiskSpec(), base.DiskSpec())
+	}
+}